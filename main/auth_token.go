@@ -0,0 +1,189 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	authTokenHashPrefix = "$argon2id$"
+	authTokenHashLen    = 32
+	authTokenSaltLen    = 16
+)
+
+// argon2id cost parameters for the hashing of auth tokens (OWASP recommendation),
+// which are variables, so that tests can lower the cost
+var (
+	authTokenHashTime    uint32 = 2
+	authTokenHashMemory  uint32 = 19 * 1024 // KiB
+	authTokenHashThreads uint8  = 1
+)
+
+// bounds for the argon2id parameters of stored auth token hashes, which are checked before the hash is computed
+const (
+	authTokenHashMaxTime    = 10
+	authTokenHashMaxMemory  = 64 * 1024 // KiB
+	authTokenHashMaxThreads = 16
+	authTokenHashMinLen     = 16
+	authTokenHashMaxLen     = 64
+)
+
+// authTokenHashSlots limits the number of concurrent auth token hash computations, which are memory intensive
+var authTokenHashSlots = make(chan struct{}, runtime.NumCPU())
+
+// verifiedAuthToken is a cache entry for an auth token, which was successfully verified against the stored hash.
+// The argon2id hash is deliberately expensive, so it is only computed for the first request with a token.
+type verifiedAuthToken struct {
+	storedHash  string
+	tokenDigest [sha256.Size]byte
+}
+
+// hashAuthToken returns a salted argon2id hash of the auth token in the PHC string format
+// Hashing is deliberately slow, so it must not be called within a transaction.
+func hashAuthToken(authToken string) (string, error) {
+	salt := make([]byte, authTokenSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate salt: %v", err)
+	}
+
+	hash := argon2IDKey([]byte(authToken), salt, authTokenHashTime, authTokenHashMemory, authTokenHashThreads, authTokenHashLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", authTokenHashPrefix, argon2.Version,
+		authTokenHashMemory, authTokenHashTime, authTokenHashThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// isHashedAuthToken checks if the stored auth token is a hash. Otherwise, it is a plaintext
+// auth token, which was stored before auth tokens were hashed.
+func isHashedAuthToken(stored string) bool {
+	return strings.HasPrefix(stored, authTokenHashPrefix)
+}
+
+// verifyAuthToken checks in constant time if the auth token matches the stored auth token,
+// which is either an argon2id hash or a plaintext auth token
+func verifyAuthToken(stored, authToken string) (bool, error) {
+	if !isHashedAuthToken(stored) {
+		return equalAuthTokens(stored, authToken), nil
+	}
+
+	h, err := parseAuthTokenHash(stored)
+	if err != nil {
+		return false, err
+	}
+
+	tokenHash := argon2IDKey([]byte(authToken), h.salt, h.time, h.memory, h.threads, uint32(len(h.hash)))
+
+	return subtle.ConstantTimeCompare(tokenHash, h.hash) == 1, nil
+}
+
+// authTokenHash holds the parameters, salt and hash of an argon2id auth token hash
+type authTokenHash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	hash    []byte
+}
+
+// parseAuthTokenHash parses an argon2id hash in the PHC string format and checks that its parameters are within
+// the bounds, so that the verification of an auth token against the hash can neither panic nor exhaust the memory
+func parseAuthTokenHash(stored string) (*authTokenHash, error) {
+	var version int
+	h := &authTokenHash{}
+
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 || parts[1] != strings.Trim(authTokenHashPrefix, "$") {
+		return nil, fmt.Errorf("invalid auth token hash format")
+	}
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth token hash version: %v", err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth token hash parameters: %v", err)
+	}
+	if h.time < 1 || h.time > authTokenHashMaxTime {
+		return nil, fmt.Errorf("auth token hash parameter t out of range [1, %d]: %d", authTokenHashMaxTime, h.time)
+	}
+	if h.threads < 1 || h.threads > authTokenHashMaxThreads {
+		return nil, fmt.Errorf("auth token hash parameter p out of range [1, %d]: %d", authTokenHashMaxThreads, h.threads)
+	}
+	if h.memory < 8*uint32(h.threads) || h.memory > authTokenHashMaxMemory {
+		return nil, fmt.Errorf("auth token hash parameter m out of range [%d, %d]: %d", 8*uint32(h.threads), authTokenHashMaxMemory, h.memory)
+	}
+
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth token hash salt: %v", err)
+	}
+
+	h.hash, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth token hash: %v", err)
+	}
+	if len(h.hash) < authTokenHashMinLen || len(h.hash) > authTokenHashMaxLen {
+		return nil, fmt.Errorf("auth token hash length out of range [%d, %d]: %d", authTokenHashMinLen, authTokenHashMaxLen, len(h.hash))
+	}
+
+	return h, nil
+}
+
+// argon2IDKey derives the argon2id hash within one of the limited hash computation slots
+func argon2IDKey(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	authTokenHashSlots <- struct{}{}
+	defer func() { <-authTokenHashSlots }()
+
+	return argon2.IDKey(password, salt, time, memory, threads, keyLen)
+}
+
+// equalAuthTokens compares two auth tokens in constant time
+func equalAuthTokens(a, b string) bool {
+	// compare digests of equal length, so that the length of the tokens is not leaked either
+	aDigest, bDigest := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(aDigest[:], bDigest[:]) == 1
+}
+
+// encodeAuthToken replaces a plaintext auth token, which was stored before auth tokens were hashed, with its hash.
+// Only for auth tokens, which were read back from storage: new auth tokens must always be hashed with hashAuthToken,
+// since a new auth token might look like a hash.
+func encodeAuthToken(id *Identity) error {
+	if isHashedAuthToken(id.AuthToken) {
+		return nil
+	}
+
+	hash, err := hashAuthToken(id.AuthToken)
+	if err != nil {
+		return err
+	}
+
+	id.AuthToken = hash
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMain(m *testing.M) {
+	// lower the cost of the auth token hashes, which are computed for every stored test identity
+	authTokenHashTime, authTokenHashMemory = 1, 64
+
+	os.Exit(m.Run())
+}
+
+func TestHashAuthToken(t *testing.T) {
+	authToken := "password1234"
+
+	hash, err := hashAuthToken(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHashedAuthToken(hash) {
+		t.Errorf("unexpected auth token hash format: %s", hash)
+	}
+	if strings.Contains(hash, authToken) {
+		t.Error("auth token hash contains the auth token")
+	}
+
+	otherHash, err := hashAuthToken(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherHash == hash {
+		t.Error("auth token hash is not salted")
+	}
+
+	checkVerifyAuthToken(t, hash, authToken, true)
+	checkVerifyAuthToken(t, hash, "password12345", false)
+	checkVerifyAuthToken(t, hash, "", false)
+}
+
+func TestVerifyAuthToken_Plaintext(t *testing.T) {
+	checkVerifyAuthToken(t, "password1234", "password1234", true)
+	checkVerifyAuthToken(t, "password1234", "password", false)
+	checkVerifyAuthToken(t, "password1234", "", false)
+}
+
+func TestVerifyAuthToken_InvalidHash(t *testing.T) {
+	for _, invalid := range []string{
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA",
+		"$argon2id$v=16$m=65536,t=3,p=4$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=65536$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=65536,t=3,p=4$!$aGFzaA",
+		// parameters out of bounds, which would make argon2 panic or allocate unbounded memory
+		"$argon2id$v=19$m=19456,t=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=19456,t=2,p=0$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=4194304,t=2,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=19456,t=1000000,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=19456,t=2,p=255$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=19456,t=2,p=1000$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+		"$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHQ$",
+	} {
+		_, err := verifyAuthToken(invalid, "password1234")
+		if err == nil {
+			t.Errorf("invalid auth token hash was accepted: %s", invalid)
+		}
+	}
+}
+
+func TestProtocol_StoreNewIdentity_AuthTokenNotHashed(t *testing.T) {
+	dm := NewMemoryContextManager()
+	p := newSecretTestProtocol(t, dm, newTestSecret(), nil)
+
+	privKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKeyPEM, err := p.GetPublicKeyFromPrivateKey(privKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the auth token of a new identity must be hashed by the caller, even if it looks like a hash
+	for _, authToken := range []string{
+		"password1234",
+		"$argon2id$v=19$m=19456,t=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA",
+	} {
+		err = storeIdentity(p, &Identity{
+			Uid:        uuid.New(),
+			PrivateKey: privKeyPEM,
+			PublicKey:  pubKeyPEM,
+			AuthToken:  authToken,
+		}, newDoneWaitGroup())
+		if err == nil {
+			t.Errorf("identity with auth token %q, which is not a valid hash, was stored", authToken)
+		}
+	}
+}
+
+func TestMigrateIdentities_AuthTokenHash(t *testing.T) {
+	dm := NewMemoryContextManager()
+
+	// an imported auth token, which looks like a hash, is hashed like any other auth token
+	authToken := "$argon2id$v=19$m=19456,t=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA"
+
+	id := generateRandomIdentity()
+	id.AuthToken = authToken
+
+	err := migrateIdentities(dm, &[]*Identity{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storedId, err := dm.GetIdentity(id.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedId.AuthToken == authToken {
+		t.Fatal("imported auth token was stored without hashing")
+	}
+
+	checkVerifyAuthToken(t, storedId.AuthToken, authToken, true)
+}
+
+func TestProtocol_CheckAuthToken(t *testing.T) {
+	dm := NewMemoryContextManager()
+	p := newSecretTestProtocol(t, dm, newTestSecret(), nil)
+
+	id := storeSecretTestIdentities(t, p, 1)[0]
+
+	storedId, err := dm.GetIdentity(id.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHashedAuthToken(storedId.AuthToken) {
+		t.Fatal("auth token was not stored as hash")
+	}
+
+	checkProtocolAuthToken(t, p, id, id.AuthToken, true)
+	checkProtocolAuthToken(t, p, id, "password12345", false)
+
+	// verified auth token is cached
+	checkProtocolAuthToken(t, p, id, id.AuthToken, true)
+	checkProtocolAuthToken(t, p, id, "password12345", false)
+}
+
+func TestProtocol_CheckAuthToken_PlaintextMigration(t *testing.T) {
+	dm := NewMemoryContextManager()
+	p := newSecretTestProtocol(t, dm, newTestSecret(), nil)
+
+	id := storeSecretTestIdentities(t, p, 1)[0]
+
+	// auth token was stored in plaintext by a previous version
+	storedId, err := dm.GetIdentity(id.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedId.AuthToken = id.AuthToken
+	updateAndCommit(t, dm, storedId)
+
+	// failed authentication does not migrate the auth token
+	checkProtocolAuthToken(t, p, id, "password12345", false)
+
+	storedId, err = dm.GetIdentity(id.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedId.AuthToken != id.AuthToken {
+		t.Fatal("plaintext auth token was replaced after failed authentication")
+	}
+
+	// successful authentication migrates the auth token
+	checkProtocolAuthToken(t, p, id, id.AuthToken, true)
+
+	storedId, err = dm.GetIdentity(id.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHashedAuthToken(storedId.AuthToken) {
+		t.Fatal("plaintext auth token was not replaced by its hash")
+	}
+
+	checkProtocolAuthToken(t, p, id, id.AuthToken, true)
+	checkProtocolAuthToken(t, p, id, "password12345", false)
+}
+
+func checkVerifyAuthToken(t *testing.T, stored, authToken string, expected bool) {
+	ok, err := verifyAuthToken(stored, authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != expected {
+		t.Errorf("verifyAuthToken returned %t for auth token %q, expected %t", ok, authToken, expected)
+	}
+}
+
+func checkProtocolAuthToken(t *testing.T, p *Protocol, id Identity, authToken string, expected bool) {
+	identity, err := p.GetIdentity(id.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := p.checkAuthToken(identity, authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != expected {
+		t.Errorf("checkAuthToken returned %t for auth token %q, expected %t", ok, authToken, expected)
+	}
+}
+
+// hashTestAuthToken returns the hash of the auth token, as it is stored for an identity
+func hashTestAuthToken(t *testing.T, authToken string) string {
+	hash, err := hashAuthToken(authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// decodeJSON parses a JSON document into a generic value which can be encoded as Canonical CBOR
+// (https://tools.ietf.org/html/rfc7049#section-4.1) without loss of information:
+//
+// 	JSON object  -> map[string]interface{}
+// 	JSON array   -> []interface{}
+// 	JSON string  -> string
+// 	JSON number  -> int64 or uint64 (integer representation) / float64 (fraction or exponent)
+// 	JSON boolean -> bool
+// 	JSON null    -> nil
+//
+// JSON documents with duplicate keys in an object or integers that exceed
+// the value range of CBOR integers are rejected, since they can not be
+// represented deterministically.
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	value, err := decodeJSONValue(decoder, "$")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after top-level JSON value")
+	}
+
+	return value, nil
+}
+
+func decodeJSONValue(decoder *json.Decoder, path string) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON at %s: %v", path, err)
+	}
+
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			return decodeJSONObject(decoder, path)
+		case '[':
+			return decodeJSONArray(decoder, path)
+		default:
+			return nil, fmt.Errorf("invalid JSON at %s: unexpected delimiter %s", path, t)
+		}
+	case json.Number:
+		return convertJSONNumber(t, path)
+	case string, bool, nil:
+		return t, nil
+	default:
+		return nil, fmt.Errorf("invalid JSON at %s: unexpected token %v", path, t)
+	}
+}
+
+func decodeJSONObject(decoder *json.Decoder, path string) (map[string]interface{}, error) {
+	object := map[string]interface{}{}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON at %s: %v", path, err)
+		}
+
+		key, ok := token.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid JSON at %s: object key is not a string", path)
+		}
+
+		if _, exists := object[key]; exists {
+			return nil, fmt.Errorf("JSON object at %s contains duplicate key %q", path, key)
+		}
+
+		object[key], err = decodeJSONValue(decoder, path+"."+key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// consume closing delimiter
+	if _, err := decoder.Token(); err != nil {
+		return nil, fmt.Errorf("invalid JSON at %s: %v", path, err)
+	}
+
+	return object, nil
+}
+
+func decodeJSONArray(decoder *json.Decoder, path string) ([]interface{}, error) {
+	array := []interface{}{}
+
+	for i := 0; decoder.More(); i++ {
+		value, err := decodeJSONValue(decoder, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+
+	// consume closing delimiter
+	if _, err := decoder.Token(); err != nil {
+		return nil, fmt.Errorf("invalid JSON at %s: %v", path, err)
+	}
+
+	return array, nil
+}
+
+// convertJSONNumber converts a JSON number to an integer, if it is in integer representation,
+// or to a floating point number, if it contains a fraction or an exponent.
+func convertJSONNumber(n json.Number, path string) (interface{}, error) {
+	s := n.String()
+
+	if strings.ContainsAny(s, ".eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("JSON number %s at %s can not be represented as CBOR floating point number", s, path)
+		}
+		return f, nil
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return u, nil
+	}
+
+	return nil, fmt.Errorf("JSON integer %s at %s exceeds the value range of CBOR integers", s, path)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestGetCBORFromJSON(t *testing.T) {
+	testCases := []struct {
+		name string
+		json string
+		cbor string
+	}{
+		{"string", `{"test": "hello"}`, "a164746573746568656c6c6f"},
+		{"integer", `{"ts": 1585838578}`, "a16274731a5e85f9f2"},
+		{"negative integer", `{"a": -1}`, "a1616120"},
+		{"max uint64", `{"a": 18446744073709551615}`, "a161611bffffffffffffffff"},
+		{"float", `{"a": 1.5}`, "a16161f93e00"},
+		{"float with integer value", `{"a": 1.0}`, "a16161f93c00"},
+		{"exponent", `{"a": 1e2}`, "a16161f95640"},
+		{"bool and null", `{"a": [true, false, null]}`, "a1616183f5f4f6"},
+		{"nested", `{"a": {"b": [1, {"c": "d"}]}}`, "a16161a161628201a161636164"},
+		{"canonical key order", `{"bb": 1, "a": 2}`, "a261610262626201"},
+		{"top-level array", `[1, 2]`, "820102"},
+	}
+
+	p, _ := setupProtocol(t)
+	coseSigner, err := NewCoseSigner(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			cborBytes, err := coseSigner.GetCBORFromJSON([]byte(c.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(cborBytes) != c.cbor {
+				t.Errorf("unexpected CBOR encoding of %s: expected %s, got %x", c.json, c.cbor, cborBytes)
+			}
+		})
+	}
+}
+
+func TestGetCBORFromJSONInvalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		json string
+	}{
+		{"duplicate key", `{"a": 1, "a": 2}`},
+		{"nested duplicate key", `{"a": [{"b": 1, "b": 1}]}`},
+		{"integer overflow", `{"a": 18446744073709551616}`},
+		{"negative integer overflow", `{"a": -9223372036854775809}`},
+		{"float overflow", `{"a": 1e400}`},
+		{"trailing data", `{"a": 1} {"b": 2}`},
+		{"invalid JSON", `{"a": }`},
+		{"empty", ``},
+	}
+
+	p, _ := setupProtocol(t)
+	coseSigner, err := NewCoseSigner(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := coseSigner.GetCBORFromJSON([]byte(c.json))
+			if err == nil {
+				t.Errorf("no error for invalid JSON %s", c.json)
+			} else {
+				t.Log(err)
+			}
+		})
+	}
+}
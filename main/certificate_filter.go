@@ -0,0 +1,57 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CertificateFilter selects the certificates of the public key certificate list, which are used for the SKID lookup
+type CertificateFilter struct {
+	Types         []string      // accepted certificate types, e.g. "DSC", all types are accepted if empty
+	Countries     []string      // accepted countries of the certificates, all countries are accepted if empty
+	ExpiryWarning time.Duration // time before the expiry of a certificate in use, when a warning is logged
+}
+
+// acceptsEntry returns true, if the type and country of the certificate list entry are accepted
+func (f *CertificateFilter) acceptsEntry(cert Certificate) bool {
+	return acceptsValue(f.Types, cert.CertificateType) && acceptsValue(f.Countries, cert.Country)
+}
+
+// checkValidity returns an error, if the given time is outside the validity period of a certificate
+func checkValidity(notBefore, notAfter, now time.Time) error {
+	if now.Before(notBefore) {
+		return fmt.Errorf("certificate is not valid before %s", notBefore.Format(time.RFC3339))
+	}
+	if now.After(notAfter) {
+		return fmt.Errorf("certificate expired at %s", notAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func acceptsValue(accepted []string, value string) bool {
+	if len(accepted) == 0 {
+		return true
+	}
+
+	for _, a := range accepted {
+		if strings.EqualFold(a, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	certLoadMinBackoff = 10 * time.Second // delay of the first retry after a failed attempt to load the certificate list
+)
+
+// certLoadIntervals returns the interval in which the public key certificate list is reloaded and the duration
+// of failed attempts to load the list, after which the SKID lookup is cleared
+func certLoadIntervals(reloadEveryMinute bool) (interval, maxFailDuration time.Duration) {
+	if reloadEveryMinute {
+		return time.Minute, time.Hour
+	}
+	return time.Hour, 3 * time.Hour
+}
+
+// certListReloader loads the public key certificate list in the regular interval and retries
+// failed attempts with exponential backoff and jitter
+type certListReloader struct {
+	load            func() error
+	clear           func()
+	interval        time.Duration
+	minBackoff      time.Duration
+	maxFailDuration time.Duration
+	changed         <-chan struct{} // notifies changes of the local certificate list files (optional)
+	rand            *rand.Rand
+}
+
+// run loads the certificate list until the context is cancelled
+func (r *certListReloader) run(ctx context.Context) {
+	failures := 0
+	failingSince := time.Time{}
+	cleared := false
+
+	for {
+		var wait time.Duration
+
+		err := r.load()
+		if err != nil {
+			log.Error(err)
+			CertificateListLastFailure.SetToCurrentTime()
+
+			if failures == 0 {
+				failingSince = time.Now()
+			}
+			failures++
+
+			// clear the SKID lookup, if the certificate list could not be loaded for too long
+			if !cleared && time.Since(failingSince) >= r.maxFailDuration {
+				log.Warnf("clearing local KID lookup after %d failed attempts to load public key certificate list", failures)
+				r.clear()
+				cleared = true
+			}
+
+			wait = r.retryDelay(failures, err)
+			log.Debugf("loading certificate list failed %d times, retrying in %s", failures, wait)
+		} else {
+			CertificateListLastSuccess.SetToCurrentTime()
+
+			failures = 0
+			cleared = false
+			wait = r.interval
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Debug("stopped reloading public key certificate list")
+			return
+		case <-r.changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryDelay returns the delay before the next attempt after the given number of failed attempts.
+// The delay doubles with every failed attempt up to the regular interval and is randomized by up
+// to half of its duration. A delay requested by the server with a Retry-After header is honoured up to
+// the regular interval, so that a misbehaving server can not suspend the reloads arbitrarily long.
+func (r *certListReloader) retryDelay(failures int, err error) time.Duration {
+	backoff := r.minBackoff
+	for i := 1; i < failures && backoff < r.interval; i++ {
+		backoff *= 2
+	}
+	if backoff > r.interval {
+		backoff = r.interval
+	}
+
+	delay := backoff/2 + time.Duration(r.rand.Int63n(int64(backoff/2)+1))
+
+	var retryAfterErr *retryAfterError
+	if errors.As(err, &retryAfterErr) && retryAfterErr.retryAfter > delay {
+		delay = retryAfterErr.retryAfter
+		if delay > r.interval {
+			delay = r.interval
+		}
+	}
+
+	return delay
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCertListReloader(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		loads   int
+		clears  int
+		results = []error{fmt.Errorf("unavailable"), fmt.Errorf("unavailable"), nil}
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := newTestCertListReloader()
+	r.load = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		loads++
+		if loads > len(results) {
+			cancel()
+			return nil
+		}
+		return results[loads-1]
+	}
+	r.clear = func() {
+		mu.Lock()
+		clears++
+		mu.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reloader did not stop after context cancellation")
+	}
+
+	if loads != len(results)+1 {
+		t.Errorf("unexpected number of attempts to load the certificate list: %d", loads)
+	}
+	if clears != 0 {
+		t.Error("SKID lookup was cleared before the maximum duration of failed attempts")
+	}
+
+	lastSuccess := testutil.ToFloat64(CertificateListLastSuccess)
+	lastFailure := testutil.ToFloat64(CertificateListLastFailure)
+	if lastSuccess == 0 || lastFailure == 0 || lastFailure > lastSuccess {
+		t.Errorf("unexpected timestamps of last success (%f) and failure (%f)", lastSuccess, lastFailure)
+	}
+}
+
+func TestCertListReloader_Clear(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	loads := 0
+	clears := 0
+
+	r := newTestCertListReloader()
+	r.maxFailDuration = 20 * time.Millisecond
+	r.load = func() error {
+		loads++
+		if loads == 10 {
+			cancel()
+		}
+		return fmt.Errorf("unavailable")
+	}
+	r.clear = func() {
+		clears++
+	}
+
+	r.run(ctx)
+
+	if clears != 1 {
+		t.Errorf("SKID lookup was cleared %d times, expected once", clears)
+	}
+}
+
+func TestCertListReloader_FileChanged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan struct{}, 1)
+
+	loads := 0
+
+	r := newTestCertListReloader()
+	r.interval = time.Hour
+	r.changed = changed
+	r.load = func() error {
+		loads++
+		if loads == 2 {
+			cancel()
+		} else {
+			changed <- struct{}{}
+		}
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cancel()
+		t.Fatal("certificate list was not reloaded after file change")
+	}
+}
+
+func TestCertListReloader_RetryDelay(t *testing.T) {
+	r := newTestCertListReloader()
+	r.minBackoff = 10 * time.Second
+	r.interval = time.Hour
+
+	testCases := []struct {
+		failures int
+		err      error
+		min, max time.Duration
+	}{
+		{failures: 1, err: fmt.Errorf("unavailable"), min: 5 * time.Second, max: 10 * time.Second},
+		{failures: 2, err: fmt.Errorf("unavailable"), min: 10 * time.Second, max: 20 * time.Second},
+		{failures: 5, err: fmt.Errorf("unavailable"), min: 80 * time.Second, max: 160 * time.Second},
+		{failures: 100, err: fmt.Errorf("unavailable"), min: 30 * time.Minute, max: time.Hour},
+		{failures: 1, err: &retryAfterError{err: fmt.Errorf("unavailable"), retryAfter: 2 * time.Minute}, min: 2 * time.Minute, max: 2 * time.Minute},
+		{failures: 100, err: &retryAfterError{err: fmt.Errorf("unavailable"), retryAfter: time.Second}, min: 30 * time.Minute, max: time.Hour},
+		{failures: 1, err: &retryAfterError{err: fmt.Errorf("unavailable"), retryAfter: 24 * time.Hour}, min: time.Hour, max: time.Hour},
+	}
+
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("%d failures: %v", c.failures, c.err), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := r.retryDelay(c.failures, fmt.Errorf("wrapped: %w", c.err))
+				if delay < c.min || delay > c.max {
+					t.Fatalf("retry delay %s out of range [%s, %s]", delay, c.min, c.max)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		value      string
+		retryAfter time.Duration
+		ok         bool
+	}{
+		{value: "", ok: false},
+		{value: "120", retryAfter: 2 * time.Minute, ok: true},
+		{value: "-1", ok: false},
+		{value: now.Add(time.Hour).Format(http.TimeFormat), retryAfter: time.Hour, ok: true},
+		{value: now.Add(-time.Hour).Format(http.TimeFormat), retryAfter: 0, ok: true},
+		{value: "tomorrow", ok: false},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.value, func(t *testing.T) {
+			retryAfter, ok := parseRetryAfter(c.value, now)
+			if ok != c.ok || retryAfter != c.retryAfter {
+				t.Errorf("unexpected result: %s, %t", retryAfter, ok)
+			}
+		})
+	}
+}
+
+func newTestCertListReloader() *certListReloader {
+	return &certListReloader{
+		interval:        10 * time.Millisecond,
+		minBackoff:      time.Millisecond,
+		maxFailDuration: time.Hour,
+		rand:            rand.New(rand.NewSource(1)),
+		clear:           func() {},
+	}
+}
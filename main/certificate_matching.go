@@ -0,0 +1,246 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certMatch is the result of matching a certificate of the public key certificate list with the known identities
+type certMatch struct {
+	uid       uuid.UUID // UUID of the identity with the public key of the certificate, uuid.Nil if there is none
+	pubKeyPEM []byte
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// matchedCertificate is a certificate of the public key certificate list, which matches a known identity
+type matchedCertificate struct {
+	Certificate
+	*certMatch
+}
+
+// certMatchCache keeps the results of matching the certificates of the last processed public key certificate
+// list, so that only new certificates need to be parsed and looked up when the list is reloaded
+type certMatchCache struct {
+	mutex      sync.Mutex
+	matches    map[string]*certMatch // {<thumbprint>: <*certMatch>}, nil if the identities changed
+	signature  string                // signature of the last processed certificate list
+	validUntil time.Time             // time until which the SKIDs of the last processed list are up to date
+	generation uint64                // incremented with every change of the identities
+	changedTx  map[interface{}]bool  // open transactions, which changed public keys of identities
+}
+
+// invalidateCertMatches makes sure that all certificates are matched again with the identities on the next reload
+func (p *Protocol) invalidateCertMatches() {
+	p.certMatches.mutex.Lock()
+	defer p.certMatches.mutex.Unlock()
+
+	p.certMatches.matches = nil
+	p.certMatches.signature = ""
+	p.certMatches.generation++
+}
+
+// markPubKeysChanged remembers that public keys of identities were changed within the transaction,
+// so that the certificate matches are invalidated as soon as the transaction was committed
+func (p *Protocol) markPubKeysChanged(tx interface{}) {
+	p.certMatches.mutex.Lock()
+	defer p.certMatches.mutex.Unlock()
+
+	if p.certMatches.changedTx == nil {
+		p.certMatches.changedTx = map[interface{}]bool{}
+	}
+	p.certMatches.changedTx[tx] = true
+}
+
+// pubKeysChanged returns true, if public keys of identities were changed within the transaction,
+// and forgets the transaction
+func (p *Protocol) pubKeysChanged(tx interface{}) bool {
+	p.certMatches.mutex.Lock()
+	defer p.certMatches.mutex.Unlock()
+
+	changed := p.certMatches.changedTx[tx]
+	delete(p.certMatches.changedTx, tx)
+
+	return changed
+}
+
+func (p *Protocol) certMatchGeneration() uint64 {
+	p.certMatches.mutex.Lock()
+	defer p.certMatches.mutex.Unlock()
+
+	return p.certMatches.generation
+}
+
+// certListUnchanged returns true, if the certificate list with the given signature was
+// already processed and the resulting SKIDs are still up to date
+func (p *Protocol) certListUnchanged(signedList []byte) bool {
+	p.certMatches.mutex.Lock()
+	defer p.certMatches.mutex.Unlock()
+
+	return p.certMatches.matches != nil &&
+		p.certMatches.signature == certListSignature(signedList) &&
+		(p.certMatches.validUntil.IsZero() || time.Now().Before(p.certMatches.validUntil))
+}
+
+// setCertListProcessed remembers the signature of the processed certificate list, unless
+// the identities changed since the given generation while the list was processed
+func (p *Protocol) setCertListProcessed(signedList []byte, generation uint64) {
+	p.certMatches.mutex.Lock()
+	defer p.certMatches.mutex.Unlock()
+
+	if p.certMatches.matches == nil || p.certMatches.generation != generation {
+		return
+	}
+
+	p.certMatches.signature = certListSignature(signedList)
+}
+
+// setCertMatchesValidUntil sets the time until which the SKIDs from the processed certificate list are up to date
+func (p *Protocol) setCertMatchesValidUntil(validUntil time.Time) {
+	p.certMatches.mutex.Lock()
+	p.certMatches.validUntil = validUntil
+	p.certMatches.mutex.Unlock()
+}
+
+// matchCertificates returns the certificates, which match the public key of a known identity, in the order of the
+// list. Only the certificates, which were not contained in the previously processed list, are parsed and their
+// public keys are looked up with a single query.
+func (p *Protocol) matchCertificates(certs []Certificate) []matchedCertificate {
+	p.certMatches.mutex.Lock()
+	prevMatches := p.certMatches.matches
+	generation := p.certMatches.generation
+	p.certMatches.mutex.Unlock()
+
+	matches := make(map[string]*certMatch, len(certs))
+	var newMatches []*certMatch
+	var lookup [][]byte
+
+	for _, cert := range certs {
+		if !p.certFilter.acceptsEntry(cert) {
+			continue
+		}
+
+		thumbprint := certThumbprint(cert)
+		if _, found := matches[thumbprint]; found {
+			continue
+		}
+
+		if m, found := prevMatches[thumbprint]; found {
+			matches[thumbprint] = m
+			continue
+		}
+
+		m := &certMatch{}
+		matches[thumbprint] = m
+
+		kid := base64.StdEncoding.EncodeToString(cert.Kid)
+
+		// get public key from certificate
+		certificate, err := x509.ParseCertificate(cert.RawData)
+		if err != nil {
+			log.Errorf("%s: %v", kid, err)
+			continue
+		}
+		m.notBefore = certificate.NotBefore
+		m.notAfter = certificate.NotAfter
+
+		pubKeyPEM, err := encodePKIXPublicKey(certificate.PublicKey)
+		if err != nil {
+			continue
+		}
+
+		// skip public keys of algorithms, which are not used by identities
+		if _, err = decodePublicKeyBytes(pubKeyPEM); err != nil {
+			log.Debugf("%s: %v", kid, err)
+			continue
+		}
+
+		m.pubKeyPEM = pubKeyPEM
+		newMatches = append(newMatches, m)
+		lookup = append(lookup, pubKeyPEM)
+	}
+
+	// look up matching UUIDs for the public keys of the new certificates
+	uids, err := p.GetUuidsForPublicKeys(lookup)
+	if err != nil {
+		log.Errorf("looking up public keys of %d new certificates failed: %v", len(lookup), err)
+	}
+	for _, m := range newMatches {
+		m.uid = uids[string(m.pubKeyPEM)]
+	}
+
+	log.Debugf("matching %d certificates, %d new", len(matches), len(lookup))
+
+	p.certMatches.mutex.Lock()
+	if err == nil && p.certMatches.generation == generation {
+		p.certMatches.matches = matches
+	} else {
+		p.certMatches.matches = nil
+	}
+	p.certMatches.signature = ""
+	p.certMatches.mutex.Unlock()
+
+	var matched []matchedCertificate
+	for _, cert := range certs {
+		if !p.certFilter.acceptsEntry(cert) {
+			continue
+		}
+
+		m := matches[certThumbprint(cert)]
+		if m.uid != uuid.Nil {
+			matched = append(matched, matchedCertificate{Certificate: cert, certMatch: m})
+		}
+	}
+
+	return matched
+}
+
+// certThumbprint returns the thumbprint of the certificate from the list or,
+// if the list does not contain it, the SHA-256 hash of the certificate
+func certThumbprint(cert Certificate) string {
+	if cert.ThumbprintHEX != "" {
+		return strings.ToLower(cert.ThumbprintHEX)
+	}
+
+	thumbprint := sha256.Sum256(cert.RawData)
+	return hex.EncodeToString(thumbprint[:])
+}
+
+// certListSignature returns the signature of a signed public key certificate list
+func certListSignature(signedList []byte) string {
+	return strings.SplitN(string(signedList), "\n", 2)[0]
+}
+
+// earliestFuture returns the earliest of the given times, which is after now and before t.
+// Returns t, if there is no such time. A zero t is later than all times.
+func earliestFuture(now, t time.Time, times ...time.Time) time.Time {
+	for _, c := range times {
+		if c.After(now) && (t.IsZero() || c.Before(t)) {
+			t = c
+		}
+	}
+	return t
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// modes for the authorization of signing requests with client certificates
+const (
+	clientCertAuthAlternative = "alternative" // a client certificate of the identity replaces the auth token
+	clientCertAuthAddition    = "addition"    // a client certificate of the identity is required in addition to the auth token
+
+	uuidURNPrefix = "urn:uuid:"
+)
+
+// newClientCertTLSConfig returns a TLS server configuration, which verifies client certificates
+// with the CA certificates from the given PEM file
+func newClientCertTLSConfig(clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	caPEM, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client CA file: %v", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no CA certificates found in client CA file %s", clientCAFile)
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return &tls.Config{
+		ClientCAs:  clientCAs,
+		ClientAuth: clientAuth,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// checkClientCert checks if the request has a verified client certificate, which belongs to the identity with the
+// given UUID. Returns true, if the client certificate authorizes the request without auth token.
+func checkClientCert(r *http.Request, mode string, uid uuid.UUID) (authorized bool, err error) {
+	if mode == "" {
+		return false, nil
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		if mode == clientCertAuthAddition {
+			return false, fmt.Errorf("missing client certificate")
+		}
+		return false, nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	for _, certUid := range certificateUUIDs(cert) {
+		if certUid == uid {
+			return mode == clientCertAuthAlternative, nil
+		}
+	}
+
+	return false, fmt.Errorf("client certificate does not belong to UUID %s", uid)
+}
+
+// certificateUUIDs returns the UUIDs from the subject common name and from the DNS and URI
+// ("urn:uuid:<uuid>") subject alternative names of the certificate
+func certificateUUIDs(cert *x509.Certificate) []uuid.UUID {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		if s := uri.String(); strings.HasPrefix(strings.ToLower(s), uuidURNPrefix) {
+			names = append(names, s[len(uuidURNPrefix):])
+		}
+	}
+
+	var uids []uuid.UUID
+	for _, name := range names {
+		// uuid.Parse accepts the URN form as well, which is only expected in URI SANs
+		if len(name) != 36 {
+			continue
+		}
+
+		uid, err := uuid.Parse(name)
+		if err == nil {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
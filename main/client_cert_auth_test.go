@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testCA issues client certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	priv *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, priv: priv}
+}
+
+func (ca *testCA) writePEM(t *testing.T) string {
+	caFile := filepath.Join(t.TempDir(), "client_ca.pem")
+
+	err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caFile
+}
+
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) tls.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &priv.PublicKey, ca.priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: priv}
+}
+
+func TestCertificateUUIDs(t *testing.T) {
+	uid2, uid3 := uuid.New(), uuid.New()
+
+	uri, err := url.Parse(uuidURNPrefix + uid3.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: uid.String()},
+		DNSNames: []string{"device.example.com", uid2.String()},
+		URIs:     []*url.URL{uri, {Scheme: "https", Host: "example.com", Path: "/" + uuid.NewString()}},
+	}
+
+	uids := certificateUUIDs(cert)
+	if len(uids) != 3 || uids[0] != uid || uids[1] != uid2 || uids[2] != uid3 {
+		t.Errorf("unexpected UUIDs of certificate: %v", uids)
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := newTestCA(t)
+
+	tlsConfig, err := newClientCertTLSConfig(ca.writePEM(t), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identityCert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: uid.String()}})
+	otherCert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: uuid.NewString()}})
+	untrustedCert := newTestCA(t).issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: uid.String()}})
+
+	testCases := []struct {
+		name       string
+		mode       string
+		cert       *tls.Certificate
+		authToken  string
+		authorized bool
+	}{
+		{name: "alternative: certificate", mode: clientCertAuthAlternative, cert: &identityCert, authorized: true},
+		{name: "alternative: auth token", mode: clientCertAuthAlternative, authToken: "password1234", authorized: true},
+		{name: "alternative: certificate of other identity", mode: clientCertAuthAlternative, cert: &otherCert, authToken: "password1234", authorized: false},
+		{name: "alternative: no credentials", mode: clientCertAuthAlternative, authorized: false},
+		{name: "addition: certificate and auth token", mode: clientCertAuthAddition, cert: &identityCert, authToken: "password1234", authorized: true},
+		{name: "addition: certificate", mode: clientCertAuthAddition, cert: &identityCert, authorized: false},
+		{name: "addition: auth token", mode: clientCertAuthAddition, authToken: "password1234", authorized: false},
+		{name: "disabled: auth token", authToken: "password1234", authorized: true},
+		{name: "disabled: certificate", cert: &identityCert, authorized: false},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			coseSigner, _ := setupCoseVerifier(t)
+
+			service := &COSEService{
+				CoseSigner:     coseSigner,
+				clientCertAuth: c.mode,
+			}
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _, ok := service.getAuthorizedIdentity(w, r, uid)
+				if ok {
+					w.WriteHeader(http.StatusOK)
+				}
+			}))
+			server.TLS = tlsConfig.Clone()
+			server.StartTLS()
+			defer server.Close()
+
+			client := server.Client()
+			if c.cert != nil {
+				client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{*c.cert}
+			}
+
+			req, err := http.NewRequest(http.MethodPost, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.authToken != "" {
+				req.Header.Set(AuthHeader, c.authToken)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+
+			if c.authorized != (resp.StatusCode == http.StatusOK) {
+				t.Errorf("unexpected response status code: %d", resp.StatusCode)
+			}
+		})
+	}
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = tlsConfig.Clone()
+		server.StartTLS()
+		defer server.Close()
+
+		client := server.Client()
+		client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{untrustedCert}
+
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+			t.Error("untrusted client certificate was accepted")
+		}
+	})
+}
+
+func TestClientCertTLSConfig_RequireClientCert(t *testing.T) {
+	tlsConfig, err := newClientCertTLSConfig(newTestCA(t).writePEM(t), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err == nil {
+		_ = resp.Body.Close()
+		t.Error("connection without client certificate was accepted")
+	}
+}
+
+func TestConfig_ClientCertAuth(t *testing.T) {
+	testCases := []struct {
+		name  string
+		conf  Config
+		valid bool
+	}{
+		{name: "disabled", conf: Config{}, valid: true},
+		{name: "default mode", conf: Config{TLS: true, TLS_ClientCAFile: "ca.pem"}, valid: true},
+		{name: "addition", conf: Config{TLS: true, TLS_ClientCAFile: "ca.pem", TLS_ClientCertAuth: clientCertAuthAddition}, valid: true},
+		{name: "invalid mode", conf: Config{TLS: true, TLS_ClientCAFile: "ca.pem", TLS_ClientCertAuth: "always"}, valid: false},
+		{name: "without TLS", conf: Config{TLS_ClientCAFile: "ca.pem"}, valid: false},
+		{name: "without client CA", conf: Config{TLS: true, TLS_RequireClientCert: true}, valid: false},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.conf.setDefaultClientCertAuth()
+			if c.valid && err != nil {
+				t.Error(err)
+			}
+			if !c.valid && err == nil {
+				t.Error("invalid configuration was accepted")
+			}
+		})
+	}
+}
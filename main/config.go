@@ -17,7 +17,6 @@ package main
 import (
 	"crypto/sha256"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -41,8 +40,10 @@ const (
 	defaultIdentityURL = "https://identity.%s.ubirch.com/api/certs/v1/csr/register"
 	//defaultSigningServiceURL = "http://localhost:8080"
 
-	identitiesFileName = "identities.json"
-	TLSCertsFileName   = "%s_ubirch_tls_certs.json"
+	identitiesFileName   = "identities.json"
+	trustListFileName    = "trust_list.json"
+	trustListKeyFileName = "trust_list_key.pem"
+	TLSCertsFileName     = "%s_ubirch_tls_certs.json"
 
 	defaultCSRCountry      = "DE"
 	defaultCSROrganization = "ubirch GmbH"
@@ -52,6 +53,15 @@ const (
 	defaultTLSCertFile = "cert.pem"
 	defaultTLSKeyFile  = "key.pem"
 
+	defaultMaxBatchSize = 100
+
+	defaultKeyRotationGracePeriod = 720 // hours (30 days)
+
+	defaultCertExpiryWarning = 720 // hours (30 days)
+
+	defaultReadinessMaxCertAge         = 180 // minutes
+	defaultReadinessMaxCertAgeMinutely = 60  // minutes, if the certificate list is reloaded every minute
+
 	defaultDbMaxOpenConns    = 10
 	defaultDbMaxIdleConns    = 10
 	defaultDbConnMaxLifetime = 10
@@ -60,31 +70,66 @@ const (
 
 type Config struct {
 	Tokens                  map[uuid.UUID]string `json:"tokens"`
-	SecretBase64            string               `json:"secret32" envconfig:"SECRET32"`                                 // 32 byte secret used to encrypt the key store (mandatory)
-	RegisterAuth            string               `json:"registerAuth" envconfig:"REGISTERAUTH"`                         // auth token needed for new identity registration
-	Env                     string               `json:"env"`                                                           // the ubirch backend environment [dev, demo, prod], defaults to 'prod'
-	PostgresDSN             string               `json:"postgresDSN" envconfig:"POSTGRES_DSN"`                          // data source name for postgres database
-	DbMaxOpenConns          string               `json:"dbMaxOpenConns" envconfig:"DB_MAX_OPEN_CONNS"`                  // maximum number of open connections to the database
-	DbMaxIdleConns          string               `json:"dbMaxIdleConns" envconfig:"DB_MAX_IDLE_CONNS"`                  // maximum number of connections in the idle connection pool
-	DbConnMaxLifetime       string               `json:"dbConnMaxLifetime" envconfig:"DB_CONN_MAX_LIFETIME"`            // maximum amount of time in minutes a connection may be reused
-	DbConnMaxIdleTime       string               `json:"dbConnMaxIdleTime" envconfig:"DB_CONN_MAX_IDLE_TIME"`           // maximum amount of time in minutes a connection may be idle
-	TCP_addr                string               `json:"TCP_addr"`                                                      // the TCP address for the server to listen on, in the form "host:port"
-	TLS                     bool                 `json:"TLS"`                                                           // enable serving HTTPS endpoints, defaults to 'false'
-	TLS_CertFile            string               `json:"TLSCertFile"`                                                   // filename of TLS certificate file name, defaults to "cert.pem"
-	TLS_KeyFile             string               `json:"TLSKeyFile"`                                                    // filename of TLS key file name, defaults to "key.pem"
-	CSR_Country             string               `json:"CSR_country"`                                                   // subject country for public key Certificate Signing Requests
-	CSR_Organization        string               `json:"CSR_organization"`                                              // subject organization for public key Certificate Signing Requests
-	Debug                   bool                 `json:"debug"`                                                         // enable extended debug output, defaults to 'false'
-	LogTextFormat           bool                 `json:"logTextFormat"`                                                 // log in text format for better human readability, default format is JSON
-	CertificateServer       string               `json:"certificateServer" envconfig:"CERTIFICATE_SERVER"`              // public key certificate list server URL
-	CertificateServerPubKey string               `json:"certificateServerPubKey" envconfig:"CERTIFICATE_SERVER_PUBKEY"` // public key for verification of the public key certificate list signature server URL
-	ReloadCertsEveryMinute  bool                 `json:"reloadCertsEveryMinute" envconfig:"RELOAD_CERTS_EVERY_MINUTE"`  // setting to make the service request the public key certificate list once a minute
+	SecretBase64            string               `json:"secret32" envconfig:"SECRET32"`                                    // 32 byte secret used to encrypt the key store (mandatory)
+	SecretFile              string               `json:"secret32File" envconfig:"SECRET32_FILE"`                           // path to a file, which contains the base64 encoded secret, alternative to 'secret32'
+	SecretCommand           string               `json:"secret32Command" envconfig:"SECRET32_COMMAND"`                     // command, which writes the base64 encoded secret to stdout, alternative to 'secret32'
+	SecretVaultURL          string               `json:"secret32VaultURL" envconfig:"SECRET32_VAULT_URL"`                  // URL of a Vault-compatible KV endpoint, which holds the base64 encoded secret, alternative to 'secret32'
+	SecretVaultKey          string               `json:"secret32VaultKey" envconfig:"SECRET32_VAULT_KEY"`                  // key of the secret in the KV endpoint data, defaults to 'secret32'
+	VaultToken              string               `json:"vaultToken" envconfig:"VAULT_TOKEN"`                               // token for authentication at the KV endpoint
+	PreviousSecretBase64    string               `json:"previousSecret32" envconfig:"PREVIOUS_SECRET32"`                   // 32 byte secret, which was used to encrypt the key store before the secret was rotated (optional)
+	PreviousSecretFile      string               `json:"previousSecret32File" envconfig:"PREVIOUS_SECRET32_FILE"`          // path to a file, which contains the base64 encoded previous secret, alternative to 'previousSecret32'
+	PreviousSecretCommand   string               `json:"previousSecret32Command" envconfig:"PREVIOUS_SECRET32_COMMAND"`    // command, which writes the base64 encoded previous secret to stdout, alternative to 'previousSecret32'
+	PreviousSecretVaultURL  string               `json:"previousSecret32VaultURL" envconfig:"PREVIOUS_SECRET32_VAULT_URL"` // URL of a Vault-compatible KV endpoint, which holds the base64 encoded previous secret, alternative to 'previousSecret32'
+	PreviousSecretVaultKey  string               `json:"previousSecret32VaultKey" envconfig:"PREVIOUS_SECRET32_VAULT_KEY"` // key of the previous secret in the KV endpoint data, defaults to 'previousSecret32'
+	RegisterAuth            string               `json:"registerAuth" envconfig:"REGISTERAUTH"`                            // auth token needed for new identity registration
+	Env                     string               `json:"env"`                                                              // the ubirch backend environment [dev, demo, prod], defaults to 'prod'
+	PostgresDSN             string               `json:"postgresDSN" envconfig:"POSTGRES_DSN"`                             // data source name for postgres database
+	SqliteDSN               string               `json:"sqliteDSN" envconfig:"SQLITE_DSN"`                                 // data source name for SQLite database (path to the database file), alternative to postgres
+	InMemory                bool                 `json:"inMemory" envconfig:"IN_MEMORY"`                                   // keep identities in memory only, all identities are lost on shutdown (for ephemeral or demo deployments), defaults to 'false'
+	FileStore               bool                 `json:"fileStore" envconfig:"FILE_STORE"`                                 // store identities in files in the configuration directory instead of a database, defaults to 'false'
+	DbMaxOpenConns          string               `json:"dbMaxOpenConns" envconfig:"DB_MAX_OPEN_CONNS"`                     // maximum number of open connections to the database
+	DbMaxIdleConns          string               `json:"dbMaxIdleConns" envconfig:"DB_MAX_IDLE_CONNS"`                     // maximum number of connections in the idle connection pool
+	DbConnMaxLifetime       string               `json:"dbConnMaxLifetime" envconfig:"DB_CONN_MAX_LIFETIME"`               // maximum amount of time in minutes a connection may be reused
+	DbConnMaxIdleTime       string               `json:"dbConnMaxIdleTime" envconfig:"DB_CONN_MAX_IDLE_TIME"`              // maximum amount of time in minutes a connection may be idle
+	TCP_addr                string               `json:"TCP_addr"`                                                         // the TCP address for the server to listen on, in the form "host:port"
+	TLS                     bool                 `json:"TLS"`                                                              // enable serving HTTPS endpoints, defaults to 'false'
+	TLS_CertFile            string               `json:"TLSCertFile"`                                                      // filename of TLS certificate file name, defaults to "cert.pem"
+	TLS_KeyFile             string               `json:"TLSKeyFile"`                                                       // filename of TLS key file name, defaults to "key.pem"
+	TLS_ClientCAFile        string               `json:"TLSClientCAFile"`                                                  // filename of a PEM file with the CA certificates for the verification of client certificates, enables mutual TLS
+	TLS_RequireClientCert   bool                 `json:"TLSRequireClientCert"`                                             // reject connections without valid client certificate, defaults to 'false'
+	TLS_ClientCertAuth      string               `json:"TLSClientCertAuth"`                                                // how client certificates authorize signing requests [alternative, addition] (to the auth token), defaults to 'alternative'
+	CSR_Country             string               `json:"CSR_country"`                                                      // subject country for public key Certificate Signing Requests
+	CSR_Organization        string               `json:"CSR_organization"`                                                 // subject organization for public key Certificate Signing Requests
+	Debug                   bool                 `json:"debug"`                                                            // enable extended debug output, defaults to 'false'
+	LogTextFormat           bool                 `json:"logTextFormat"`                                                    // log in text format for better human readability, default format is JSON
+	CertificateServer       string               `json:"certificateServer" envconfig:"CERTIFICATE_SERVER"`                 // public key certificate list server URL
+	CertificateServerPubKey string               `json:"certificateServerPubKey" envconfig:"CERTIFICATE_SERVER_PUBKEY"`    // public key for verification of the public key certificate list signature server URL
+	CertificateListFile     string               `json:"certificateListFile" envconfig:"CERTIFICATE_LIST_FILE"`            // path to a local file with the signed public key certificate list, replaces 'certificateServer' for offline operation
+	CertificateListKeyFile  string               `json:"certificateListKeyFile" envconfig:"CERTIFICATE_LIST_KEY_FILE"`     // path to a local file with the PEM encoded public key for verification of the public key certificate list signature
+	CertificateTypes        []string             `json:"certificateTypes" envconfig:"CERTIFICATE_TYPES"`                   // accepted types of the certificates in the public key certificate list, e.g. 'DSC', defaults to all types
+	CertificateCountries    []string             `json:"certificateCountries" envconfig:"CERTIFICATE_COUNTRIES"`           // accepted countries of the certificates in the public key certificate list, defaults to all countries
+	CertExpiryWarning       int                  `json:"certExpiryWarning" envconfig:"CERT_EXPIRY_WARNING"`                // time in hours before the expiry of a public key certificate in use, when a warning is logged, defaults to 720 (30 days)
+	ReloadCertsEveryMinute  bool                 `json:"reloadCertsEveryMinute" envconfig:"RELOAD_CERTS_EVERY_MINUTE"`     // setting to make the service request the public key certificate list once a minute
+	SigningAlgorithm        string               `json:"signingAlgorithm" envconfig:"SIGNING_ALGORITHM"`                   // default signing algorithm for new identities [ES256, ES384, ES512, EdDSA], defaults to 'ES256'
+	MaxBatchSize            int                  `json:"maxBatchSize" envconfig:"MAX_BATCH_SIZE"`                          // maximum number of items in a batch signing request, defaults to 100
+	KeyRotationGracePeriod  int                  `json:"keyRotationGracePeriod" envconfig:"KEY_ROTATION_GRACE_PERIOD"`     // time in hours a replaced key is kept after key rotation, defaults to 720 (30 days)
+	PKCS11Module            string               `json:"pkcs11Module" envconfig:"PKCS11_MODULE"`                           // path to a PKCS#11 module (e.g. SoftHSM or HSM vendor library), enables key storage in the PKCS#11 token
+	PKCS11TokenLabel        string               `json:"pkcs11TokenLabel" envconfig:"PKCS11_TOKEN_LABEL"`                  // label of the PKCS#11 token, which holds the signing keys
+	PKCS11Pin               string               `json:"pkcs11Pin" envconfig:"PKCS11_PIN"`                                 // user PIN of the PKCS#11 token
+	JWTJWKS                 string               `json:"jwtJWKS" envconfig:"JWT_JWKS"`                                     // path to a JWKS file or URL of a JWKS endpoint, enables JWT bearer authentication for signing requests
+	JWTIssuer               string               `json:"jwtIssuer" envconfig:"JWT_ISSUER"`                                 // expected issuer of JWT bearer tokens
+	JWTAudience             string               `json:"jwtAudience" envconfig:"JWT_AUDIENCE"`                             // expected audience of JWT bearer tokens
+	JWTUUIDsClaim           string               `json:"jwtUUIDsClaim" envconfig:"JWT_UUIDS_CLAIM"`                        // name of the JWT claim, which lists the UUIDs the token may sign for, defaults to 'uuids'
+	JWTTenant               string               `json:"jwtTenant" envconfig:"JWT_TENANT"`                                 // tenant of the client, JWTs with "tenant:<tenant>" in the UUIDs claim may sign for all identities
+	ReadinessMaxCertAge     int                  `json:"readinessMaxCertAge" envconfig:"READINESS_MAX_CERT_AGE"`           // maximum age in minutes of the public key certificate list for the service to be ready, defaults to 180 (60 if reloaded every minute)
+	ReadinessMinSKIDs       int                  `json:"readinessMinSKIDs" envconfig:"READINESS_MIN_SKIDS"`                // minimum number of identities with known SKID for the service to be ready, defaults to 0
 	KeyService              string               // key service URL
 	IdentityService         string               // identity service URL
 	//SigningService   string               // signing service URL
 	ServerTLSCertFingerprints map[string][32]byte
 	configDir                 string // directory where config and protocol ctx are stored
 	secretBytes               []byte // the decoded key store secret
+	prevSecretBytes           []byte // the decoded previous key store secret
 	dbParams                  DatabaseParams
 }
 
@@ -92,9 +137,10 @@ func (c *Config) Load(configDir string, filename string) error {
 	c.configDir = configDir
 
 	// assume that we want to load from env instead of config files, if
-	// we have the UBIRCH_SECRET env variable set.
+	// we have the UBIRCH_SECRET env variable (or one of its sources) set.
 	var err error
-	if os.Getenv("UBIRCH_SECRET32") != "" {
+	if os.Getenv("UBIRCH_SECRET32") != "" || os.Getenv("UBIRCH_SECRET32_FILE") != "" ||
+		os.Getenv("UBIRCH_SECRET32_COMMAND") != "" || os.Getenv("UBIRCH_SECRET32_VAULT_URL") != "" {
 		err = c.loadEnv()
 	} else {
 		err = c.loadFile(filename)
@@ -111,9 +157,14 @@ func (c *Config) Load(configDir string, filename string) error {
 		log.SetFormatter(&log.TextFormatter{FullTimestamp: true, TimestampFormat: "2006-01-02 15:04:05.000 -0700"})
 	}
 
-	c.secretBytes, err = base64.StdEncoding.DecodeString(c.SecretBase64)
+	err = c.checkSecretSource()
+	if err != nil {
+		return err
+	}
+
+	err = c.loadSecret()
 	if err != nil {
-		return fmt.Errorf("unable to decode base64 encoded secret (%s): %v", c.SecretBase64, err)
+		return err
 	}
 
 	err = c.checkMandatory()
@@ -121,9 +172,24 @@ func (c *Config) Load(configDir string, filename string) error {
 		return err
 	}
 
+	err = c.setDefaultSigningAlgorithm()
+	if err != nil {
+		return err
+	}
+
 	c.setDefaultCSR()
+	c.setDefaultMaxBatchSize()
+	c.setDefaultKeyRotationGracePeriod()
+	c.setDefaultCertFilter()
+	c.setDefaultReadiness()
 	c.setDefaultTLS()
 	c.setDefaultURLs()
+	c.setCertificateListFiles()
+
+	err = c.setDefaultClientCertAuth()
+	if err != nil {
+		return err
+	}
 
 	err = c.loadServerTLSCertificates()
 	if err != nil {
@@ -158,10 +224,43 @@ func (c *Config) checkMandatory() error {
 		return fmt.Errorf("secret for key encryption ('secret32') length must be %d bytes (is %d)", secretLength, len(c.secretBytes))
 	}
 
+	if c.previousSecretSource().isSet() && len(c.prevSecretBytes) != secretLength {
+		return fmt.Errorf("previous secret for key encryption ('previousSecret32') length must be %d bytes (is %d)", secretLength, len(c.prevSecretBytes))
+	}
+
 	if len(c.RegisterAuth) == 0 {
 		return fmt.Errorf("auth token for identity registration ('registerAuth') wasn't set")
 	}
 
+	if c.PostgresDSN != "" && c.SqliteDSN != "" {
+		return fmt.Errorf("only one database may be configured ('postgresDSN' or 'sqliteDSN')")
+	}
+
+	if c.InMemory && (c.PostgresDSN != "" || c.SqliteDSN != "") {
+		return fmt.Errorf("in-memory identity store ('inMemory') can not be used with a database")
+	}
+
+	if c.FileStore && (c.PostgresDSN != "" || c.SqliteDSN != "" || c.InMemory) {
+		return fmt.Errorf("file-based identity store ('fileStore') can not be used with a database or the in-memory identity store")
+	}
+
+	if c.PKCS11Module != "" && c.PKCS11TokenLabel == "" {
+		return fmt.Errorf("missing 'pkcs11TokenLabel' for PKCS#11 key storage")
+	}
+
+	if c.CertificateListFile != "" || c.CertificateListKeyFile != "" {
+		if c.CertificateListFile == "" {
+			return fmt.Errorf("missing 'certificateListFile' in configuration")
+		}
+
+		if c.CertificateListKeyFile == "" {
+			return fmt.Errorf("missing 'certificateListKeyFile' in configuration")
+		}
+
+		// the certificate list is loaded from the local files instead of the certificate server
+		return nil
+	}
+
 	if c.CertificateServer == "" {
 		return fmt.Errorf("missing 'certificateServer' in configuration")
 	}
@@ -173,6 +272,22 @@ func (c *Config) checkMandatory() error {
 	return nil
 }
 
+func (c *Config) setDefaultSigningAlgorithm() error {
+	if c.SigningAlgorithm == "" {
+		c.SigningAlgorithm = defaultAlgorithm
+	}
+
+	if _, err := lookupAlgorithm(c.SigningAlgorithm); err != nil {
+		return err
+	}
+	if c.PKCS11Module != "" && c.SigningAlgorithm == EdDSA {
+		return fmt.Errorf("signing algorithm %s is not supported with PKCS#11 key storage", EdDSA)
+	}
+	log.Debugf("default signing algorithm: %s", c.SigningAlgorithm)
+
+	return nil
+}
+
 func (c *Config) setDefaultCSR() {
 	if c.CSR_Country == "" {
 		c.CSR_Country = defaultCSRCountry
@@ -185,6 +300,52 @@ func (c *Config) setDefaultCSR() {
 	log.Debugf("CSR Subject Organization: %s", c.CSR_Organization)
 }
 
+func (c *Config) setDefaultMaxBatchSize() {
+	if c.MaxBatchSize <= 0 {
+		c.MaxBatchSize = defaultMaxBatchSize
+	}
+	log.Debugf("maximum batch size: %d", c.MaxBatchSize)
+}
+
+func (c *Config) setDefaultKeyRotationGracePeriod() {
+	if c.KeyRotationGracePeriod <= 0 {
+		c.KeyRotationGracePeriod = defaultKeyRotationGracePeriod
+	}
+	log.Debugf("key rotation grace period: %d hours", c.KeyRotationGracePeriod)
+}
+
+func (c *Config) setDefaultCertFilter() {
+	if c.CertExpiryWarning <= 0 {
+		c.CertExpiryWarning = defaultCertExpiryWarning
+	}
+	log.Debugf("certificate expiry warning: %d hours", c.CertExpiryWarning)
+
+	if len(c.CertificateTypes) != 0 {
+		log.Debugf("accepted certificate types: %v", c.CertificateTypes)
+	}
+	if len(c.CertificateCountries) != 0 {
+		log.Debugf("accepted certificate countries: %v", c.CertificateCountries)
+	}
+}
+
+func (c *Config) setDefaultReadiness() {
+	// by default, the service is not ready anymore as soon as the SKID lookup is
+	// cleared after repeated failed attempts to load the public key certificate list
+	if c.ReadinessMaxCertAge <= 0 {
+		if c.ReloadCertsEveryMinute {
+			c.ReadinessMaxCertAge = defaultReadinessMaxCertAgeMinutely
+		} else {
+			c.ReadinessMaxCertAge = defaultReadinessMaxCertAge
+		}
+	}
+	log.Debugf("readiness: maximum certificate list age: %d minutes", c.ReadinessMaxCertAge)
+
+	if c.ReadinessMinSKIDs < 0 {
+		c.ReadinessMinSKIDs = 0
+	}
+	log.Debugf("readiness: minimum number of known SKIDs: %d", c.ReadinessMinSKIDs)
+}
+
 func (c *Config) setDefaultTLS() {
 	if c.TCP_addr == "" {
 		c.TCP_addr = defaultTCPAddr
@@ -208,6 +369,34 @@ func (c *Config) setDefaultTLS() {
 	}
 }
 
+func (c *Config) setDefaultClientCertAuth() error {
+	if c.TLS_ClientCAFile == "" {
+		if c.TLS_RequireClientCert || c.TLS_ClientCertAuth != "" {
+			return fmt.Errorf("client certificate authentication requires a client CA file ('TLSClientCAFile')")
+		}
+		return nil
+	}
+
+	if !c.TLS {
+		return fmt.Errorf("client certificate authentication requires TLS to be enabled ('TLS')")
+	}
+
+	c.TLS_ClientCAFile = filepath.Join(c.configDir, c.TLS_ClientCAFile)
+	log.Debugf(" - Client CA: %s", c.TLS_ClientCAFile)
+
+	switch c.TLS_ClientCertAuth {
+	case "":
+		c.TLS_ClientCertAuth = clientCertAuthAlternative
+	case clientCertAuthAlternative, clientCertAuthAddition:
+	default:
+		return fmt.Errorf("invalid client certificate authentication mode ('TLSClientCertAuth'): %s, expected %q or %q",
+			c.TLS_ClientCertAuth, clientCertAuthAlternative, clientCertAuthAddition)
+	}
+	log.Debugf(" - Client certificate authentication: %s", c.TLS_ClientCertAuth)
+
+	return nil
+}
+
 func (c *Config) setDefaultURLs() {
 	if c.Env == "" {
 		c.Env = PROD_STAGE
@@ -226,6 +415,21 @@ func (c *Config) setDefaultURLs() {
 	}
 }
 
+func (c *Config) setCertificateListFiles() {
+	if c.CertificateListFile == "" {
+		return
+	}
+
+	if !filepath.IsAbs(c.CertificateListFile) {
+		c.CertificateListFile = filepath.Join(c.configDir, c.CertificateListFile)
+	}
+	if !filepath.IsAbs(c.CertificateListKeyFile) {
+		c.CertificateListKeyFile = filepath.Join(c.configDir, c.CertificateListKeyFile)
+	}
+	log.Infof("loading public key certificate list from file: %s", c.CertificateListFile)
+	log.Debugf(" - public key for verification: %s", c.CertificateListKeyFile)
+}
+
 func (c *Config) setDbParams() error {
 	if c.DbMaxOpenConns == "" {
 		c.dbParams.MaxOpenConns = defaultDbMaxOpenConns
@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -23,17 +26,44 @@ type ContextManager interface {
 	CloseTransaction(transactionCtx interface{}, commit bool) error
 
 	StoreNewIdentity(tx interface{}, id Identity) error
+	UpdateIdentity(tx interface{}, id Identity) error
 	GetIdentity(uid uuid.UUID) (*Identity, error)
 
+	// GetIdentityForUpdate returns the identity within the transaction and locks it against
+	// concurrent updates, until the transaction is closed
+	GetIdentityForUpdate(tx interface{}, uid uuid.UUID) (*Identity, error)
+
+	DeleteIdentity(tx interface{}, uid uuid.UUID) error
+
+	// GetIdentitiesWithOtherKeyVersion returns up to limit identities, the private keys of which were not
+	// encrypted with the secret of the given key version, for an update within the transaction
+	GetIdentitiesWithOtherKeyVersion(tx interface{}, keyVersion string, limit int) ([]Identity, error)
+
 	GetUuidForPublicKey(pubKey []byte) (uuid.UUID, error)
 
+	// GetUuidsForPublicKeys returns the UUIDs of the identities, which have one of the given public keys as active,
+	// next or previous public key, mapped by the public key. Unknown public keys are not contained in the result.
+	GetUuidsForPublicKeys(pubKeys [][]byte) (map[string]uuid.UUID, error)
+
+	// GetUuidsWithExpiredPrevKey returns the UUIDs of the identities, which still have a replaced key pair,
+	// the key rotation grace period of which was over at the given time
+	GetUuidsWithExpiredPrevKey(now time.Time) ([]uuid.UUID, error)
+
+	IsReady(ctx context.Context) error
 	Close()
 }
 
 func GetCtxManager(c *Config) (ContextManager, error) {
 	if c.PostgresDSN != "" {
 		return NewSqlDatabaseInfo(c.PostgresDSN, PostgreSqlIdentityTableName, &c.dbParams)
+	} else if c.SqliteDSN != "" {
+		return NewSqliteDatabaseInfo(c.SqliteDSN, SQLiteIdentityTableName, &c.dbParams)
+	} else if c.InMemory {
+		log.Warnf("identities are kept in memory only and will be lost on shutdown")
+		return NewMemoryContextManager(), nil
+	} else if c.FileStore {
+		return NewFileContextManager(c.configDir)
 	} else {
-		return nil, fmt.Errorf("file-based context management is not supported in the current version")
+		return nil, fmt.Errorf("no identity store configured: set 'postgresDSN', 'sqliteDSN', 'fileStore' or 'inMemory'")
 	}
 }
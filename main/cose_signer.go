@@ -16,7 +16,6 @@ package main
 
 import (
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -64,8 +63,8 @@ type Sig_structure struct {
 
 type CoseSigner struct {
 	*Protocol
-	encMode         cbor.EncMode
-	protectedHeader []byte
+	encMode          cbor.EncMode
+	protectedHeaders map[string][]byte // {<algorithm name>: <serialized protected header>}
 }
 
 func initCBOREncMode() (cbor.EncMode, error) {
@@ -79,21 +78,31 @@ func NewCoseSigner(p *Protocol) (*CoseSigner, error) {
 		return nil, err
 	}
 
-	protectedHeaderAlgES256 := map[uint8]int8{COSE_Alg_Label: COSE_ES256_ID}
-	protectedHeaderAlgES256CBOR, err := encMode.Marshal(protectedHeaderAlgES256)
-	if err != nil {
-		return nil, err
+	protectedHeaders := map[string][]byte{}
+
+	for name, alg := range signingAlgorithms {
+		protectedHeaderAlg := map[uint8]int64{COSE_Alg_Label: alg.coseID}
+		protectedHeaders[name], err = encMode.Marshal(protectedHeaderAlg)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &CoseSigner{
-		Protocol:        p,
-		encMode:         encMode,
-		protectedHeader: protectedHeaderAlgES256CBOR,
+		Protocol:         p,
+		encMode:          encMode,
+		protectedHeaders: protectedHeaders,
 	}, nil
 }
 
 func (c *CoseSigner) Sign(msg HTTPRequest, privateKeyPEM []byte) HTTPResponse {
-	log.Infof("%s: hash: %s", msg.ID, base64.StdEncoding.EncodeToString(msg.Hash[:]))
+	log.Infof("%s: hash: %s", msg.ID, base64.StdEncoding.EncodeToString(msg.Hash))
+
+	alg, err := lookupAlgorithm(msg.Algorithm)
+	if err != nil {
+		log.Errorf("%s: %v", msg.ID, err)
+		return errorResponse(http.StatusInternalServerError, "")
+	}
 
 	skid, err := c.GetSKID(msg.ID)
 	if err != nil {
@@ -101,7 +110,13 @@ func (c *CoseSigner) Sign(msg HTTPRequest, privateKeyPEM []byte) HTTPResponse {
 		return errorResponse(http.StatusBadRequest, err.Error())
 	}
 
-	cose, err := c.createSignedCOSE(msg.Hash, privateKeyPEM, skid, msg.Payload)
+	// algorithms which do not sign a pre-computed hash need the ToBeSigned value itself
+	signData := msg.Hash
+	if alg.pure {
+		signData = msg.ToBeSigned
+	}
+
+	cose, err := c.createSignedCOSE(alg.name, signData, privateKeyPEM, skid, msg.Payload)
 	if err != nil {
 		log.Errorf("could not create COSE object for identity %s: %v", msg.ID, err)
 		return errorResponse(http.StatusInternalServerError, "")
@@ -115,13 +130,21 @@ func (c *CoseSigner) Sign(msg HTTPRequest, privateKeyPEM []byte) HTTPResponse {
 	}
 }
 
-func (c *CoseSigner) createSignedCOSE(hash Sha256Sum, privateKeyPEM, kid, payload []byte) ([]byte, error) {
-	signature, err := c.SignHash(privateKeyPEM, hash[:])
+// createSignedCOSE signs the given data with the given algorithm and returns the COSE_Sign1 object.
+// The data is the hash of the ToBeSigned value, or, for algorithms which sign the
+// message itself (EdDSA), the ToBeSigned value.
+func (c *CoseSigner) createSignedCOSE(algorithm string, signData, privateKeyPEM, kid, payload []byte) ([]byte, error) {
+	alg, err := lookupAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := alg.crypto.SignHash(privateKeyPEM, signData)
 	if err != nil {
 		return nil, err
 	}
 
-	coseBytes, err := c.getCOSE(kid, payload, signature)
+	coseBytes, err := c.getCOSE(alg.name, kid, payload, signature)
 	if err != nil {
 		return nil, err
 	}
@@ -131,7 +154,7 @@ func (c *CoseSigner) createSignedCOSE(hash Sha256Sum, privateKeyPEM, kid, payloa
 
 // getCOSE creates a COSE Single Signer Data Object (COSE_Sign1)
 // and returns the Canonical-CBOR-encoded object with tag 18
-func (c *CoseSigner) getCOSE(kid, payload, signatureBytes []byte) ([]byte, error) {
+func (c *CoseSigner) getCOSE(algorithm string, kid, payload, signatureBytes []byte) ([]byte, error) {
 	/*
 		* https://cose-wg.github.io/cose-spec/#rfc.section.4.2
 			[COSE Single Signer Data Object]
@@ -215,9 +238,15 @@ func (c *CoseSigner) getCOSE(kid, payload, signatureBytes []byte) ([]byte, error
 																							payload is unknown
 	*/
 
+	alg, err := lookupAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	protectedHeader := c.protectedHeaders[alg.name]
+
 	// create COSE_Sign1 object
 	coseSign1 := &COSE_Sign1{
-		Protected:   c.protectedHeader,
+		Protected:   protectedHeader,
 		Unprotected: map[interface{}]interface{}{COSE_Kid_Label: kid},
 		Payload:     payload,
 		Signature:   signatureBytes,
@@ -228,30 +257,49 @@ func (c *CoseSigner) getCOSE(kid, payload, signatureBytes []byte) ([]byte, error
 }
 
 // GetSigStructBytes creates a "Canonical CBOR"-encoded](https://tools.ietf.org/html/rfc7049#section-3.9)
-// signature structure for a COSE_Sign1 object containing the given payload.
+// signature structure for a COSE_Sign1 object with the given signing algorithm and payload.
+// The optional externalAAD is included in the signature structure as externally
+// supplied data (https://cose-wg.github.io/cose-spec/#rfc.section.4.3).
 //
 // Implements step 1 + 2 of the "How to compute a signature"-instructions from
 // the [Signing and Verification Process](https://cose-wg.github.io/cose-spec/#rfc.section.4.4)
 // and returns the ToBeSigned value.
-func (c *CoseSigner) GetSigStructBytes(payload []byte) ([]byte, error) {
+func (c *CoseSigner) GetSigStructBytes(algorithm string, payload, externalAAD []byte) ([]byte, error) {
+	alg, err := lookupAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	protectedHeader := c.protectedHeaders[alg.name]
+
+	return getSigStructBytes(c.encMode, protectedHeader, payload, externalAAD)
+}
+
+// getSigStructBytes encodes the signature structure for a COSE_Sign1 object with
+// the given serialized protected header, payload and external additional authenticated data.
+// Used for signing as well as for the verification of received COSE_Sign1 objects.
+func getSigStructBytes(encMode cbor.EncMode, protectedHeader, payload, externalAAD []byte) ([]byte, error) {
+	if externalAAD == nil {
+		externalAAD = []byte{} // must be encoded as zero length binary string if not supplied
+	}
+
 	sigStruct := &Sig_structure{
 		Context:         COSE_Sign1_Context,
-		ProtectedHeader: c.protectedHeader,
-		External:        []byte{}, // empty
+		ProtectedHeader: protectedHeader,
+		External:        externalAAD,
 		Payload:         payload,
 	}
 
 	// encode with "Canonical CBOR" rules -> https://tools.ietf.org/html/rfc7049#section-3.9
-	return c.encMode.Marshal(sigStruct)
+	return encMode.Marshal(sigStruct)
 }
 
+// GetCBORFromJSON converts a JSON document to "Canonical CBOR"
+// preserving the types of all values (see decodeJSON)
 func (c *CoseSigner) GetCBORFromJSON(data []byte) ([]byte, error) {
-	var reqDump map[string]string
-
-	err := json.Unmarshal(data, &reqDump)
+	value, err := decodeJSON(data)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse JSON request body: %v", err)
 	}
 
-	return c.encMode.Marshal(reqDump)
+	return c.encMode.Marshal(value)
 }
@@ -46,7 +46,7 @@ func TestCoseSign(t *testing.T) {
 
 	t.Logf("payload [CBOR]: %x", payloadCBOR)
 
-	toBeSigned, err := coseSigner.GetSigStructBytes(payloadCBOR)
+	toBeSigned, err := coseSigner.GetSigStructBytes(ES256, payloadCBOR, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -57,7 +57,7 @@ func TestCoseSign(t *testing.T) {
 
 	t.Logf("sha256 hash [base64]: %s", base64.StdEncoding.EncodeToString(hash[:]))
 
-	coseBytes, err := coseSigner.createSignedCOSE(hash, privateKeyPEM, uid[:], payloadCBOR)
+	coseBytes, err := coseSigner.createSignedCOSE(ES256, hash[:], privateKeyPEM, uid[:], payloadCBOR)
 	if err != nil {
 		t.Fatal(err)
 	}
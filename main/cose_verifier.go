@@ -0,0 +1,287 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fxamacker/cbor/v2" // imports as package "cbor"
+	"github.com/google/uuid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const cborTypeTag = 6 // CBOR major type 6: tagged data item (https://tools.ietf.org/html/rfc7049#section-2.1)
+
+type VerificationResponse struct {
+	Valid  bool   `json:"valid"`
+	UUID   string `json:"uuid,omitempty"`
+	Kid    []byte `json:"kid,omitempty"`
+	Alg    string `json:"alg,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type CoseVerifier struct {
+	*Protocol
+	encMode cbor.EncMode
+	decMode cbor.DecMode
+}
+
+func NewCoseVerifier(p *Protocol) (*CoseVerifier, error) {
+	encMode, err := initCBOREncMode()
+	if err != nil {
+		return nil, err
+	}
+
+	decMode, err := cbor.DecOptions{}.DecMode()
+	if err != nil {
+		return nil, err
+	}
+
+	return &CoseVerifier{
+		Protocol: p,
+		encMode:  encMode,
+		decMode:  decMode,
+	}, nil
+}
+
+// VerifyCOSE verifies the signature of a tagged or untagged COSE_Sign1 object.
+// If expectedUid is not uuid.Nil, the object is only considered valid
+// if it was signed with the key of the identity with that UUID.
+// The externalAAD must match the external additional authenticated data
+// which was supplied when the object was signed.
+func (c *CoseVerifier) VerifyCOSE(expectedUid uuid.UUID, coseBytes, externalAAD []byte) HTTPResponse {
+	coseSign1, err := c.decodeCOSE(coseBytes)
+	if err != nil {
+		return getVerificationResponse(http.StatusBadRequest, VerificationResponse{Reason: err.Error()})
+	}
+
+	return getVerificationResponse(c.verifyCOSE(expectedUid, coseSign1, externalAAD))
+}
+
+// AttachPayload inserts the given payload into a COSE_Sign1 object with detached payload
+// and returns the completed, tagged COSE_Sign1 object, if the signature is valid for the payload.
+func (c *CoseVerifier) AttachPayload(expectedUid uuid.UUID, coseBytes, payload, externalAAD []byte) HTTPResponse {
+	coseSign1, err := c.decodeCOSE(coseBytes)
+	if err != nil {
+		return getVerificationResponse(http.StatusBadRequest, VerificationResponse{Reason: err.Error()})
+	}
+
+	if len(payload) == 0 {
+		return getVerificationResponse(http.StatusBadRequest, VerificationResponse{Reason: "empty payload"})
+	}
+	coseSign1.Payload = payload
+
+	code, verdict := c.verifyCOSE(expectedUid, coseSign1, externalAAD)
+	if !verdict.Valid {
+		return getVerificationResponse(code, verdict)
+	}
+
+	completeCOSE, err := c.encMode.Marshal(cbor.Tag{Number: COSE_Sign1_Tag, Content: coseSign1})
+	if err != nil {
+		log.Errorf("%s: unable to encode COSE object: %v", verdict.UUID, err)
+		return errorResponse(http.StatusInternalServerError, "")
+	}
+	log.Debugf("%s: COSE: %x", verdict.UUID, completeCOSE)
+
+	return HTTPResponse{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {CBORType}},
+		Content:    completeCOSE,
+	}
+}
+
+func (c *CoseVerifier) verifyCOSE(expectedUid uuid.UUID, coseSign1 *COSE_Sign1, externalAAD []byte) (int, VerificationResponse) {
+	verdict := VerificationResponse{}
+
+	algID, err := c.getAlgorithmID(coseSign1.Protected)
+	if err != nil {
+		verdict.Reason = err.Error()
+		return http.StatusBadRequest, verdict
+	}
+
+	alg, algErr := lookupAlgorithmByCOSEID(algID)
+	if algErr == nil {
+		verdict.Alg = alg.name
+	}
+
+	kid, err := getKid(coseSign1.Unprotected)
+	if err != nil {
+		verdict.Reason = err.Error()
+		return http.StatusBadRequest, verdict
+	}
+	verdict.Kid = kid
+
+	uid, err := c.getUuidForKid(kid)
+	if err != nil {
+		verdict.Reason = err.Error()
+		return http.StatusNotFound, verdict
+	}
+	verdict.UUID = uid.String()
+
+	if expectedUid != uuid.Nil && expectedUid != uid {
+		verdict.Reason = fmt.Sprintf("key identifier does not belong to identity %s", expectedUid)
+		return http.StatusUnprocessableEntity, verdict
+	}
+
+	if algErr != nil {
+		verdict.Reason = algErr.Error()
+		return http.StatusUnprocessableEntity, verdict
+	}
+
+	if coseSign1.Payload == nil {
+		verdict.Reason = "COSE object has detached payload"
+		return http.StatusUnprocessableEntity, verdict
+	}
+
+	identity, err := c.GetIdentity(uid)
+	if err == ErrNotExist {
+		verdict.Reason = "unknown identity"
+		return http.StatusNotFound, verdict
+	}
+	if err != nil {
+		log.Errorf("%s: %v", uid, err)
+		verdict.Reason = http.StatusText(http.StatusInternalServerError)
+		return http.StatusInternalServerError, verdict
+	}
+
+	if identity.Algorithm != alg.name {
+		verdict.Reason = fmt.Sprintf("algorithm %s does not match signing algorithm of identity: %s", alg.name, identity.Algorithm)
+		return http.StatusUnprocessableEntity, verdict
+	}
+
+	toBeSigned, err := getSigStructBytes(c.encMode, coseSign1.Protected, coseSign1.Payload, externalAAD)
+	if err != nil {
+		log.Errorf("%s: %v", uid, err)
+		verdict.Reason = http.StatusText(http.StatusInternalServerError)
+		return http.StatusInternalServerError, verdict
+	}
+	log.Debugf("%s: toBeSigned: %x", uid, toBeSigned)
+
+	ok, err := alg.crypto.Verify(identity.PublicKey, toBeSigned, coseSign1.Signature)
+	if err == nil && !ok && len(identity.PrevPublicKey) != 0 && time.Now().Before(identity.PrevKeyExpiry) {
+		// the object might have been signed with a key which was replaced within the key rotation grace period
+		ok, err = alg.crypto.Verify(identity.PrevPublicKey, toBeSigned, coseSign1.Signature)
+	}
+	if err != nil {
+		verdict.Reason = fmt.Sprintf("unable to verify signature: %v", err)
+		return http.StatusUnprocessableEntity, verdict
+	}
+	if !ok {
+		verdict.Reason = "invalid signature"
+		return http.StatusUnprocessableEntity, verdict
+	}
+
+	verdict.Valid = true
+	return http.StatusOK, verdict
+}
+
+// decodeCOSE decodes a COSE_Sign1 object which may or may not be tagged with the COSE_Sign1 tag
+func (c *CoseVerifier) decodeCOSE(coseBytes []byte) (*COSE_Sign1, error) {
+	if len(coseBytes) == 0 {
+		return nil, fmt.Errorf("empty COSE object")
+	}
+
+	if coseBytes[0]>>5 == cborTypeTag {
+		tag := cbor.RawTag{}
+		err := c.decMode.Unmarshal(coseBytes, &tag)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode tagged COSE object: %v", err)
+		}
+		if tag.Number != COSE_Sign1_Tag {
+			return nil, fmt.Errorf("unexpected CBOR tag: expected %d (COSE_Sign1), got %d", COSE_Sign1_Tag, tag.Number)
+		}
+		coseBytes = tag.Content
+	}
+
+	coseSign1 := &COSE_Sign1{}
+	err := c.decMode.Unmarshal(coseBytes, coseSign1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode COSE_Sign1 object: %v", err)
+	}
+
+	if len(coseSign1.Signature) == 0 {
+		return nil, fmt.Errorf("COSE object has empty signature")
+	}
+
+	return coseSign1, nil
+}
+
+// getAlgorithmID returns the value of the "alg" parameter from the serialized protected header
+func (c *CoseVerifier) getAlgorithmID(protectedHeader []byte) (int64, error) {
+	headerMap := map[int64]interface{}{}
+
+	err := c.decMode.Unmarshal(protectedHeader, &headerMap)
+	if err != nil {
+		return 0, fmt.Errorf("unable to decode protected header: %v", err)
+	}
+
+	alg, ok := headerMap[COSE_Alg_Label].(int64)
+	if !ok {
+		return 0, fmt.Errorf("missing or invalid algorithm identifier in protected header")
+	}
+
+	return alg, nil
+}
+
+// getKid returns the value of the "kid" parameter from the unprotected header
+func getKid(unprotectedHeader map[interface{}]interface{}) ([]byte, error) {
+	for label, value := range unprotectedHeader {
+		if l, ok := label.(uint64); !ok || l != COSE_Kid_Label {
+			continue
+		}
+
+		kid, ok := value.([]byte)
+		if !ok || len(kid) == 0 {
+			break
+		}
+		return kid, nil
+	}
+
+	return nil, fmt.Errorf("missing or invalid key identifier in unprotected header")
+}
+
+// getUuidForKid resolves the identity for a key identifier, which is either the
+// SKID of a known public key certificate or the raw bytes of the identity UUID
+func (c *CoseVerifier) getUuidForKid(kid []byte) (uuid.UUID, error) {
+	switch len(kid) {
+	case SkidLen:
+		return c.GetUuidForSKID(kid)
+	case len(uuid.Nil):
+		return uuid.FromBytes(kid)
+	default:
+		return uuid.Nil, fmt.Errorf("invalid key identifier length: %d", len(kid))
+	}
+}
+
+func getVerificationResponse(respCode int, verdict VerificationResponse) HTTPResponse {
+	verificationResp, err := json.Marshal(verdict)
+	if err != nil {
+		log.Warnf("error serializing response: %v", err)
+	}
+
+	if !verdict.Valid {
+		log.Warnf("COSE verification failed: %s", string(verificationResp))
+	}
+
+	return HTTPResponse{
+		StatusCode: respCode,
+		Header:     http.Header{"Content-Type": {JSONType}},
+		Content:    verificationResp,
+	}
+}
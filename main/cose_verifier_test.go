@@ -0,0 +1,320 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+)
+
+var skid = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+func TestCoseVerify(t *testing.T) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	coseBytes := createTestCOSE(t, coseSigner, skid)
+
+	verdict := checkVerification(t, coseVerifier, uuid.Nil, coseBytes, http.StatusOK)
+	if !verdict.Valid {
+		t.Errorf("valid COSE object was not verified: %s", verdict.Reason)
+	}
+	if verdict.UUID != uid.String() {
+		t.Errorf("unexpected UUID in verification response: %s", verdict.UUID)
+	}
+	if verdict.Alg != "ES256" {
+		t.Errorf("unexpected algorithm in verification response: %s", verdict.Alg)
+	}
+
+	checkVerification(t, coseVerifier, uid, coseBytes, http.StatusOK)
+	checkVerification(t, coseVerifier, uuid.New(), coseBytes, http.StatusUnprocessableEntity)
+}
+
+func TestCoseVerifyUntagged(t *testing.T) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	coseBytes := createTestCOSE(t, coseSigner, skid)
+
+	tag := cbor.RawTag{}
+	err := cbor.Unmarshal(coseBytes, &tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkVerification(t, coseVerifier, uuid.Nil, tag.Content, http.StatusOK)
+}
+
+func TestCoseVerifyUuidKid(t *testing.T) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	coseBytes := createTestCOSE(t, coseSigner, uid[:])
+
+	checkVerification(t, coseVerifier, uuid.Nil, coseBytes, http.StatusOK)
+}
+
+func TestCoseVerifyBadSignature(t *testing.T) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	coseBytes := createTestCOSE(t, coseSigner, skid)
+	coseBytes[len(coseBytes)-1] ^= 0xff
+
+	verdict := checkVerification(t, coseVerifier, uuid.Nil, coseBytes, http.StatusUnprocessableEntity)
+	if verdict.Valid {
+		t.Error("COSE object with invalid signature was verified")
+	}
+}
+
+func TestCoseVerifyUnknownKid(t *testing.T) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	coseBytes := createTestCOSE(t, coseSigner, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	checkVerification(t, coseVerifier, uuid.Nil, coseBytes, http.StatusNotFound)
+}
+
+func TestCoseVerifyMalformed(t *testing.T) {
+	_, coseVerifier := setupCoseVerifier(t)
+
+	checkVerification(t, coseVerifier, uuid.Nil, []byte{0xd2, 0x84, 0x01}, http.StatusBadRequest)
+	checkVerification(t, coseVerifier, uuid.Nil, []byte{}, http.StatusBadRequest)
+}
+
+func TestCoseAttachPayload(t *testing.T) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	payloadCBOR, err := coseSigner.GetCBORFromJSON([]byte(payloadJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := coseSigner.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toBeSigned, err := coseSigner.GetSigStructBytes(id.Algorithm, payloadCBOR, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	detachedCOSE, err := coseSigner.createSignedCOSE(id.Algorithm, signData(t, id.Algorithm, toBeSigned), id.PrivateKey, skid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verdict := checkVerification(t, coseVerifier, uid, detachedCOSE, http.StatusUnprocessableEntity)
+	if verdict.Valid {
+		t.Error("COSE object with detached payload was verified")
+	}
+
+	resp := coseVerifier.AttachPayload(uid, detachedCOSE, []byte("wrong payload"), nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("wrong payload was attached: %d, %s", resp.StatusCode, resp.Content)
+	}
+
+	resp = coseVerifier.AttachPayload(uid, detachedCOSE, payloadCBOR, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("attaching payload failed: %d, %s", resp.StatusCode, resp.Content)
+	}
+
+	checkVerification(t, coseVerifier, uid, resp.Content, http.StatusOK)
+}
+
+func TestCoseVerifyExternalAAD(t *testing.T) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	externalAAD := []byte("session-1234")
+
+	payloadCBOR, err := coseSigner.GetCBORFromJSON([]byte(payloadJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := coseSigner.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toBeSigned, err := coseSigner.GetSigStructBytes(id.Algorithm, payloadCBOR, externalAAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coseBytes, err := coseSigner.createSignedCOSE(id.Algorithm, signData(t, id.Algorithm, toBeSigned), id.PrivateKey, skid, payloadCBOR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := coseVerifier.VerifyCOSE(uid, coseBytes, externalAAD)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("COSE object with external AAD was not verified: %d, %s", resp.StatusCode, resp.Content)
+	}
+
+	resp = coseVerifier.VerifyCOSE(uid, coseBytes, []byte("session-5678"))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("COSE object was verified with wrong external AAD: %d, %s", resp.StatusCode, resp.Content)
+	}
+
+	checkVerification(t, coseVerifier, uid, coseBytes, http.StatusUnprocessableEntity)
+}
+
+func TestCoseVerifyAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{ES256, ES384, ES512, EdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			coseSigner, coseVerifier := setupCoseVerifier(t)
+			setTestIdentityAlgorithm(t, coseSigner.Protocol, algorithm)
+
+			coseBytes := createTestCOSE(t, coseSigner, skid)
+
+			verdict := checkVerification(t, coseVerifier, uid, coseBytes, http.StatusOK)
+			if verdict.Alg != algorithm {
+				t.Errorf("unexpected algorithm in verification response: expected %s, got %s", algorithm, verdict.Alg)
+			}
+
+			coseBytes[len(coseBytes)-1] ^= 0xff
+			checkVerification(t, coseVerifier, uid, coseBytes, http.StatusUnprocessableEntity)
+		})
+	}
+}
+
+func TestCoseVerifyAlgorithmMismatch(t *testing.T) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	coseBytes := createTestCOSE(t, coseSigner, skid)
+
+	setTestIdentityAlgorithm(t, coseSigner.Protocol, ES384)
+
+	verdict := checkVerification(t, coseVerifier, uid, coseBytes, http.StatusUnprocessableEntity)
+	if verdict.Valid {
+		t.Error("COSE object with algorithm other than the signing algorithm of the identity was verified")
+	}
+}
+
+func setupCoseVerifier(t *testing.T) (*CoseSigner, *CoseVerifier) {
+	p, privateKeyPEM := setupProtocol(t)
+
+	pubKeyPEM, err := p.GetPublicKeyFromPrivateKey(privateKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.identityCache = &sync.Map{}
+	p.authCache = &sync.Map{}
+	p.identityCache.Store(uid, &Identity{
+		Uid:        uid,
+		PrivateKey: privateKeyPEM,
+		PublicKey:  pubKeyPEM,
+		AuthToken:  hashTestAuthToken(t, "password1234"),
+		Algorithm:  ES256,
+	})
+
+	p.skidStore = map[uuid.UUID][]byte{uid: skid}
+	p.skidStoreMutex = &sync.RWMutex{}
+
+	coseSigner, err := NewCoseSigner(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coseVerifier, err := NewCoseVerifier(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return coseSigner, coseVerifier
+}
+
+func createTestCOSE(t *testing.T, coseSigner *CoseSigner, kid []byte) []byte {
+	payloadCBOR, err := coseSigner.GetCBORFromJSON([]byte(payloadJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := coseSigner.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toBeSigned, err := coseSigner.GetSigStructBytes(id.Algorithm, payloadCBOR, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coseBytes, err := coseSigner.createSignedCOSE(id.Algorithm, signData(t, id.Algorithm, toBeSigned), id.PrivateKey, kid, payloadCBOR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return coseBytes
+}
+
+// setTestIdentityAlgorithm replaces the key of the test identity with a new key for the given algorithm
+func setTestIdentityAlgorithm(t *testing.T, p *Protocol, algorithm string) {
+	alg, err := lookupAlgorithm(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privKeyPEM, err := alg.crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKeyPEM, err := alg.crypto.GetPublicKeyFromPrivateKey(privKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.identityCache.Store(uid, &Identity{
+		Uid:        uid,
+		PrivateKey: privKeyPEM,
+		PublicKey:  pubKeyPEM,
+		AuthToken:  hashTestAuthToken(t, "password1234"),
+		Algorithm:  alg.name,
+	})
+}
+
+// signData returns the data which is signed for the given algorithm:
+// the hash of the ToBeSigned value, or the ToBeSigned value itself for EdDSA
+func signData(t *testing.T, algorithm string, toBeSigned []byte) []byte {
+	alg, err := lookupAlgorithm(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if alg.pure {
+		return toBeSigned
+	}
+	return alg.digest(toBeSigned)
+}
+
+func checkVerification(t *testing.T, coseVerifier *CoseVerifier, expectedUid uuid.UUID, coseBytes []byte, expectedCode int) VerificationResponse {
+	resp := coseVerifier.VerifyCOSE(expectedUid, coseBytes, nil)
+	if resp.StatusCode != expectedCode {
+		t.Errorf("unexpected response status code: expected %d, got %d (%s)", expectedCode, resp.StatusCode, resp.Content)
+	}
+
+	verdict := VerificationResponse{}
+	err := json.Unmarshal(resp.Content, &verdict)
+	if err != nil {
+		t.Fatalf("unable to decode verification response: %v", err)
+	}
+
+	return verdict
+}
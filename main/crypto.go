@@ -0,0 +1,713 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+
+	_ "crypto/sha256" // register hash functions
+	_ "crypto/sha512"
+)
+
+// supported signing algorithms (https://cose-wg.github.io/cose-spec/#rfc.section.8)
+const (
+	ES256 = "ES256" // ECDSA w/ SHA-256 on curve P-256
+	ES384 = "ES384" // ECDSA w/ SHA-384 on curve P-384
+	ES512 = "ES512" // ECDSA w/ SHA-512 on curve P-521
+	EdDSA = "EdDSA" // Ed25519 (PureEdDSA)
+
+	defaultAlgorithm = ES256
+
+	COSE_ES384_ID = -35 // cryptographic algorithm identifier for ECDSA P-384 (https://cose-wg.github.io/cose-spec/#rfc.section.8.1)
+	COSE_ES512_ID = -36 // cryptographic algorithm identifier for ECDSA P-521 (https://cose-wg.github.io/cose-spec/#rfc.section.8.1)
+	COSE_EdDSA_ID = -8  // cryptographic algorithm identifier for EdDSA (https://cose-wg.github.io/cose-spec/#rfc.section.8.2)
+
+	keyRegistrationTimeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+type signingAlgorithm struct {
+	name   string
+	coseID int64
+	crypto ubirch.Crypto
+	hash   crypto.Hash // hash function for the ToBeSigned value
+	pure   bool        // signature is calculated over the ToBeSigned value itself instead of its hash
+}
+
+var signingAlgorithms = map[string]*signingAlgorithm{
+	ES256: {
+		name:   ES256,
+		coseID: COSE_ES256_ID,
+		crypto: &ubirch.ECDSACryptoContext{},
+		hash:   crypto.SHA256,
+	},
+	ES384: {
+		name:   ES384,
+		coseID: COSE_ES384_ID,
+		crypto: &ECDSACurveCryptoContext{
+			Curve:                    elliptic.P384(),
+			Hash:                     crypto.SHA384,
+			SignatureAlgorithm:       x509.ECDSAWithSHA384,
+			KeyRegistrationAlgorithm: "ecdsa-p384v1",
+		},
+		hash: crypto.SHA384,
+	},
+	ES512: {
+		name:   ES512,
+		coseID: COSE_ES512_ID,
+		crypto: &ECDSACurveCryptoContext{
+			Curve:                    elliptic.P521(),
+			Hash:                     crypto.SHA512,
+			SignatureAlgorithm:       x509.ECDSAWithSHA512,
+			KeyRegistrationAlgorithm: "ecdsa-p521v1",
+		},
+		hash: crypto.SHA512,
+	},
+	EdDSA: {
+		name:   EdDSA,
+		coseID: COSE_EdDSA_ID,
+		crypto: &ED25519CryptoContext{},
+		hash:   crypto.SHA512,
+		pure:   true,
+	},
+}
+
+// lookupAlgorithm returns the signing algorithm with the given name.
+// An empty name refers to the default algorithm (ES256).
+func lookupAlgorithm(name string) (*signingAlgorithm, error) {
+	if name == "" {
+		name = defaultAlgorithm
+	}
+
+	alg, found := signingAlgorithms[name]
+	if !found {
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", name)
+	}
+	return alg, nil
+}
+
+// lookupAlgorithmByCOSEID returns the signing algorithm with the given COSE algorithm identifier
+func lookupAlgorithmByCOSEID(coseID int64) (*signingAlgorithm, error) {
+	for _, alg := range signingAlgorithms {
+		if alg.coseID == coseID {
+			return alg, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported algorithm: %d", coseID)
+}
+
+// lookupAlgorithmForPublicKey returns the signing algorithm which matches the type of the given public key
+func lookupAlgorithmForPublicKey(pub interface{}) (*signingAlgorithm, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return signingAlgorithms[ES256], nil
+		case elliptic.P384():
+			return signingAlgorithms[ES384], nil
+		case elliptic.P521():
+			return signingAlgorithms[ES512], nil
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve: %s", k.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		return signingAlgorithms[EdDSA], nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type: %T", pub)
+	}
+}
+
+// digest returns the hash of the ToBeSigned value
+func (a *signingAlgorithm) digest(toBeSigned []byte) []byte {
+	h := a.hash.New()
+	h.Write(toBeSigned)
+	return h.Sum(nil)
+}
+
+// ECDSACurveCryptoContext implements the ubirch.Crypto interface for ECDSA with
+// the given curve and hash function. Signatures are the concatenation of R and S,
+// each zero-padded to the byte length of the curve order.
+type ECDSACurveCryptoContext struct {
+	Curve                    elliptic.Curve
+	Hash                     crypto.Hash
+	SignatureAlgorithm       x509.SignatureAlgorithm
+	KeyRegistrationAlgorithm string
+}
+
+// Ensure ECDSACurveCryptoContext implements the Crypto interface
+var _ ubirch.Crypto = (*ECDSACurveCryptoContext)(nil)
+
+func (c *ECDSACurveCryptoContext) coordinateLength() int {
+	return (c.Curve.Params().BitSize + 7) / 8
+}
+
+func (c *ECDSACurveCryptoContext) SignatureLength() int {
+	return 2 * c.coordinateLength()
+}
+
+func (c *ECDSACurveCryptoContext) HashLength() int {
+	return c.Hash.Size()
+}
+
+func (c *ECDSACurveCryptoContext) GenerateKey() (privKeyPEM []byte, err error) {
+	priv, err := ecdsa.GenerateKey(c.Curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return c.EncodePrivateKey(priv)
+}
+
+func (c *ECDSACurveCryptoContext) GetPublicKeyFromPrivateKey(privKeyPEM []byte) (pubKeyPEM []byte, err error) {
+	priv, err := c.decodePrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return c.EncodePublicKey(&priv.PublicKey)
+}
+
+func (c *ECDSACurveCryptoContext) PublicKeyPEMToBytes(pubKeyPEM []byte) (pubKeyBytes []byte, err error) {
+	pub, err := c.decodePublicKey(pubKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	l := c.coordinateLength()
+	pubKeyBytes = make([]byte, 2*l)
+	pub.X.FillBytes(pubKeyBytes[:l])
+	pub.Y.FillBytes(pubKeyBytes[l:])
+
+	return pubKeyBytes, nil
+}
+
+func (c *ECDSACurveCryptoContext) PublicKeyBytesToPEM(pubKeyBytes []byte) (pubKeyPEM []byte, err error) {
+	l := c.coordinateLength()
+	if len(pubKeyBytes) != 2*l {
+		return nil, fmt.Errorf("unexpected length for ECDSA %s public key: expected %d, got %d", c.Curve.Params().Name, 2*l, len(pubKeyBytes))
+	}
+
+	pub := &ecdsa.PublicKey{
+		Curve: c.Curve,
+		X:     new(big.Int).SetBytes(pubKeyBytes[:l]),
+		Y:     new(big.Int).SetBytes(pubKeyBytes[l:]),
+	}
+
+	if !pub.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("invalid public key value: point not on curve")
+	}
+
+	return c.EncodePublicKey(pub)
+}
+
+func (c *ECDSACurveCryptoContext) PrivateKeyBytesToPEM(privKeyBytes []byte) (privKeyPEM []byte, err error) {
+	if len(privKeyBytes) != c.coordinateLength() {
+		return nil, fmt.Errorf("unexpected length for ECDSA %s private key: expected %d, got %d", c.Curve.Params().Name, c.coordinateLength(), len(privKeyBytes))
+	}
+
+	priv := new(ecdsa.PrivateKey)
+	priv.Curve = c.Curve
+	priv.D = new(big.Int).SetBytes(privKeyBytes)
+
+	if priv.D.Sign() == 0 || priv.D.Cmp(c.Curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("invalid private key value: value is zero or greater or equal curve order")
+	}
+	priv.X, priv.Y = c.Curve.ScalarBaseMult(priv.D.Bytes())
+
+	return c.EncodePrivateKey(priv)
+}
+
+func (c *ECDSACurveCryptoContext) EncodePrivateKey(priv interface{}) (pemEncoded []byte, err error) {
+	typedKey, ok := priv.(*ecdsa.PrivateKey)
+	if !ok || typedKey.Curve != c.Curve {
+		return nil, fmt.Errorf("key is not of type ECDSA %s private key", c.Curve.Params().Name)
+	}
+	return encodePKCS8PrivateKey(typedKey)
+}
+
+func (c *ECDSACurveCryptoContext) DecodePrivateKey(pemEncoded []byte) (priv interface{}, err error) {
+	return c.decodePrivateKey(pemEncoded)
+}
+
+func (c *ECDSACurveCryptoContext) decodePrivateKey(pemEncoded []byte) (*ecdsa.PrivateKey, error) {
+	priv, err := decodePKCS8PrivateKey(pemEncoded)
+	if err != nil {
+		return nil, err
+	}
+
+	typedKey, ok := priv.(*ecdsa.PrivateKey)
+	if !ok || typedKey.Curve != c.Curve {
+		return nil, fmt.Errorf("key is not of type ECDSA %s private key", c.Curve.Params().Name)
+	}
+	return typedKey, nil
+}
+
+func (c *ECDSACurveCryptoContext) EncodePublicKey(pub interface{}) (pemEncoded []byte, err error) {
+	typedKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok || typedKey.Curve != c.Curve {
+		return nil, fmt.Errorf("key is not of type ECDSA %s public key", c.Curve.Params().Name)
+	}
+	return encodePKIXPublicKey(typedKey)
+}
+
+func (c *ECDSACurveCryptoContext) DecodePublicKey(pemEncoded []byte) (pub interface{}, err error) {
+	return c.decodePublicKey(pemEncoded)
+}
+
+func (c *ECDSACurveCryptoContext) decodePublicKey(pemEncoded []byte) (*ecdsa.PublicKey, error) {
+	pub, err := decodePKIXPublicKey(pemEncoded)
+	if err != nil {
+		return nil, err
+	}
+
+	typedKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok || typedKey.Curve != c.Curve {
+		return nil, fmt.Errorf("key is not of type ECDSA %s public key", c.Curve.Params().Name)
+	}
+	return typedKey, nil
+}
+
+func (c *ECDSACurveCryptoContext) GetSignedKeyRegistration(privKeyPEM []byte, uid uuid.UUID) ([]byte, error) {
+	return getSignedKeyRegistration(c, c.KeyRegistrationAlgorithm, privKeyPEM, uid)
+}
+
+func (c *ECDSACurveCryptoContext) GetCSR(privKeyPEM []byte, id uuid.UUID, subjectCountry string, subjectOrganization string) ([]byte, error) {
+	priv, err := c.decodePrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return createCSR(priv, c.SignatureAlgorithm, id, subjectCountry, subjectOrganization)
+}
+
+func (c *ECDSACurveCryptoContext) Sign(privKeyPEM []byte, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty data")
+	}
+
+	h := c.Hash.New()
+	h.Write(data)
+	return c.SignHash(privKeyPEM, h.Sum(nil))
+}
+
+func (c *ECDSACurveCryptoContext) SignHash(privKeyPEM []byte, hash []byte) ([]byte, error) {
+	if len(hash) != c.HashLength() {
+		return nil, fmt.Errorf("invalid hash size: expected %d, got %d", c.HashLength(), len(hash))
+	}
+
+	priv, err := c.decodePrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, priv, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	l := c.coordinateLength()
+	signature := make([]byte, 2*l)
+	r.FillBytes(signature[:l])
+	s.FillBytes(signature[l:])
+
+	return signature, nil
+}
+
+func (c *ECDSACurveCryptoContext) Verify(pubKeyPEM []byte, data []byte, signature []byte) (bool, error) {
+	if len(data) == 0 {
+		return false, fmt.Errorf("empty data cannot be verified")
+	}
+	if len(signature) != c.SignatureLength() {
+		return false, fmt.Errorf("wrong signature length: expected: %d, got: %d", c.SignatureLength(), len(signature))
+	}
+
+	pub, err := c.decodePublicKey(pubKeyPEM)
+	if err != nil {
+		return false, err
+	}
+
+	l := c.coordinateLength()
+	r := new(big.Int).SetBytes(signature[:l])
+	s := new(big.Int).SetBytes(signature[l:])
+
+	h := c.Hash.New()
+	h.Write(data)
+	return ecdsa.Verify(pub, h.Sum(nil), r, s), nil
+}
+
+// ED25519CryptoContext implements the ubirch.Crypto interface for Ed25519 (PureEdDSA).
+// Since PureEdDSA does not sign a pre-computed hash, SignHash signs the given data itself.
+type ED25519CryptoContext struct{}
+
+// Ensure ED25519CryptoContext implements the Crypto interface
+var _ ubirch.Crypto = (*ED25519CryptoContext)(nil)
+
+const ed25519KeyRegistrationAlgorithm = "ECC_ED25519"
+
+func (c *ED25519CryptoContext) SignatureLength() int {
+	return ed25519.SignatureSize
+}
+
+func (c *ED25519CryptoContext) HashLength() int {
+	return crypto.SHA512.Size()
+}
+
+func (c *ED25519CryptoContext) GenerateKey() (privKeyPEM []byte, err error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return c.EncodePrivateKey(priv)
+}
+
+func (c *ED25519CryptoContext) GetPublicKeyFromPrivateKey(privKeyPEM []byte) (pubKeyPEM []byte, err error) {
+	priv, err := c.decodePrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return c.EncodePublicKey(priv.Public())
+}
+
+func (c *ED25519CryptoContext) PublicKeyPEMToBytes(pubKeyPEM []byte) (pubKeyBytes []byte, err error) {
+	pub, err := c.decodePublicKey(pubKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(pub), nil
+}
+
+func (c *ED25519CryptoContext) PublicKeyBytesToPEM(pubKeyBytes []byte) (pubKeyPEM []byte, err error) {
+	if len(pubKeyBytes) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("unexpected length for Ed25519 public key: expected %d, got %d", ed25519.PublicKeySize, len(pubKeyBytes))
+	}
+	return c.EncodePublicKey(ed25519.PublicKey(pubKeyBytes))
+}
+
+// PrivateKeyBytesToPEM converts an Ed25519 private key seed (32 bytes) to PEM format
+func (c *ED25519CryptoContext) PrivateKeyBytesToPEM(privKeyBytes []byte) (privKeyPEM []byte, err error) {
+	if len(privKeyBytes) != ed25519.SeedSize {
+		return nil, fmt.Errorf("unexpected length for Ed25519 private key seed: expected %d, got %d", ed25519.SeedSize, len(privKeyBytes))
+	}
+	return c.EncodePrivateKey(ed25519.NewKeyFromSeed(privKeyBytes))
+}
+
+func (c *ED25519CryptoContext) EncodePrivateKey(priv interface{}) (pemEncoded []byte, err error) {
+	typedKey, ok := priv.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not of type Ed25519 private key")
+	}
+	return encodePKCS8PrivateKey(typedKey)
+}
+
+func (c *ED25519CryptoContext) DecodePrivateKey(pemEncoded []byte) (priv interface{}, err error) {
+	return c.decodePrivateKey(pemEncoded)
+}
+
+func (c *ED25519CryptoContext) decodePrivateKey(pemEncoded []byte) (ed25519.PrivateKey, error) {
+	priv, err := decodePKCS8PrivateKey(pemEncoded)
+	if err != nil {
+		return nil, err
+	}
+
+	typedKey, ok := priv.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not of type Ed25519 private key")
+	}
+	return typedKey, nil
+}
+
+func (c *ED25519CryptoContext) EncodePublicKey(pub interface{}) (pemEncoded []byte, err error) {
+	typedKey, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not of type Ed25519 public key")
+	}
+	return encodePKIXPublicKey(typedKey)
+}
+
+func (c *ED25519CryptoContext) DecodePublicKey(pemEncoded []byte) (pub interface{}, err error) {
+	return c.decodePublicKey(pemEncoded)
+}
+
+func (c *ED25519CryptoContext) decodePublicKey(pemEncoded []byte) (ed25519.PublicKey, error) {
+	pub, err := decodePKIXPublicKey(pemEncoded)
+	if err != nil {
+		return nil, err
+	}
+
+	typedKey, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not of type Ed25519 public key")
+	}
+	return typedKey, nil
+}
+
+func (c *ED25519CryptoContext) GetSignedKeyRegistration(privKeyPEM []byte, uid uuid.UUID) ([]byte, error) {
+	return getSignedKeyRegistration(c, ed25519KeyRegistrationAlgorithm, privKeyPEM, uid)
+}
+
+func (c *ED25519CryptoContext) GetCSR(privKeyPEM []byte, id uuid.UUID, subjectCountry string, subjectOrganization string) ([]byte, error) {
+	priv, err := c.decodePrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return createCSR(priv, x509.PureEd25519, id, subjectCountry, subjectOrganization)
+}
+
+func (c *ED25519CryptoContext) Sign(privKeyPEM []byte, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty data")
+	}
+
+	priv, err := c.decodePrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return ed25519.Sign(priv, data), nil
+}
+
+// SignHash signs the given data with Ed25519. Other than with ECDSA, the data
+// is not expected to be a pre-computed hash, since PureEdDSA signs the message itself.
+func (c *ED25519CryptoContext) SignHash(privKeyPEM []byte, data []byte) ([]byte, error) {
+	return c.Sign(privKeyPEM, data)
+}
+
+func (c *ED25519CryptoContext) Verify(pubKeyPEM []byte, data []byte, signature []byte) (bool, error) {
+	if len(data) == 0 {
+		return false, fmt.Errorf("empty data cannot be verified")
+	}
+	if len(signature) != c.SignatureLength() {
+		return false, fmt.Errorf("wrong signature length: expected: %d, got: %d", c.SignatureLength(), len(signature))
+	}
+
+	pub, err := c.decodePublicKey(pubKeyPEM)
+	if err != nil {
+		return false, err
+	}
+
+	return ed25519.Verify(pub, data, signature), nil
+}
+
+func encodePKCS8PrivateKey(priv interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func decodePKCS8PrivateKey(pemEncoded []byte) (interface{}, error) {
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil {
+		return nil, fmt.Errorf("unable to parse PEM block")
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+func encodePKIXPublicKey(pub interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func decodePKIXPublicKey(pemEncoded []byte) (interface{}, error) {
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil {
+		return nil, fmt.Errorf("unable to parse PEM block")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// getSignedKeyRegistration creates a self-signed JSON key registration for the ubirch key service
+func getSignedKeyRegistration(c ubirch.Crypto, algorithm string, privKeyPEM []byte, uid uuid.UUID) ([]byte, error) {
+	pubKeyPEM, err := c.GetPublicKeyFromPrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := c.PublicKeyPEMToBytes(pubKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	keyRegistration := ubirch.KeyRegistration{
+		Algorithm:      algorithm,
+		Created:        now.Format(keyRegistrationTimeFormat),
+		HwDeviceId:     uid.String(),
+		PubKey:         base64.StdEncoding.EncodeToString(pubKey),
+		PubKeyId:       base64.StdEncoding.EncodeToString(pubKey),
+		ValidNotAfter:  now.Add(10 * 365 * 24 * time.Hour).Format(keyRegistrationTimeFormat), // valid for 10 years
+		ValidNotBefore: now.Format(keyRegistrationTimeFormat),
+	}
+
+	jsonKeyReg, err := json.Marshal(keyRegistration)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := c.Sign(privKeyPEM, jsonKeyReg)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(ubirch.SignedKeyRegistration{
+		PubKeyInfo: keyRegistration,
+		Signature:  base64.StdEncoding.EncodeToString(signature),
+	})
+}
+
+// KeyUpdate is the public key info of a key registration, which replaces a previously registered public key
+type KeyUpdate struct {
+	ubirch.KeyRegistration
+	PrevPubKeyId string `json:"prevPubKeyId"`
+}
+
+// SignedKeyUpdate is the request body for a key update at the ubirch key service. The public key info
+// is signed with the new private key as well as with the private key which is being replaced.
+type SignedKeyUpdate struct {
+	PubKeyInfo    KeyUpdate `json:"pubKeyInfo"`
+	Signature     string    `json:"signature"`
+	PrevSignature string    `json:"prevSignature"`
+}
+
+// getSignedKeyUpdate creates a JSON key update for the ubirch key service, which registers the
+// public key of newPrivKeyPEM as the successor of the public key of prevPrivKeyPEM
+func getSignedKeyUpdate(c ubirch.Crypto, prevPrivKeyPEM, newPrivKeyPEM []byte, uid uuid.UUID) ([]byte, error) {
+	keyRegistration, err := c.GetSignedKeyRegistration(newPrivKeyPEM, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	signedKeyRegistration := ubirch.SignedKeyRegistration{}
+	err = json.Unmarshal(keyRegistration, &signedKeyRegistration)
+	if err != nil {
+		return nil, err
+	}
+
+	prevPubKeyPEM, err := c.GetPublicKeyFromPrivateKey(prevPrivKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	prevPubKey, err := c.PublicKeyPEMToBytes(prevPubKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	keyUpdate := KeyUpdate{
+		KeyRegistration: signedKeyRegistration.PubKeyInfo,
+		PrevPubKeyId:    base64.StdEncoding.EncodeToString(prevPubKey),
+	}
+
+	jsonKeyUpdate, err := json.Marshal(keyUpdate)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := c.Sign(newPrivKeyPEM, jsonKeyUpdate)
+	if err != nil {
+		return nil, err
+	}
+
+	prevSignature, err := c.Sign(prevPrivKeyPEM, jsonKeyUpdate)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(SignedKeyUpdate{
+		PubKeyInfo:    keyUpdate,
+		Signature:     base64.StdEncoding.EncodeToString(signature),
+		PrevSignature: base64.StdEncoding.EncodeToString(prevSignature),
+	})
+}
+
+// samePublicKey returns true, if the given PEM encoded public keys are equal
+func samePublicKey(pubKeyPEM1, pubKeyPEM2 []byte) bool {
+	if len(pubKeyPEM1) == 0 || len(pubKeyPEM2) == 0 {
+		return false
+	}
+
+	pub1, err := decodePKIXPublicKey(pubKeyPEM1)
+	if err != nil {
+		return false
+	}
+
+	pub2, err := decodePKIXPublicKey(pubKeyPEM2)
+	if err != nil {
+		return false
+	}
+
+	pub, ok := pub1.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(pub2)
+}
+
+// KeyDeletion is the request body for the deletion of a public key at the ubirch key service
+type KeyDeletion struct {
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// getSignedKeyDeletion creates a JSON key deletion request for the ubirch key service,
+// which is signed with the private key corresponding to the public key to be deleted
+func getSignedKeyDeletion(c ubirch.Crypto, privKeyPEM []byte) ([]byte, error) {
+	pubKeyPEM, err := c.GetPublicKeyFromPrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := c.PublicKeyPEMToBytes(pubKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyBase64 := base64.StdEncoding.EncodeToString(pubKey)
+
+	signature, err := c.Sign(privKeyPEM, []byte(pubKeyBase64))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(KeyDeletion{
+		PublicKey: pubKeyBase64,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	})
+}
+
+func createCSR(priv crypto.Signer, sigAlg x509.SignatureAlgorithm, id uuid.UUID, subjectCountry string, subjectOrganization string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		SignatureAlgorithm: sigAlg,
+		Subject: pkix.Name{
+			Country:      []string{subjectCountry},
+			Organization: []string{subjectOrganization},
+			CommonName:   id.String(),
+		},
+	}
+
+	return x509.CreateCertificateRequest(rand.Reader, template, priv)
+}
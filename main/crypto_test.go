@@ -0,0 +1,219 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-client-go/main/adapters/encrypters"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+func TestSigningAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{ES256, ES384, ES512, EdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			alg, err := lookupAlgorithm(algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			privKeyPEM, err := alg.crypto.GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pubKeyPEM, err := alg.crypto.GetPublicKeyFromPrivateKey(privKeyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// public key conversion round trip
+			pubKeyBytes, err := alg.crypto.PublicKeyPEMToBytes(pubKeyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pubKeyPEM2, err := alg.crypto.PublicKeyBytesToPEM(pubKeyBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(pubKeyPEM, pubKeyPEM2) {
+				t.Errorf("public key conversion round trip failed: %s != %s", pubKeyPEM, pubKeyPEM2)
+			}
+
+			// algorithm lookup by public key
+			pub, err := decodePKIXPublicKey(pubKeyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			algForKey, err := lookupAlgorithmForPublicKey(pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if algForKey.name != alg.name {
+				t.Errorf("unexpected algorithm for public key: expected %s, got %s", alg.name, algForKey.name)
+			}
+
+			// private key encryption round trip
+			secret := make([]byte, 32)
+			rand.Read(secret)
+
+			defaultEnc, err := encrypters.NewKeyEncrypter(secret, &ubirch.ECDSACryptoContext{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := &Protocol{keyEncrypter: defaultEnc}
+			enc := p.getKeyEncrypter(alg)
+
+			encryptedKey, err := enc.Encrypt(privKeyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decryptedKey, err := enc.Decrypt(encryptedKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(privKeyPEM, decryptedKey) {
+				t.Error("private key encryption round trip failed")
+			}
+
+			// signature
+			data := []byte("test data")
+
+			signature, err := alg.crypto.Sign(privKeyPEM, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(signature) != alg.crypto.SignatureLength() {
+				t.Errorf("unexpected signature length: expected %d, got %d", alg.crypto.SignatureLength(), len(signature))
+			}
+
+			ok, err := alg.crypto.Verify(pubKeyPEM, data, signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Error("signature verification failed")
+			}
+
+			// CSR
+			csr, err := alg.crypto.GetCSR(privKeyPEM, uid, "DE", "test organization")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			certReq, err := x509.ParseCertificateRequest(csr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = certReq.CheckSignature()
+			if err != nil {
+				t.Errorf("invalid CSR signature: %v", err)
+			}
+
+			if certReq.Subject.CommonName != uid.String() {
+				t.Errorf("unexpected CSR subject common name: %s", certReq.Subject.CommonName)
+			}
+
+			// key registration
+			keyReg, err := alg.crypto.GetSignedKeyRegistration(privKeyPEM, uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkSignedKeyRegistration(t, alg.crypto, pubKeyPEM, keyReg, uid)
+		})
+	}
+}
+
+func TestLookupAlgorithm(t *testing.T) {
+	alg, err := lookupAlgorithm("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg.name != defaultAlgorithm {
+		t.Errorf("unexpected default algorithm: %s", alg.name)
+	}
+
+	_, err = lookupAlgorithm("RS256")
+	if err == nil {
+		t.Error("lookupAlgorithm did not return error for unsupported algorithm")
+	}
+
+	alg, err = lookupAlgorithmByCOSEID(COSE_EdDSA_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg.name != EdDSA {
+		t.Errorf("unexpected algorithm for COSE algorithm identifier %d: %s", COSE_EdDSA_ID, alg.name)
+	}
+
+	_, err = lookupAlgorithmByCOSEID(-257)
+	if err == nil {
+		t.Error("lookupAlgorithmByCOSEID did not return error for unsupported algorithm")
+	}
+}
+
+func checkSignedKeyRegistration(t *testing.T, c ubirch.Crypto, pubKeyPEM, keyReg []byte, uid uuid.UUID) {
+	signedKeyReg := ubirch.SignedKeyRegistration{}
+	err := json.Unmarshal(keyReg, &signedKeyReg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signedKeyReg.PubKeyInfo.HwDeviceId != uid.String() {
+		t.Errorf("unexpected hwDeviceId in key registration: %s", signedKeyReg.PubKeyInfo.HwDeviceId)
+	}
+
+	pubKeyBytes, err := c.PublicKeyPEMToBytes(pubKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signedKeyReg.PubKeyInfo.PubKey != base64.StdEncoding.EncodeToString(pubKeyBytes) {
+		t.Errorf("unexpected public key in key registration: %s", signedKeyReg.PubKeyInfo.PubKey)
+	}
+
+	pubKeyInfo, err := json.Marshal(signedKeyReg.PubKeyInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(signedKeyReg.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := c.Verify(pubKeyPEM, pubKeyInfo, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("invalid key registration signature")
+	}
+}
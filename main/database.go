@@ -35,19 +35,12 @@ const (
 
 const (
 	PostgresIdentity = iota
+	SQLiteIdentity
 )
 
-var create = map[int]string{
-	PostgresIdentity: "CREATE TABLE IF NOT EXISTS %s(" +
-		"uid VARCHAR(255) NOT NULL PRIMARY KEY, " +
-		"private_key BYTEA NOT NULL, " +
-		"public_key BYTEA NOT NULL, " +
-		"auth_token VARCHAR(255) NOT NULL);",
-}
-
-func CreateTable(tableType int, tableName string) string {
-	return fmt.Sprintf(create[tableType], tableName)
-}
+// identityColumns are the columns of the identity table in the order in which they are read by scanIdentity
+const identityColumns = "uid, private_key, public_key, auth_token, algorithm, " +
+	"next_private_key, next_public_key, prev_private_key, prev_public_key, prev_key_expiry, key_version"
 
 // DatabaseManager contains the postgres database connection, and offers methods
 // for interacting with the database.
@@ -98,7 +91,7 @@ func NewSqlDatabaseInfo(dataSourceName, tableName string, dbParams *DatabasePara
 		tableName: tableName,
 	}
 
-	_, err = dm.db.Exec(CreateTable(PostgresIdentity, tableName))
+	err = migrateSchema(dm.db, PostgresIdentity, tableName)
 	if err != nil {
 		return nil, err
 	}
@@ -106,6 +99,11 @@ func NewSqlDatabaseInfo(dataSourceName, tableName string, dbParams *DatabasePara
 	return dm, nil
 }
 
+// IsReady checks if the database is reachable
+func (dm *DatabaseManager) IsReady(ctx context.Context) error {
+	return dm.db.PingContext(ctx)
+}
+
 func (dm *DatabaseManager) Close() {
 	err := dm.db.Close()
 	if err != nil {
@@ -137,23 +135,73 @@ func (dm *DatabaseManager) StoreNewIdentity(transactionCtx interface{}, identity
 	}
 
 	query := fmt.Sprintf(
-		"INSERT INTO %s (uid, private_key, public_key, auth_token) VALUES ($1, $2, $3, $4);",
+		"INSERT INTO %s (uid, private_key, public_key, auth_token, algorithm, key_version) VALUES ($1, $2, $3, $4, $5, $6);",
+		dm.tableName)
+
+	_, err := tx.Exec(query, &identity.Uid, &identity.PrivateKey, &identity.PublicKey, &identity.AuthToken, &identity.Algorithm,
+		&identity.KeyVersion)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (dm *DatabaseManager) UpdateIdentity(transactionCtx interface{}, identity Identity) error {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
+
+	query := fmt.Sprintf(
+		"UPDATE %s SET private_key = $2, public_key = $3, auth_token = $4, algorithm = $5, "+
+			"next_private_key = $6, next_public_key = $7, prev_private_key = $8, prev_public_key = $9, prev_key_expiry = $10, "+
+			"key_version = $11 WHERE uid = $1;",
 		dm.tableName)
 
-	_, err := tx.Exec(query, &identity.Uid, &identity.PrivateKey, &identity.PublicKey, &identity.AuthToken)
+	prevKeyExpiry := sql.NullTime{Time: identity.PrevKeyExpiry, Valid: !identity.PrevKeyExpiry.IsZero()}
+
+	result, err := tx.Exec(query, identity.Uid.String(), &identity.PrivateKey, &identity.PublicKey, &identity.AuthToken, &identity.Algorithm,
+		&identity.NextPrivateKey, &identity.NextPublicKey, &identity.PrevPrivateKey, &identity.PrevPublicKey, prevKeyExpiry,
+		&identity.KeyVersion)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if rowsAffected == 0 {
+		return ErrNotExist
+	}
 
 	return nil
 }
 
 func (dm *DatabaseManager) GetIdentity(uid uuid.UUID) (*Identity, error) {
-	var id Identity
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE uid = $1", identityColumns, dm.tableName)
+
+	id, err := scanIdentity(dm.db.QueryRow(query, uid.String()))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+
+	return id, nil
+}
+
+func (dm *DatabaseManager) GetIdentityForUpdate(transactionCtx interface{}, uid uuid.UUID) (*Identity, error) {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return nil, fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
 
-	query := fmt.Sprintf("SELECT * FROM %s WHERE uid = $1", dm.tableName)
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE uid = $1 FOR UPDATE", identityColumns, dm.tableName)
 
-	err := dm.db.QueryRow(query, uid.String()).Scan(&id.Uid, &id.PrivateKey, &id.PublicKey, &id.AuthToken)
+	id, err := scanIdentity(tx.QueryRow(query, uid.String()))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrNotExist
@@ -161,13 +209,53 @@ func (dm *DatabaseManager) GetIdentity(uid uuid.UUID) (*Identity, error) {
 		return nil, err
 	}
 
-	return &id, nil
+	return id, nil
+}
+
+func (dm *DatabaseManager) GetIdentitiesWithOtherKeyVersion(transactionCtx interface{}, keyVersion string, limit int) ([]Identity, error) {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return nil, fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE key_version <> $1 ORDER BY uid LIMIT $2 FOR UPDATE", identityColumns, dm.tableName)
+
+	rows, err := tx.Query(query, keyVersion, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanIdentities(rows)
+}
+
+func (dm *DatabaseManager) DeleteIdentity(transactionCtx interface{}, uid uuid.UUID) error {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE uid = $1;", dm.tableName)
+
+	result, err := tx.Exec(query, uid.String())
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotExist
+	}
+
+	return nil
 }
 
 func (dm *DatabaseManager) GetUuidForPublicKey(pubKey []byte) (uuid.UUID, error) {
 	var uid uuid.UUID
 
-	query := fmt.Sprintf("SELECT uid FROM %s WHERE public_key = $1", dm.tableName)
+	query := fmt.Sprintf("SELECT uid FROM %s WHERE public_key = $1 OR next_public_key = $1 OR prev_public_key = $1", dm.tableName)
 
 	err := dm.db.QueryRow(query, pubKey).Scan(&uid)
 	if err != nil {
@@ -180,6 +268,131 @@ func (dm *DatabaseManager) GetUuidForPublicKey(pubKey []byte) (uuid.UUID, error)
 	return uid, nil
 }
 
+func (dm *DatabaseManager) GetUuidsForPublicKeys(pubKeys [][]byte) (map[string]uuid.UUID, error) {
+	if len(pubKeys) == 0 {
+		return map[string]uuid.UUID{}, nil
+	}
+
+	query := fmt.Sprintf("SELECT uid, public_key, next_public_key, prev_public_key FROM %s "+
+		"WHERE public_key = ANY($1) OR next_public_key = ANY($1) OR prev_public_key = ANY($1)", dm.tableName)
+
+	rows, err := dm.db.Query(query, pq.ByteaArray(pubKeys))
+	if err != nil {
+		return nil, err
+	}
+
+	uids := map[string]uuid.UUID{}
+	err = scanUuidsForPublicKeys(rows, pubKeys, uids)
+	if err != nil {
+		return nil, err
+	}
+
+	return uids, nil
+}
+
+func (dm *DatabaseManager) GetUuidsWithExpiredPrevKey(now time.Time) ([]uuid.UUID, error) {
+	query := fmt.Sprintf("SELECT uid, prev_key_expiry FROM %s WHERE prev_key_expiry < $1", dm.tableName)
+
+	rows, err := dm.db.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanUuidsWithExpiredPrevKey(rows, now)
+}
+
+// scanUuidsForPublicKeys reads rows with the UUID, public key, next public key and previous public key of identities
+// and adds the UUIDs to the given map for those of the public keys, which are contained in the given public keys
+func scanUuidsForPublicKeys(rows *sql.Rows, pubKeys [][]byte, uids map[string]uuid.UUID) error {
+	//noinspection GoUnhandledErrorResult
+	defer rows.Close()
+
+	requested := make(map[string]bool, len(pubKeys))
+	for _, pubKey := range pubKeys {
+		requested[string(pubKey)] = true
+	}
+
+	for rows.Next() {
+		var uid uuid.UUID
+		var pubKey, nextPubKey, prevPubKey []byte
+
+		err := rows.Scan(&uid, &pubKey, &nextPubKey, &prevPubKey)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range [][]byte{pubKey, nextPubKey, prevPubKey} {
+			if len(k) != 0 && requested[string(k)] {
+				uids[string(k)] = uid
+			}
+		}
+	}
+
+	return rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanIdentity reads an identity from a row, which contains the identityColumns
+// scanUuidsWithExpiredPrevKey reads rows with the UUID and the expiry of the replaced key of identities
+// and returns the UUIDs of those identities, the replaced key of which was expired at the given time
+func scanUuidsWithExpiredPrevKey(rows *sql.Rows, now time.Time) ([]uuid.UUID, error) {
+	//noinspection GoUnhandledErrorResult
+	defer rows.Close()
+
+	var uids []uuid.UUID
+	for rows.Next() {
+		var uid uuid.UUID
+		var prevKeyExpiry sql.NullTime
+
+		err := rows.Scan(&uid, &prevKeyExpiry)
+		if err != nil {
+			return nil, err
+		}
+
+		if prevKeyExpiry.Valid && now.After(prevKeyExpiry.Time) {
+			uids = append(uids, uid)
+		}
+	}
+
+	return uids, rows.Err()
+}
+
+func scanIdentity(row scanner) (*Identity, error) {
+	var id Identity
+	var prevKeyExpiry sql.NullTime
+
+	err := row.Scan(&id.Uid, &id.PrivateKey, &id.PublicKey, &id.AuthToken, &id.Algorithm,
+		&id.NextPrivateKey, &id.NextPublicKey, &id.PrevPrivateKey, &id.PrevPublicKey, &prevKeyExpiry, &id.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if prevKeyExpiry.Valid {
+		id.PrevKeyExpiry = prevKeyExpiry.Time
+	}
+
+	return &id, nil
+}
+
+func scanIdentities(rows *sql.Rows) ([]Identity, error) {
+	//noinspection GoUnhandledErrorResult
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		id, err := scanIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, *id)
+	}
+
+	return identities, rows.Err()
+}
+
 func isConnectionNotAvailable(err error) bool {
 	if err.Error() == pq.ErrorCode("53300").Name() || // "53300": "too_many_connections",
 		err.Error() == pq.ErrorCode("53400").Name() { // "53400": "configuration_limit_exceeded",
@@ -0,0 +1,288 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const schemaVersionTableSuffix = "_schema_version"
+
+// migration is a versioned change of the schema of a table
+type migration struct {
+	version     int
+	description string
+	up          string // statement to apply the migration, %s is replaced by the table name
+	applied     string // optional query, which checks if the change was already applied, for statements without IF NOT EXISTS
+}
+
+// migrations contains the ordered schema migrations for each table type. Migrations must never be changed
+// or removed once they were released, changes of the schema are added as a new migration with the next version.
+var migrations = map[int][]migration{
+	PostgresIdentity: {
+		{
+			version:     1,
+			description: "create identity table",
+			up: "CREATE TABLE IF NOT EXISTS %s(" +
+				"uid VARCHAR(255) NOT NULL PRIMARY KEY, " +
+				"private_key BYTEA NOT NULL, " +
+				"public_key BYTEA NOT NULL, " +
+				"auth_token VARCHAR(255) NOT NULL);",
+		},
+		{
+			version:     2,
+			description: "add signing algorithm",
+			up: "ALTER TABLE %s " +
+				"ADD COLUMN IF NOT EXISTS algorithm VARCHAR(255) NOT NULL DEFAULT 'ES256';",
+		},
+		{
+			version:     3,
+			description: "add key rotation",
+			up: "ALTER TABLE %s " +
+				"ADD COLUMN IF NOT EXISTS next_private_key BYTEA, " +
+				"ADD COLUMN IF NOT EXISTS next_public_key BYTEA, " +
+				"ADD COLUMN IF NOT EXISTS prev_private_key BYTEA, " +
+				"ADD COLUMN IF NOT EXISTS prev_public_key BYTEA, " +
+				"ADD COLUMN IF NOT EXISTS prev_key_expiry TIMESTAMP WITH TIME ZONE;",
+		},
+		{
+			version:     4,
+			description: "add key version",
+			up: "ALTER TABLE %s " +
+				"ADD COLUMN IF NOT EXISTS key_version VARCHAR(255) NOT NULL DEFAULT '';",
+		},
+	},
+	SQLiteIdentity: {
+		{
+			version:     1,
+			description: "create identity table",
+			up: "CREATE TABLE IF NOT EXISTS %s(" +
+				"uid VARCHAR(255) NOT NULL PRIMARY KEY, " +
+				"private_key BLOB NOT NULL, " +
+				"public_key BLOB NOT NULL, " +
+				"auth_token VARCHAR(255) NOT NULL, " +
+				"algorithm VARCHAR(255) NOT NULL DEFAULT 'ES256', " +
+				"next_private_key BLOB, " +
+				"next_public_key BLOB, " +
+				"prev_private_key BLOB, " +
+				"prev_public_key BLOB, " +
+				"prev_key_expiry TIMESTAMP);",
+		},
+		{
+			version:     2,
+			description: "add key version",
+			up: "ALTER TABLE %s " +
+				"ADD COLUMN key_version VARCHAR(255) NOT NULL DEFAULT '';",
+			applied: "SELECT COUNT(*) > 0 FROM pragma_table_info('%s') WHERE name = 'key_version';",
+		},
+	},
+}
+
+var createVersionTable = map[int]string{
+	PostgresIdentity: "CREATE TABLE IF NOT EXISTS %s(" +
+		"version INTEGER NOT NULL PRIMARY KEY, " +
+		"description VARCHAR(255) NOT NULL, " +
+		"applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP);",
+	SQLiteIdentity: "CREATE TABLE IF NOT EXISTS %s(" +
+		"version INTEGER NOT NULL PRIMARY KEY, " +
+		"description VARCHAR(255) NOT NULL, " +
+		"applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);",
+}
+
+var versionTableExists = map[int]string{
+	PostgresIdentity: "SELECT to_regclass($1) IS NOT NULL;",
+	SQLiteIdentity:   "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?;",
+}
+
+var insertVersion = map[int]string{
+	PostgresIdentity: "INSERT INTO %s (version, description) VALUES ($1, $2);",
+	SQLiteIdentity:   "INSERT INTO %s (version, description) VALUES (?, ?);",
+}
+
+// lockMigrations contains the statements to acquire a lock for the migration transaction, so that
+// multiple instances of the service, which share a database, do not apply migrations concurrently.
+// SQLite transactions acquire the write lock of the database immediately (see sqliteParams).
+var lockMigrations = map[int]string{
+	PostgresIdentity: "SELECT pg_advisory_xact_lock($1);",
+}
+
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// migrateSchema brings the schema of the table up to date by applying all pending migrations within a transaction
+func migrateSchema(db *sql.DB, tableType int, tableName string) error {
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	err = applyPendingMigrations(tx, tableType, tableName)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Errorf("rollback of database migration failed: %v", rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func applyPendingMigrations(tx *sql.Tx, tableType int, tableName string) error {
+	if lock, ok := lockMigrations[tableType]; ok {
+		_, err := tx.Exec(lock, migrationLockID(tableName))
+		if err != nil {
+			return fmt.Errorf("unable to acquire lock for database migration: %v", err)
+		}
+	}
+
+	_, err := tx.Exec(fmt.Sprintf(createVersionTable[tableType], versionTableName(tableName)))
+	if err != nil {
+		return fmt.Errorf("unable to create schema version table: %v", err)
+	}
+
+	pending, err := pendingMigrations(tx, tableType, tableName)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		log.Infof("applying database migration %d to table %s: %s", m.version, tableName, m.description)
+
+		var applied bool
+		if m.applied != "" {
+			err = tx.QueryRow(fmt.Sprintf(m.applied, tableName)).Scan(&applied)
+			if err != nil {
+				return fmt.Errorf("unable to check database migration %d (%s): %v", m.version, m.description, err)
+			}
+		}
+
+		if !applied {
+			_, err = tx.Exec(fmt.Sprintf(m.up, tableName))
+			if err != nil {
+				return fmt.Errorf("database migration %d (%s) failed: %v", m.version, m.description, err)
+			}
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(insertVersion[tableType], versionTableName(tableName)), m.version, m.description)
+		if err != nil {
+			return fmt.Errorf("unable to record schema version %d: %v", m.version, err)
+		}
+	}
+
+	return nil
+}
+
+// pendingMigrations returns the migrations, which have not been applied to the table yet, in order
+func pendingMigrations(q querier, tableType int, tableName string) ([]migration, error) {
+	version, err := schemaVersion(q, tableType, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []migration
+	for _, m := range migrations[tableType] {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// schemaVersion returns the version of the latest migration, which was applied to the table
+func schemaVersion(q querier, tableType int, tableName string) (int, error) {
+	var exists bool
+	err := q.QueryRow(versionTableExists[tableType], versionTableName(tableName)).Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("unable to check for schema version table: %v", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version int
+	err = q.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s;", versionTableName(tableName))).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get schema version: %v", err)
+	}
+
+	return version, nil
+}
+
+func versionTableName(tableName string) string {
+	return tableName + schemaVersionTableSuffix
+}
+
+// migrationLockID derives the ID of the advisory lock for migrations of the table from its name
+func migrationLockID(tableName string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("migration:" + tableName))
+	return int64(h.Sum64())
+}
+
+// PrintPendingMigrations prints the schema migrations, which have not been applied to the
+// configured database yet, without applying them
+func PrintPendingMigrations(c *Config) error {
+	var driverName, dataSourceName, tableName string
+	var tableType int
+
+	switch {
+	case c.PostgresDSN != "":
+		driverName, dataSourceName, tableType, tableName = PostgreSql, c.PostgresDSN, PostgresIdentity, PostgreSqlIdentityTableName
+	case c.SqliteDSN != "" && !sqliteSupported:
+		return errSqliteNotSupported
+	case c.SqliteDSN != "":
+		driverName, dataSourceName, tableType, tableName = SQLite, sqliteDataSourceName(c.SqliteDSN), SQLiteIdentity, SQLiteIdentityTableName
+	default:
+		return fmt.Errorf("schema migrations require a database ('postgresDSN' or 'sqliteDSN')")
+	}
+
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer db.Close()
+
+	version, err := schemaVersion(db, tableType, tableName)
+	if err != nil {
+		return err
+	}
+
+	pending, err := pendingMigrations(db, tableType, tableName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("schema version of table %s: %d\n", tableName, version)
+
+	if len(pending) == 0 {
+		fmt.Println("no pending migrations")
+		return nil
+	}
+
+	fmt.Printf("%d pending migration(s):\n", len(pending))
+	for _, m := range pending {
+		fmt.Printf("\n-- %d: %s\n%s\n", m.version, m.description, fmt.Sprintf(m.up, tableName))
+	}
+
+	return nil
+}
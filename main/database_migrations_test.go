@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+func TestSchemaMigrations(t *testing.T) {
+	runForEachBackend(t, func(t *testing.T, ctxMngr ContextManager) {
+		var db *sql.DB
+		var tableType int
+
+		switch dm := ctxMngr.(type) {
+		case *DatabaseManager:
+			db, tableType = dm.db, PostgresIdentity
+		case *SqliteDatabaseManager:
+			db, tableType = dm.db, SQLiteIdentity
+		default:
+			t.Skipf("schema migrations are not supported by %T", ctxMngr)
+		}
+
+		latest := migrations[tableType][len(migrations[tableType])-1].version
+
+		// all migrations were applied when the database was initialized
+		version, err := schemaVersion(db, tableType, testTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != latest {
+			t.Errorf("unexpected schema version: expected %d, got %d", latest, version)
+		}
+
+		pending, err := pendingMigrations(db, tableType, testTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("unexpected pending migrations: %v", pending)
+		}
+
+		// existing data is kept when migrations are applied again
+		testIdentity := generateRandomIdentity()
+		storeAndCommit(t, ctxMngr, testIdentity)
+
+		_, err = db.Exec(fmt.Sprintf("DELETE FROM %s;", versionTableName(testTableName)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pending, err = pendingMigrations(db, tableType, testTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != len(migrations[tableType]) {
+			t.Errorf("unexpected number of pending migrations: expected %d, got %d", len(migrations[tableType]), len(pending))
+		}
+		for i, m := range pending {
+			if m.version != i+1 {
+				t.Errorf("pending migrations are not in order: %d at index %d", m.version, i)
+			}
+		}
+
+		err = migrateSchema(db, tableType, testTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		version, err = schemaVersion(db, tableType, testTableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != latest {
+			t.Errorf("unexpected schema version after migration: expected %d, got %d", latest, version)
+		}
+
+		err = checkIdentity(ctxMngr, testIdentity, newDoneWaitGroup())
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SQLite                  string = "sqlite3"
+	SQLiteIdentityTableName string = "cose_identity"
+
+	sqliteMaxLookupKeys = 500 // maximum number of public keys per query, below the default limit of 999 parameters
+)
+
+var errSqliteNotSupported = fmt.Errorf("SQLite is not supported by this build (build with CGO_ENABLED=1)")
+
+// sqliteParams are appended to the data source name, if they are not set explicitly.
+// Transactions acquire the write lock immediately, so that concurrent transactions
+// wait for each other instead of failing on commit.
+var sqliteParams = map[string]string{
+	"_txlock":       "immediate",
+	"_busy_timeout": "10000",
+	"_journal_mode": "WAL",
+}
+
+// SqliteDatabaseManager contains the SQLite database connection, and offers methods
+// for interacting with the database.
+type SqliteDatabaseManager struct {
+	options   *sql.TxOptions
+	db        *sql.DB
+	tableName string
+}
+
+// Ensure SqliteDatabaseManager implements the ContextManager interface
+var _ ContextManager = (*SqliteDatabaseManager)(nil)
+
+// NewSqliteDatabaseInfo takes the data source name of a SQLite database (i.e. the path to the
+// database file), returns a new initialized database.
+func NewSqliteDatabaseInfo(dataSourceName, tableName string, dbParams *DatabaseParams) (*SqliteDatabaseManager, error) {
+	log.Infof("preparing SQLite usage")
+
+	if !sqliteSupported {
+		return nil, errSqliteNotSupported
+	}
+
+	db, err := sql.Open(SQLite, sqliteDataSourceName(dataSourceName))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(dbParams.MaxOpenConns)
+	db.SetMaxIdleConns(dbParams.MaxIdleConns)
+	db.SetConnMaxLifetime(dbParams.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(dbParams.ConnMaxIdleTime)
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+
+	dm := &SqliteDatabaseManager{
+		options: &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		},
+		db:        db,
+		tableName: tableName,
+	}
+
+	err = migrateSchema(dm.db, SQLiteIdentity, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return dm, nil
+}
+
+// sqliteDataSourceName appends the default connection parameters to the data source name
+func sqliteDataSourceName(dataSourceName string) string {
+	var params []string
+	for key, value := range sqliteParams {
+		if !strings.Contains(dataSourceName, key+"=") {
+			params = append(params, key+"="+value)
+		}
+	}
+
+	if len(params) == 0 {
+		return dataSourceName
+	}
+
+	separator := "?"
+	if strings.Contains(dataSourceName, "?") {
+		separator = "&"
+	}
+
+	return "file:" + strings.TrimPrefix(dataSourceName, "file:") + separator + strings.Join(params, "&")
+}
+
+func (dm *SqliteDatabaseManager) IsReady(ctx context.Context) error {
+	return dm.db.PingContext(ctx)
+}
+
+func (dm *SqliteDatabaseManager) Close() {
+	err := dm.db.Close()
+	if err != nil {
+		log.Errorf("failed to close database: %v", err)
+	}
+}
+
+func (dm *SqliteDatabaseManager) StartTransaction(ctx context.Context) (transactionCtx interface{}, err error) {
+	return dm.db.BeginTx(ctx, dm.options)
+}
+
+func (dm *SqliteDatabaseManager) CloseTransaction(transactionCtx interface{}, commit bool) error {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
+
+	if commit {
+		return tx.Commit()
+	} else {
+		return tx.Rollback()
+	}
+}
+
+func (dm *SqliteDatabaseManager) StoreNewIdentity(transactionCtx interface{}, identity Identity) error {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (uid, private_key, public_key, auth_token, algorithm, key_version) VALUES (?, ?, ?, ?, ?, ?);",
+		dm.tableName)
+
+	_, err := tx.Exec(query, identity.Uid.String(), identity.PrivateKey, identity.PublicKey, identity.AuthToken, identity.Algorithm,
+		identity.KeyVersion)
+	if err != nil {
+		if isSqliteConstraintViolation(err) {
+			return ErrExists
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (dm *SqliteDatabaseManager) UpdateIdentity(transactionCtx interface{}, identity Identity) error {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
+
+	query := fmt.Sprintf(
+		"UPDATE %s SET private_key = ?, public_key = ?, auth_token = ?, algorithm = ?, "+
+			"next_private_key = ?, next_public_key = ?, prev_private_key = ?, prev_public_key = ?, prev_key_expiry = ?, "+
+			"key_version = ? WHERE uid = ?;",
+		dm.tableName)
+
+	prevKeyExpiry := sql.NullTime{Time: identity.PrevKeyExpiry, Valid: !identity.PrevKeyExpiry.IsZero()}
+
+	result, err := tx.Exec(query, identity.PrivateKey, identity.PublicKey, identity.AuthToken, identity.Algorithm,
+		identity.NextPrivateKey, identity.NextPublicKey, identity.PrevPrivateKey, identity.PrevPublicKey, prevKeyExpiry,
+		identity.KeyVersion, identity.Uid.String())
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotExist
+	}
+
+	return nil
+}
+
+func (dm *SqliteDatabaseManager) GetIdentity(uid uuid.UUID) (*Identity, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE uid = ?", identityColumns, dm.tableName)
+
+	id, err := scanIdentity(dm.db.QueryRow(query, uid.String()))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// GetIdentityForUpdate reads the identity within the transaction. SQLite does not support row locks,
+// but transactions acquire the write lock of the database immediately (see sqliteParams).
+func (dm *SqliteDatabaseManager) GetIdentityForUpdate(transactionCtx interface{}, uid uuid.UUID) (*Identity, error) {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return nil, fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE uid = ?", identityColumns, dm.tableName)
+
+	id, err := scanIdentity(tx.QueryRow(query, uid.String()))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+
+	return id, nil
+}
+
+func (dm *SqliteDatabaseManager) GetIdentitiesWithOtherKeyVersion(transactionCtx interface{}, keyVersion string, limit int) ([]Identity, error) {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return nil, fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE key_version <> ? ORDER BY uid LIMIT ?", identityColumns, dm.tableName)
+
+	rows, err := tx.Query(query, keyVersion, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanIdentities(rows)
+}
+
+func (dm *SqliteDatabaseManager) DeleteIdentity(transactionCtx interface{}, uid uuid.UUID) error {
+	tx, ok := transactionCtx.(*sql.Tx)
+	if !ok {
+		return fmt.Errorf("transactionCtx for database manager is not of expected type *sql.Tx")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE uid = ?;", dm.tableName)
+
+	result, err := tx.Exec(query, uid.String())
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotExist
+	}
+
+	return nil
+}
+
+func (dm *SqliteDatabaseManager) GetUuidForPublicKey(pubKey []byte) (uuid.UUID, error) {
+	var uid uuid.UUID
+
+	query := fmt.Sprintf("SELECT uid FROM %s WHERE public_key = ? OR next_public_key = ? OR prev_public_key = ?", dm.tableName)
+
+	err := dm.db.QueryRow(query, pubKey, pubKey, pubKey).Scan(&uid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return uuid.Nil, ErrNotExist
+		}
+		return uuid.Nil, err
+	}
+
+	return uid, nil
+}
+
+func (dm *SqliteDatabaseManager) GetUuidsForPublicKeys(pubKeys [][]byte) (map[string]uuid.UUID, error) {
+	uids := map[string]uuid.UUID{}
+
+	// the public keys are looked up in chunks, since the number of parameters of a statement is limited
+	for start := 0; start < len(pubKeys); start += sqliteMaxLookupKeys {
+		end := start + sqliteMaxLookupKeys
+		if end > len(pubKeys) {
+			end = len(pubKeys)
+		}
+		chunk := pubKeys[start:end]
+
+		// numbered parameters are used in all three lists, so that every public key is only bound once
+		params := make([]string, len(chunk))
+		args := make([]interface{}, len(chunk))
+		for i, pubKey := range chunk {
+			params[i] = fmt.Sprintf("?%d", i+1)
+			args[i] = pubKey
+		}
+		in := strings.Join(params, ", ")
+
+		query := fmt.Sprintf("SELECT uid, public_key, next_public_key, prev_public_key FROM %s "+
+			"WHERE public_key IN (%s) OR next_public_key IN (%s) OR prev_public_key IN (%s)", dm.tableName, in, in, in)
+
+		rows, err := dm.db.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		err = scanUuidsForPublicKeys(rows, chunk, uids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return uids, nil
+}
+
+func (dm *SqliteDatabaseManager) GetUuidsWithExpiredPrevKey(now time.Time) ([]uuid.UUID, error) {
+	// the expiry is compared after scanning, since SQLite stores timestamps as text
+	query := fmt.Sprintf("SELECT uid, prev_key_expiry FROM %s WHERE prev_key_expiry IS NOT NULL", dm.tableName)
+
+	rows, err := dm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanUuidsWithExpiredPrevKey(rows, now)
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -17,19 +19,38 @@ import (
 const (
 	testTableName = "test_cose_identity"
 	testLoad      = 10000
+
+	fileBackend   = "file"
+	memoryBackend = "memory"
 )
 
-func TestDatabaseManager(t *testing.T) {
-	dm, err := initDB()
-	if err != nil {
-		t.Fatal(err)
+// testBackends are the backends the context manager tests are run against
+var testBackends = []string{PostgreSql, SQLite, fileBackend, memoryBackend}
+
+// runForEachBackend runs the test function as subtest with a context manager for each of the test backends
+func runForEachBackend(t *testing.T, test func(t *testing.T, dm ContextManager)) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			dm, err := initDB(t, backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanUp(t, dm)
+
+			test(t, dm)
+		})
 	}
-	defer cleanUp(t, dm)
+}
 
+func TestDatabaseManager(t *testing.T) {
+	runForEachBackend(t, testDatabaseManager)
+}
+
+func testDatabaseManager(t *testing.T, dm ContextManager) {
 	testIdentity := generateRandomIdentity()
 
 	// check not exists
-	_, err = dm.GetIdentity(testIdentity.Uid)
+	_, err := dm.GetIdentity(testIdentity.Uid)
 	if err != ErrNotExist {
 		t.Error("GetIdentity did not return ErrNotExist")
 	}
@@ -85,13 +106,89 @@ func TestDatabaseManager(t *testing.T) {
 	}
 }
 
-func TestStoreExisting(t *testing.T) {
-	dm, err := initDB()
+func TestGetUuidsForPublicKeys(t *testing.T) {
+	runForEachBackend(t, testGetUuidsForPublicKeys)
+}
+
+func testGetUuidsForPublicKeys(t *testing.T, dm ContextManager) {
+	testIdentity := generateRandomIdentity()
+	testIdentity.NextPublicKey = generateRandomIdentity().PublicKey
+
+	rotatedIdentity := generateRandomIdentity()
+	rotatedIdentity.PrevPrivateKey = generateRandomIdentity().PrivateKey
+	rotatedIdentity.PrevPublicKey = generateRandomIdentity().PublicKey
+	rotatedIdentity.PrevKeyExpiry = time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, id := range []*Identity{testIdentity, rotatedIdentity} {
+		tx, err := dm.StartTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the keys of a key rotation are only set by updates
+		err = dm.StoreNewIdentity(tx, *id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = dm.UpdateIdentity(tx, *id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = dm.CloseTransaction(tx, Commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unknownPubKey := generateRandomIdentity().PublicKey
+
+	// more public keys than fit into a single SQLite query
+	pubKeys := [][]byte{testIdentity.PublicKey, testIdentity.NextPublicKey, rotatedIdentity.PrevPublicKey, unknownPubKey}
+	for i := 0; i < sqliteMaxLookupKeys; i++ {
+		pubKeys = append(pubKeys, generateRandomIdentity().PublicKey)
+	}
+	pubKeys = append(pubKeys, rotatedIdentity.PublicKey)
+
+	uids, err := dm.GetUuidsForPublicKeys(pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]uuid.UUID{
+		string(testIdentity.PublicKey):        testIdentity.Uid,
+		string(testIdentity.NextPublicKey):    testIdentity.Uid,
+		string(rotatedIdentity.PublicKey):     rotatedIdentity.Uid,
+		string(rotatedIdentity.PrevPublicKey): rotatedIdentity.Uid,
+	}
+
+	if len(uids) != len(expected) {
+		t.Errorf("GetUuidsForPublicKeys returned %d UUIDs, expected %d", len(uids), len(expected))
+	}
+	for pubKey, expectedUid := range expected {
+		if uids[pubKey] != expectedUid {
+			t.Errorf("GetUuidsForPublicKeys returned unexpected value: %s, expected: %s", uids[pubKey], expectedUid)
+		}
+	}
+
+	uids, err = dm.GetUuidsForPublicKeys(nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer cleanUp(t, dm)
+	if len(uids) != 0 {
+		t.Errorf("GetUuidsForPublicKeys returned UUIDs without public keys: %v", uids)
+	}
+}
 
+func TestStoreExisting(t *testing.T) {
+	runForEachBackend(t, testStoreExisting)
+}
+
+func testStoreExisting(t *testing.T, dm ContextManager) {
 	testIdentity := generateRandomIdentity()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -123,16 +220,181 @@ func TestStoreExisting(t *testing.T) {
 	if err == nil {
 		t.Fatal("existing identity was overwritten")
 	}
+
+	err = dm.CloseTransaction(tx2, Rollback)
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func TestDatabaseLoad(t *testing.T) {
+func TestGetIdentityForUpdate(t *testing.T) {
+	runForEachBackend(t, testGetIdentityForUpdate)
+}
+
+func testGetIdentityForUpdate(t *testing.T, dm ContextManager) {
+	testIdentity := generateRandomIdentity()
+	storeAndCommit(t, dm, testIdentity)
+
+	// concurrent transactions register a next public key, if none is pending yet
 	wg := &sync.WaitGroup{}
+	mutex := &sync.Mutex{}
+	var registeredKeys [][]byte
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			tx, err := dm.StartTransaction(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			id, err := dm.GetIdentityForUpdate(tx, testIdentity.Uid)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if len(id.NextPublicKey) != 0 {
+				err = dm.CloseTransaction(tx, Rollback)
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+
+			id.NextPrivateKey = generateRandomIdentity().PrivateKey
+			id.NextPublicKey = generateRandomIdentity().PublicKey
+
+			err = dm.UpdateIdentity(tx, *id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			err = dm.CloseTransaction(tx, Commit)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			mutex.Lock()
+			registeredKeys = append(registeredKeys, id.NextPublicKey)
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(registeredKeys) != 1 {
+		t.Fatalf("unexpected number of registered next public keys: %d", len(registeredKeys))
+	}
+
+	idFromDb, err := dm.GetIdentity(testIdentity.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(idFromDb.NextPublicKey, registeredKeys[0]) {
+		t.Error("next public key was overwritten by concurrent transaction")
+	}
+
+	// unknown identity
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tx, err := dm.StartTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dm.GetIdentityForUpdate(tx, uuid.New())
+	if err != ErrNotExist {
+		t.Errorf("GetIdentityForUpdate did not return ErrNotExist: %v", err)
+	}
+
+	err = dm.CloseTransaction(tx, Rollback)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetUuidsWithExpiredPrevKey(t *testing.T) {
+	runForEachBackend(t, testGetUuidsWithExpiredPrevKey)
+}
+
+func testGetUuidsWithExpiredPrevKey(t *testing.T, dm ContextManager) {
+	now := time.Now()
+
+	expiredIdentity := generateRandomIdentity()
+	expiredIdentity.PrevPrivateKey = generateRandomIdentity().PrivateKey
+	expiredIdentity.PrevPublicKey = generateRandomIdentity().PublicKey
+	expiredIdentity.PrevKeyExpiry = now.Add(-time.Hour).UTC().Truncate(time.Second)
+
+	rotatedIdentity := generateRandomIdentity()
+	rotatedIdentity.PrevPrivateKey = generateRandomIdentity().PrivateKey
+	rotatedIdentity.PrevPublicKey = generateRandomIdentity().PublicKey
+	rotatedIdentity.PrevKeyExpiry = now.Add(time.Hour).UTC().Truncate(time.Second)
+
+	testIdentity := generateRandomIdentity()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, id := range []*Identity{expiredIdentity, rotatedIdentity, testIdentity} {
+		tx, err := dm.StartTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	dm, err := initDB()
+		// the keys of a key rotation are only set by updates
+		err = dm.StoreNewIdentity(tx, *id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = dm.UpdateIdentity(tx, *id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = dm.CloseTransaction(tx, Commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uids, err := dm.GetUuidsWithExpiredPrevKey(now)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer cleanUp(t, dm)
+
+	// other tests may have stored identities with replaced keys in the same store
+	found := map[uuid.UUID]bool{}
+	for _, uid := range uids {
+		found[uid] = true
+	}
+
+	if !found[expiredIdentity.Uid] {
+		t.Error("identity with expired replaced key was not returned")
+	}
+	if found[rotatedIdentity.Uid] {
+		t.Error("identity within the key rotation grace period was returned")
+	}
+	if found[testIdentity.Uid] {
+		t.Error("identity without replaced key was returned")
+	}
+}
+
+func TestDatabaseLoad(t *testing.T) {
+	runForEachBackend(t, testDatabaseLoad)
+}
+
+func testDatabaseLoad(t *testing.T, dm ContextManager) {
+	wg := &sync.WaitGroup{}
 
 	// generate identities
 	var testIdentities []*Identity
@@ -174,7 +436,7 @@ type dbConfig struct {
 	PostgresDSN string
 }
 
-func initDB() (*DatabaseManager, error) {
+func initDB(t *testing.T, backend string) (ContextManager, error) {
 	testDbParams := &DatabaseParams{
 		MaxOpenConns:    10,
 		MaxIdleConns:    5,
@@ -182,29 +444,62 @@ func initDB() (*DatabaseManager, error) {
 		ConnMaxIdleTime: 1 * time.Minute,
 	}
 
-	fileHandle, err := os.Open("config.json")
-	if err != nil {
-		return nil, err
-	}
-	defer fileHandle.Close()
-
-	c := &dbConfig{}
-	err = json.NewDecoder(fileHandle).Decode(c)
-	if err != nil {
-		return nil, err
+	switch backend {
+	case PostgreSql:
+		fileHandle, err := os.Open("config.json")
+		if err != nil {
+			return nil, err
+		}
+		defer fileHandle.Close()
+
+		c := &dbConfig{}
+		err = json.NewDecoder(fileHandle).Decode(c)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewSqlDatabaseInfo(c.PostgresDSN, testTableName, testDbParams)
+	case SQLite:
+		if !sqliteSupported {
+			t.Skip(errSqliteNotSupported)
+		}
+		return NewSqliteDatabaseInfo(filepath.Join(t.TempDir(), "test.db"), testTableName, testDbParams)
+	case fileBackend:
+		return NewFileContextManager(t.TempDir())
+	case memoryBackend:
+		return NewMemoryContextManager(), nil
+	default:
+		return nil, fmt.Errorf("unknown database backend: %s", backend)
 	}
-
-	return NewSqlDatabaseInfo(c.PostgresDSN, testTableName, testDbParams)
 }
 
-func cleanUp(t *testing.T, dm *DatabaseManager) {
-	dropTableQuery := fmt.Sprintf("DROP TABLE %s;", testTableName)
-	_, err := dm.db.Exec(dropTableQuery)
-	if err != nil {
-		t.Error(err)
-	}
-
-	dm.Close()
+func cleanUp(t *testing.T, ctxMngr ContextManager) {
+	var db *sql.DB
+
+	switch dm := ctxMngr.(type) {
+	case *DatabaseManager:
+		db = dm.db
+	case *SqliteDatabaseManager:
+		db = dm.db
+	case *FileContextManager:
+		dm.Close() // identity files are removed with the temporary directory
+		return
+	case *MemoryContextManager:
+		dm.Close()
+		return
+	default:
+		t.Fatalf("unexpected context manager type: %T", ctxMngr)
+	}
+
+	for _, table := range []string{testTableName, versionTableName(testTableName)} {
+		dropTableQuery := fmt.Sprintf("DROP TABLE %s;", table)
+		_, err := db.Exec(dropTableQuery)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	ctxMngr.Close()
 }
 
 func generateRandomIdentity() *Identity {
@@ -249,6 +544,20 @@ func storeIdentity(ctxMngr ContextManager, id *Identity, wg *sync.WaitGroup) err
 	return nil
 }
 
+func storeAndCommit(t *testing.T, ctxMngr ContextManager, id *Identity) {
+	err := storeIdentity(ctxMngr, id, newDoneWaitGroup())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newDoneWaitGroup returns a wait group with one pending call to Done
+func newDoneWaitGroup() *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	return wg
+}
+
 func checkIdentity(ctxMngr ContextManager, id *Identity, wg *sync.WaitGroup) error {
 	defer wg.Done()
 
@@ -262,7 +571,12 @@ func checkIdentity(ctxMngr ContextManager, id *Identity, wg *sync.WaitGroup) err
 	if !bytes.Equal(idFromCtx.PublicKey, id.PublicKey) {
 		return fmt.Errorf("GetIdentity returned unexpected PublicKey value")
 	}
-	if idFromCtx.AuthToken != id.AuthToken {
+	// the protocol stores a hash of the auth token
+	authOk, err := verifyAuthToken(idFromCtx.AuthToken, id.AuthToken)
+	if err != nil {
+		return err
+	}
+	if !authOk {
 		return fmt.Errorf("GetIdentity returned unexpected AuthToken value")
 	}
 	if !bytes.Equal(idFromCtx.Uid[:], id.Uid[:]) {
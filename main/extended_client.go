@@ -26,9 +26,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	h "github.com/ubirch/ubirch-client-go/main/adapters/httphelper"
 	urlpkg "net/url"
 )
@@ -39,6 +41,8 @@ type ExtendedClient struct {
 	CertificateServerURL       string
 	CertificateServerPubKeyURL string
 	ServerTLSCertFingerprints  map[string][32]byte
+	CertificateListFile        string // local file with the signed public key certificate list, replaces the certificate server (optional)
+	CertificateListKeyFile     string // local file with the public key for the verification of the certificate list signature
 }
 
 func (c *ExtendedClient) SendToUbirchSigningService(uid uuid.UUID, auth string, upp []byte) (h.HTTPResponse, error) {
@@ -46,6 +50,55 @@ func (c *ExtendedClient) SendToUbirchSigningService(uid uuid.UUID, auth string,
 	return clients.Post(endpoint, upp, UCCHeader(auth))
 }
 
+// SubmitKeyUpdate registers a public key at the key service, which replaces the previously registered public key
+func (c *ExtendedClient) SubmitKeyUpdate(uid uuid.UUID, keyUpdate []byte) error {
+	log.Debugf("%s: updating public key at key service", uid)
+
+	keyUpdateHeader := map[string]string{"content-type": "application/json"}
+
+	resp, err := clients.Post(c.KeyServiceURL+"/update", keyUpdate, keyUpdateHeader)
+	if err != nil {
+		return fmt.Errorf("error sending key update: %v", err)
+	}
+	if h.HttpFailed(resp.StatusCode) {
+		return fmt.Errorf("key update failed: (%d) %q", resp.StatusCode, resp.Content)
+	}
+	log.Debugf("%s: key update successful: (%d) %s", uid, resp.StatusCode, string(resp.Content))
+	return nil
+}
+
+// SubmitKeyDeletion deletes a public key at the key service. Returns ErrNotExist,
+// if the key service does not know the public key.
+func (c *ExtendedClient) SubmitKeyDeletion(uid uuid.UUID, keyDeletion []byte) error {
+	log.Debugf("%s: deleting public key at key service", uid)
+
+	client := &http.Client{Timeout: h.BackendRequestTimeout}
+
+	req, err := http.NewRequest(http.MethodDelete, c.KeyServiceURL, bytes.NewBuffer(keyDeletion))
+	if err != nil {
+		return fmt.Errorf("can't make new delete request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending key deletion: %v", err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	respBodyBytes, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotExist
+	}
+	if h.HttpFailed(resp.StatusCode) {
+		return fmt.Errorf("key deletion failed: (%d) %q", resp.StatusCode, respBodyBytes)
+	}
+	log.Debugf("%s: key deletion successful: (%d) %s", uid, resp.StatusCode, string(respBodyBytes))
+	return nil
+}
+
 func UCCHeader(auth string) map[string]string {
 	return map[string]string{
 		"x-auth-token": auth,
@@ -70,21 +123,90 @@ type Certificate struct {
 
 type Verify func(pubKeyPEM []byte, data []byte, signature []byte) (bool, error)
 
-func (c *ExtendedClient) RequestCertificateList(verify Verify) ([]Certificate, error) {
-	respBodyBytes, err := c.getWithCertPinning(c.CertificateServerURL)
-	if err != nil {
-		return nil, fmt.Errorf("retrieving public key certificate list failed: %v", err)
+// VerifiedTrustList is a public key certificate list, the signature of which was successfully verified
+type VerifiedTrustList struct {
+	SignedList   []byte        `json:"signedList"` // base64 encoded signature and JSON encoded certificate list, separated by a newline
+	PublicKey    []byte        `json:"-"`          // PEM encoded public key for the verification of the signature
+	VerifiedAt   time.Time     `json:"verifiedAt"` // time of the verification
+	Certificates []Certificate `json:"-"`
+}
+
+// RequestCertificateList retrieves the signed public key certificate list and the public key for its verification
+// from the certificate server or, if configured, from the local files and verifies the signature of the list
+func (c *ExtendedClient) RequestCertificateList(verify Verify) (*VerifiedTrustList, error) {
+	if c.CertificateListFile != "" {
+		return c.ReadCertificateListFile(verify)
 	}
 
-	respContent := strings.SplitN(string(respBodyBytes), "\n", 2)
-	if len(respContent) < 2 {
-		return nil, fmt.Errorf("unexpected response content from public key certificate server")
+	signedList, err := c.getWithCertPinning(c.CertificateServerURL)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving public key certificate list failed: %w", err)
 	}
 
-	// verify signature
 	pubKeyPEM, err := c.RequestCertificateListPublicKey()
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve public key for certificate list verification: %v", err)
+		return nil, fmt.Errorf("unable to retrieve public key for certificate list verification: %w", err)
+	}
+
+	return newVerifiedTrustList(signedList, pubKeyPEM, verify)
+}
+
+// ReadCertificateListFile reads the signed public key certificate list and the public key for its
+// verification from the local files, e.g. in offline installations, and verifies the signature of the list
+func (c *ExtendedClient) ReadCertificateListFile(verify Verify) (*VerifiedTrustList, error) {
+	signedList, err := ioutil.ReadFile(c.CertificateListFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading public key certificate list file failed: %v", err)
+	}
+
+	pubKeyPEM, err := c.ReadCertificateListKeyFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return newVerifiedTrustList(signedList, pubKeyPEM, verify)
+}
+
+// ReadCertificateListKeyFile reads the PEM encoded public key for the verification
+// of the certificate list signature from the local key file
+func (c *ExtendedClient) ReadCertificateListKeyFile() ([]byte, error) {
+	pubKeyPEM, err := ioutil.ReadFile(c.CertificateListKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read public key for certificate list verification: %v", err)
+	}
+
+	return pubKeyPEM, nil
+}
+
+// CertificateListSource returns a description of where the public key certificate list is loaded from
+func (c *ExtendedClient) CertificateListSource() string {
+	if c.CertificateListFile != "" {
+		return "file " + c.CertificateListFile
+	}
+	return "server"
+}
+
+func newVerifiedTrustList(signedList, pubKeyPEM []byte, verify Verify) (*VerifiedTrustList, error) {
+	certs, err := VerifyCertificateList(signedList, pubKeyPEM, verify)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VerifiedTrustList{
+		SignedList:   signedList,
+		PublicKey:    pubKeyPEM,
+		VerifiedAt:   time.Now().UTC(),
+		Certificates: certs,
+	}, nil
+}
+
+// VerifyCertificateList verifies the signature of a signed public key certificate list, which consists of
+// the base64 encoded signature and the JSON encoded certificate list, separated by a newline.
+// Returns the certificates of the list, if the signature is valid.
+func VerifyCertificateList(signedList, pubKeyPEM []byte, verify Verify) ([]Certificate, error) {
+	respContent := strings.SplitN(string(signedList), "\n", 2)
+	if len(respContent) < 2 {
+		return nil, fmt.Errorf("unexpected content of public key certificate list")
 	}
 
 	signature, err := base64.StdEncoding.DecodeString(respContent[0])
@@ -114,7 +236,7 @@ func (c *ExtendedClient) RequestCertificateList(verify Verify) ([]Certificate, e
 func (c *ExtendedClient) RequestCertificateListPublicKey() ([]byte, error) {
 	resp, err := c.getWithCertPinning(c.CertificateServerPubKeyURL)
 	if err != nil {
-		return nil, fmt.Errorf("retrieving public key for certificate list verification failed: %v", err)
+		return nil, fmt.Errorf("retrieving public key for certificate list verification failed: %w", err)
 	}
 
 	return resp, nil
@@ -132,7 +254,7 @@ func (c *ExtendedClient) getWithCertPinning(url string) ([]byte, error) {
 	}
 
 	// set up TLS certificate verification
-	client := &http.Client{}
+	client := &http.Client{Timeout: h.BackendRequestTimeout}
 	client.Transport = &http.Transport{
 		TLSClientConfig: &tls.Config{
 			//VerifyPeerCertificate: NewPeerCertificateVerifier(tlsCertFingerprint),
@@ -154,12 +276,56 @@ func (c *ExtendedClient) getWithCertPinning(url string) ([]byte, error) {
 
 	if h.HttpFailed(resp.StatusCode) {
 		respBodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("response: (%s) %s", resp.Status, string(respBodyBytes))
+		err = fmt.Errorf("response: (%s) %s", resp.Status, string(respBodyBytes))
+
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return nil, &retryAfterError{err: err, retryAfter: retryAfter}
+		}
+		return nil, err
 	}
 
 	return ioutil.ReadAll(resp.Body)
 }
 
+// retryAfterError is returned, if the server responded with an error and
+// requested to wait before the next request with a Retry-After header
+type retryAfterError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.err, e.retryAfter)
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date, relative to the given time
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if date.Before(now) {
+		return 0, true
+	}
+	return date.Sub(now), true
+}
+
 //// VerifyPeerCertificate is called after normal certificate verification by either a TLS client or server. It receives
 //// the raw ASN.1 certificates provided by the peer and also any verified chains that normal processing found.
 //// If it returns a non-nil error, the handshake is aborted and that error results.
@@ -0,0 +1,331 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	identityStoreDirName = "cose_identity"
+	journalFileName      = "journal.json"
+	identityFileExt      = ".json"
+	identityFilePerm     = 0600
+	identityDirPerm      = 0700
+)
+
+// identityRecord is the representation of an identity in the file-based identity store.
+// The private keys are stored encrypted, the same way as in the database.
+type identityRecord struct {
+	Uid            uuid.UUID  `json:"uuid"`
+	PrivateKey     []byte     `json:"privKey"`
+	PublicKey      []byte     `json:"pubKey"`
+	AuthToken      string     `json:"token"`
+	Algorithm      string     `json:"algorithm"`
+	NextPrivateKey []byte     `json:"nextPrivKey,omitempty"`
+	NextPublicKey  []byte     `json:"nextPubKey,omitempty"`
+	PrevPrivateKey []byte     `json:"prevPrivKey,omitempty"`
+	PrevPublicKey  []byte     `json:"prevPubKey,omitempty"`
+	PrevKeyExpiry  *time.Time `json:"prevKeyExpiry,omitempty"`
+	KeyVersion     string     `json:"keyVersion,omitempty"`
+}
+
+// journal contains the changes of a transaction, which affects more than one identity.
+// It is persisted before the changes are applied to the identity files and replayed at
+// start-up, if the changes could not be applied completely. If applying the changes fails,
+// the journal is replaced by a journal, which restores the last committed state.
+type journal struct {
+	Store  []identityRecord `json:"store"`
+	Delete []uuid.UUID      `json:"delete"`
+}
+
+// FileContextManager is a file-based identity store, which keeps one file per identity in the
+// configuration directory. All identities are held in memory, the files are only read at start-up.
+// Transactions are serialized, i.e. only one transaction can be open at a time.
+type FileContextManager struct {
+	*MemoryContextManager
+	identityDir string
+	failed      error // set, if the identity files could not be rolled back after a failed transaction
+}
+
+// Ensure FileContextManager implements the ContextManager interface
+var _ ContextManager = (*FileContextManager)(nil)
+
+func NewFileContextManager(configDir string) (*FileContextManager, error) {
+	f := &FileContextManager{
+		MemoryContextManager: NewMemoryContextManager(),
+		identityDir:          filepath.Join(configDir, identityStoreDirName),
+	}
+	f.persist = f.persistChanges
+
+	log.Infof("preparing file-based identity store: %s", f.identityDir)
+
+	err := os.MkdirAll(f.identityDir, identityDirPerm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.replayJournal()
+	if err != nil {
+		return nil, fmt.Errorf("unable to replay journal: %v", err)
+	}
+
+	err = f.loadIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("loaded %d identities from file-based identity store", len(f.identities))
+
+	return f, nil
+}
+
+func (f *FileContextManager) IsReady(ctx context.Context) error {
+	_, err := os.Stat(f.identityDir)
+	return err
+}
+
+// persistChanges persists the changes of a transaction to the identity files. Changes, which affect more than one
+// identity, are written to a journal first, so they can be completed at the next start-up, if applying them
+// to the identity files fails. If the changes can not be applied, the identity files are rolled back.
+func (f *FileContextManager) persistChanges(changes map[uuid.UUID]*Identity) error {
+	if f.failed != nil {
+		return fmt.Errorf("identity files are inconsistent, no further changes are persisted: %v", f.failed)
+	}
+
+	// a journal, which is left from a transaction that could not be rolled back completely, is replayed first,
+	// so that no changes are persisted on top of identity files, which do not reflect the committed identities
+	err := f.replayJournal()
+	if err != nil {
+		return fmt.Errorf("unable to replay journal: %v", err)
+	}
+
+	journalFile := filepath.Join(f.identityDir, journalFileName)
+
+	if len(changes) > 1 {
+		err = persistFileAtomic(journalFile, newJournal(changes), identityFilePerm)
+		if err != nil {
+			return fmt.Errorf("unable to persist journal: %v", err)
+		}
+	}
+
+	err = f.applyJournal(newJournal(changes))
+	if err != nil {
+		rollbackErr := f.rollback(changes)
+		if rollbackErr != nil {
+			log.Errorf("unable to roll back identity files, rollback will be retried before the next change: %v", rollbackErr)
+		}
+		return err
+	}
+
+	if len(changes) > 1 {
+		err = removeFileAndBackup(journalFile)
+		if err != nil {
+			log.Errorf("unable to remove journal: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// rollback restores the identity files, which are affected by the given changes, to the committed identities.
+// The journal of the failed transaction is replaced by a journal with the committed identities first, so that
+// an incomplete rollback is completed before the next change or at the next start-up.
+func (f *FileContextManager) rollback(changes map[uuid.UUID]*Identity) error {
+	committed := make(map[uuid.UUID]*Identity, len(changes))
+
+	f.mutex.RLock()
+	for uid := range changes {
+		if id, found := f.identities[uid]; found {
+			committed[uid] = &id
+		} else {
+			committed[uid] = nil
+		}
+	}
+	f.mutex.RUnlock()
+
+	j := newJournal(committed)
+	journalFile := filepath.Join(f.identityDir, journalFileName)
+
+	err := persistFileAtomic(journalFile, j, identityFilePerm)
+	if err != nil {
+		// the identity files can neither be restored now nor later, so no further changes must be persisted
+		f.failed = fmt.Errorf("unable to persist rollback journal: %v", err)
+		return f.failed
+	}
+
+	// the backup contains the journal of the failed transaction, which must never be replayed
+	err = os.Remove(journalFile + ".bck")
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove backup of journal: %v", err)
+	}
+
+	err = f.applyJournal(j)
+	if err != nil {
+		return err
+	}
+
+	return removeFileAndBackup(journalFile)
+}
+
+// newJournal returns a journal with the given changes, a nil identity marks a deletion
+func newJournal(changes map[uuid.UUID]*Identity) *journal {
+	j := &journal{}
+	for uid, id := range changes {
+		if id == nil {
+			j.Delete = append(j.Delete, uid)
+		} else {
+			j.Store = append(j.Store, *toIdentityRecord(*id))
+		}
+	}
+	return j
+}
+
+// applyJournal writes the changes of a journal to the identity files
+func (f *FileContextManager) applyJournal(j *journal) error {
+	for _, record := range j.Store {
+		err := persistFileAtomic(f.identityFile(record.Uid), record, identityFilePerm)
+		if err != nil {
+			return fmt.Errorf("%s: unable to persist identity: %v", record.Uid, err)
+		}
+	}
+
+	for _, uid := range j.Delete {
+		err := removeFileAndBackup(f.identityFile(uid))
+		if err != nil {
+			return fmt.Errorf("%s: unable to delete identity: %v", uid, err)
+		}
+	}
+
+	return nil
+}
+
+// replayJournal completes a transaction, which was interrupted while its changes were applied to the identity files
+func (f *FileContextManager) replayJournal() error {
+	journalFile := filepath.Join(f.identityDir, journalFileName)
+
+	if _, err := os.Stat(journalFile); os.IsNotExist(err) {
+		return nil
+	}
+
+	j := &journal{}
+	err := loadFile(journalFile, j)
+	if err != nil {
+		return err
+	}
+
+	if len(j.Store) == 0 && len(j.Delete) == 0 {
+		return nil
+	}
+
+	log.Warnf("completing interrupted transaction from journal: %s", journalFile)
+
+	err = f.applyJournal(j)
+	if err != nil {
+		return err
+	}
+
+	return removeFileAndBackup(journalFile)
+}
+
+func (f *FileContextManager) loadIdentities() error {
+	files, err := ioutil.ReadDir(f.identityDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		uid, err := uuid.Parse(strings.TrimSuffix(file.Name(), identityFileExt))
+		if err != nil || !strings.HasSuffix(file.Name(), identityFileExt) {
+			continue // not an identity file, e.g. a backup or temporary file
+		}
+
+		record := identityRecord{}
+		err = loadFile(f.identityFile(uid), &record)
+		if err != nil {
+			return fmt.Errorf("%s: unable to load identity: %v", uid, err)
+		}
+		if record.Uid != uid {
+			return fmt.Errorf("%s: identity file contains unexpected UUID: %s", uid, record.Uid)
+		}
+
+		f.load(*record.toIdentity())
+	}
+
+	return nil
+}
+
+func (f *FileContextManager) identityFile(uid uuid.UUID) string {
+	return filepath.Join(f.identityDir, uid.String()+identityFileExt)
+}
+
+func removeFileAndBackup(file string) error {
+	for _, name := range []string{file, file + ".bck"} {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func toIdentityRecord(id Identity) *identityRecord {
+	record := &identityRecord{
+		Uid:            id.Uid,
+		PrivateKey:     id.PrivateKey,
+		PublicKey:      id.PublicKey,
+		AuthToken:      id.AuthToken,
+		Algorithm:      id.Algorithm,
+		NextPrivateKey: id.NextPrivateKey,
+		NextPublicKey:  id.NextPublicKey,
+		PrevPrivateKey: id.PrevPrivateKey,
+		PrevPublicKey:  id.PrevPublicKey,
+		KeyVersion:     id.KeyVersion,
+	}
+	if !id.PrevKeyExpiry.IsZero() {
+		prevKeyExpiry := id.PrevKeyExpiry
+		record.PrevKeyExpiry = &prevKeyExpiry
+	}
+	return record
+}
+
+func (r identityRecord) toIdentity() *Identity {
+	id := &Identity{
+		Uid:            r.Uid,
+		PrivateKey:     r.PrivateKey,
+		PublicKey:      r.PublicKey,
+		AuthToken:      r.AuthToken,
+		Algorithm:      r.Algorithm,
+		NextPrivateKey: r.NextPrivateKey,
+		NextPublicKey:  r.NextPublicKey,
+		PrevPrivateKey: r.PrevPrivateKey,
+		PrevPublicKey:  r.PrevPublicKey,
+		KeyVersion:     r.KeyVersion,
+	}
+	if r.PrevKeyExpiry != nil {
+		id.PrevKeyExpiry = *r.PrevKeyExpiry
+	}
+	return id
+}
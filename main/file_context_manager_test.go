@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestGetCtxManager_FileStore(t *testing.T) {
+	c := &Config{configDir: t.TempDir()}
+
+	// the file-based identity store is not used without explicit opt-in
+	_, err := GetCtxManager(c)
+	if err == nil {
+		t.Error("GetCtxManager did not return an error without configured identity store")
+	}
+
+	c.FileStore = true
+
+	ctxManager, err := GetCtxManager(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctxManager.Close()
+
+	if _, ok := ctxManager.(*FileContextManager); !ok {
+		t.Errorf("unexpected context manager type: %T", ctxManager)
+	}
+}
+
+func TestFileContextManager_Reload(t *testing.T) {
+	configDir := t.TempDir()
+
+	fm, err := NewFileContextManager(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testIdentity := generateRandomIdentity()
+	testIdentity.NextPrivateKey = []byte("next private key")
+	testIdentity.NextPublicKey = []byte("next public key")
+
+	storeAndCommit(t, fm, testIdentity)
+
+	// load identities from files
+	reloaded, err := NewFileContextManager(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkIdentity(reloaded, testIdentity, newDoneWaitGroup())
+	if err != nil {
+		t.Error(err)
+	}
+
+	uid, err := reloaded.GetUuidForPublicKey(testIdentity.NextPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != testIdentity.Uid {
+		t.Errorf("GetUuidForPublicKey returned unexpected value for next public key: %s", uid)
+	}
+
+	// delete identity
+	tx, err := reloaded.StartTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reloaded.DeleteIdentity(tx, testIdentity.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reloaded.CloseTransaction(tx, Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = reloaded.GetUuidForPublicKey(testIdentity.PublicKey)
+	if err != ErrNotExist {
+		t.Errorf("GetUuidForPublicKey did not return ErrNotExist after deletion: %v", err)
+	}
+
+	reloaded, err = NewFileContextManager(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = reloaded.GetIdentity(testIdentity.Uid)
+	if err != ErrNotExist {
+		t.Errorf("GetIdentity did not return ErrNotExist after deletion: %v", err)
+	}
+}
+
+func TestFileContextManager_Backup(t *testing.T) {
+	configDir := t.TempDir()
+
+	fm, err := NewFileContextManager(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testIdentity := generateRandomIdentity()
+	storeAndCommit(t, fm, testIdentity)
+
+	// update identity to create a backup of the identity file
+	updatedIdentity := *testIdentity
+	updatedIdentity.AuthToken = "updated"
+
+	tx, err := fm.StartTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fm.UpdateIdentity(tx, updatedIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fm.CloseTransaction(tx, Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt identity file
+	err = ioutil.WriteFile(fm.identityFile(testIdentity.Uid), []byte("{corrupt"), identityFilePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewFileContextManager(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkIdentity(reloaded, testIdentity, newDoneWaitGroup())
+	if err != nil {
+		t.Errorf("identity was not recovered from backup: %v", err)
+	}
+}
+
+func TestFileContextManager_Journal(t *testing.T) {
+	configDir := t.TempDir()
+
+	fm, err := NewFileContextManager(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deletedIdentity := generateRandomIdentity()
+	storeAndCommit(t, fm, deletedIdentity)
+
+	// simulate a transaction, which was interrupted after the journal was persisted
+	storedIdentities := []*Identity{generateRandomIdentity(), generateRandomIdentity()}
+
+	j := &journal{Delete: []uuid.UUID{deletedIdentity.Uid}}
+	for _, id := range storedIdentities {
+		j.Store = append(j.Store, *toIdentityRecord(*id))
+	}
+
+	journalFile := filepath.Join(configDir, identityStoreDirName, journalFileName)
+
+	err = persistFileAtomic(journalFile, j, identityFilePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewFileContextManager(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range storedIdentities {
+		err = checkIdentity(reloaded, id, newDoneWaitGroup())
+		if err != nil {
+			t.Errorf("journal was not replayed: %v", err)
+		}
+	}
+
+	_, err = reloaded.GetIdentity(deletedIdentity.Uid)
+	if err != ErrNotExist {
+		t.Errorf("journal was not replayed, GetIdentity did not return ErrNotExist: %v", err)
+	}
+
+	if _, err = os.Stat(journalFile); !os.IsNotExist(err) {
+		t.Errorf("journal was not removed after replay: %v", err)
+	}
+}
+
+func TestFileContextManager_Rollback(t *testing.T) {
+	configDir := t.TempDir()
+
+	fm, err := NewFileContextManager(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testIdentity := generateRandomIdentity()
+	storeAndCommit(t, fm, testIdentity)
+
+	// the identity file of the new identity can not be written
+	newIdentity := generateRandomIdentity()
+	blocker := fm.identityFile(newIdentity.Uid)
+
+	err = os.Mkdir(blocker, identityDirPerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(blocker, "blocker"), nil, identityFilePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failedUpdate := *testIdentity
+	failedUpdate.AuthToken = "failed update"
+
+	updateAndStore := func(t *testing.T, update *Identity, newId *Identity) error {
+		tx, err := fm.StartTransaction(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = fm.UpdateIdentity(tx, *update)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if newId != nil {
+			err = fm.StoreNewIdentity(tx, *newId)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return fm.CloseTransaction(tx, Commit)
+	}
+
+	err = updateAndStore(t, &failedUpdate, newIdentity)
+	if err == nil {
+		t.Fatal("transaction was committed, although an identity file could not be written")
+	}
+
+	// the rollback can not be completed, since the blocker can not be removed,
+	// so no further changes are persisted until the rollback was completed
+	committedUpdate := *testIdentity
+	committedUpdate.AuthToken = "committed update"
+
+	err = updateAndStore(t, &committedUpdate, nil)
+	if err == nil {
+		t.Error("change was persisted before the rollback of the failed transaction was completed")
+	}
+
+	err = os.RemoveAll(blocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = updateAndStore(t, &committedUpdate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journalFile := filepath.Join(configDir, identityStoreDirName, journalFileName)
+	if _, err = os.Stat(journalFile); !os.IsNotExist(err) {
+		t.Errorf("journal was not removed after rollback: %v", err)
+	}
+
+	// the failed transaction must not be resurrected at start-up
+	reloaded, err := NewFileContextManager(configDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkIdentity(reloaded, &committedUpdate, newDoneWaitGroup())
+	if err != nil {
+		t.Errorf("committed update was reverted: %v", err)
+	}
+
+	_, err = reloaded.GetIdentity(newIdentity.Uid)
+	if err != ErrNotExist {
+		t.Errorf("identity of failed transaction was stored, GetIdentity did not return ErrNotExist: %v", err)
+	}
+}
@@ -155,3 +155,53 @@ func persistFile(file string, source interface{}) error {
 	}
 	return ioutil.WriteFile(file, contextBytes, filePerm)
 }
+
+// persistFileAtomic writes the JSON encoded source to a temporary file, which then replaces the file by renaming it,
+// so the file is never left in a partially written state. Like persistFile, a backup of the previous version of the
+// file is kept, which is read by loadFile, if the file can not be loaded.
+func persistFileAtomic(file string, source interface{}, perm os.FileMode) error {
+	contextBytes, err := json.MarshalIndent(source, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile := file + ".tmp"
+	err = writeFileSync(tmpFile, contextBytes, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(file); err == nil { // if file already exists, create a backup
+		err = copyFile(file, file+".bck", perm)
+		if err != nil {
+			log.Warnf("unable to create backup file for %s: %v", file, err)
+		}
+	}
+
+	return os.Rename(tmpFile, file)
+}
+
+// writeFileSync writes data to a file and commits the content to stable storage before closing the file
+func writeFileSync(file string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, perm)
+}
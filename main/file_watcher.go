@@ -0,0 +1,88 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const fileWatchInterval = 5 * time.Second
+
+// fileState is the state of a watched file, which indicates changes of the file
+type fileState struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+func statFile(file string) fileState {
+	info, err := os.Stat(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("unable to check watched file: %v", err)
+		}
+		return fileState{}
+	}
+	return fileState{exists: true, modTime: info.ModTime(), size: info.Size()}
+}
+
+// watchFiles polls the given files in the given interval until the context is cancelled and notifies the
+// returned channel, when one of the files was created, modified or removed. Changes, which occur before
+// the previous notification was received, are merged into a single notification.
+func watchFiles(ctx context.Context, interval time.Duration, files ...string) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+
+	states := make([]fileState, len(files))
+	for i, file := range files {
+		states[i] = statFile(file)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			modified := false
+
+			for i, file := range files {
+				state := statFile(file)
+				if state != states[i] {
+					log.Debugf("watched file changed: %s", file)
+					states[i] = state
+					modified = true
+				}
+			}
+
+			if modified {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changed
+}
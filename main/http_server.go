@@ -0,0 +1,82 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	log "github.com/sirupsen/logrus"
+	h "github.com/ubirch/ubirch-client-go/main/adapters/httphelper"
+)
+
+// HTTPServer serves the router like the HTTPServer of the ubirch client handlers,
+// but with an optional TLS configuration, e.g. for the verification of client certificates
+type HTTPServer struct {
+	Router    *chi.Mux
+	Addr      string
+	TLS       bool
+	CertFile  string
+	KeyFile   string
+	TLSConfig *tls.Config // TLS configuration, if TLS is enabled (optional)
+}
+
+func (srv *HTTPServer) Serve(cancelCtx context.Context, serverReady context.CancelFunc) error {
+	server := &http.Server{
+		Addr:         srv.Addr,
+		Handler:      srv.Router,
+		ReadTimeout:  h.ReadTimeout,
+		WriteTimeout: h.WriteTimeout,
+		IdleTimeout:  h.IdleTimeout,
+		TLSConfig:    srv.TLSConfig,
+	}
+	shutdownCtx, shutdownCancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-cancelCtx.Done()
+		server.SetKeepAlivesEnabled(false) // disallow clients to create new long-running conns
+
+		shutdownWithTimeoutCtx, cancel := context.WithTimeout(shutdownCtx, h.ShutdownTimeout)
+		defer cancel()
+		defer shutdownCancel()
+
+		if err := server.Shutdown(shutdownWithTimeoutCtx); err != nil {
+			log.Warnf("could not gracefully shut down server: %s", err)
+		} else {
+			log.Debug("shut down HTTP server")
+		}
+	}()
+
+	log.Infof("starting HTTP server")
+	serverReady()
+
+	var err error
+	if srv.TLS {
+		err = server.ListenAndServeTLS(srv.CertFile, srv.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("error starting HTTP server: %v", err)
+	}
+
+	// wait for server to shut down gracefully
+	<-shutdownCtx.Done()
+	return nil
+}
@@ -16,10 +16,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-client-go/main/adapters/handlers"
 	"github.com/ubirch/ubirch-client-go/main/auditlogger"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -28,6 +34,8 @@ type IdentityHandler struct {
 	protocol            *Protocol
 	subjectCountry      string
 	subjectOrganization string
+	defaultAlgorithm    string
+	registerAuth        string
 }
 
 type Identity struct {
@@ -38,6 +46,16 @@ type Identity struct {
 	PrivateKey []byte    `json:"privKey"`
 	PublicKey  []byte    `json:"pubKey"`
 	AuthToken  string    `json:"token"`
+	Algorithm  string    `json:"algorithm"` // signing algorithm [ES256, ES384, ES512, EdDSA]
+
+	// key rotation
+	NextPrivateKey []byte    `json:"-"` // new key pair, which becomes active once a certificate for its public key is available
+	NextPublicKey  []byte    `json:"-"`
+	PrevPrivateKey []byte    `json:"-"` // replaced key pair, which is kept inactive until the end of the grace period
+	PrevPublicKey  []byte    `json:"-"`
+	PrevKeyExpiry  time.Time `json:"-"` // end of the grace period for the replaced key pair
+
+	KeyVersion string `json:"-"` // identifies the secret, which was used for the encryption of the private keys
 }
 
 func (i *IdentityHandler) initIdentities(identities []*Identity) error {
@@ -60,7 +78,12 @@ func (i *IdentityHandler) initIdentities(identities []*Identity) error {
 			return fmt.Errorf("missing auth token for identity %s", id.Uid)
 		}
 
-		_, err = i.initIdentity(id.Uid, id.AuthToken)
+		algorithm := id.Algorithm
+		if algorithm == "" {
+			algorithm = i.defaultAlgorithm
+		}
+
+		_, err = i.initIdentity(id.Uid, id.AuthToken, algorithm)
 		if err != nil {
 			return err
 		}
@@ -69,16 +92,55 @@ func (i *IdentityHandler) initIdentities(identities []*Identity) error {
 	return nil
 }
 
-func (i *IdentityHandler) initIdentity(uid uuid.UUID, auth string) (csr []byte, err error) {
-	log.Infof("initializing new identity %s", uid)
+// register returns a handler for identity registration requests. The signing algorithm
+// for the new identity can be selected with the query parameter "algorithm",
+// otherwise the configured default algorithm is used.
+func (i *IdentityHandler) register(creator handlers.IdentityCreator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		algorithm := r.URL.Query().Get(AlgorithmParam)
+		if algorithm == "" {
+			algorithm = i.defaultAlgorithm
+		}
+
+		if _, err := lookupAlgorithm(algorithm); err != nil {
+			log.Warn(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		initIdentity := func(uid uuid.UUID, auth string) ([]byte, error) {
+			return i.initIdentity(uid, auth, algorithm)
+		}
+
+		creator.Put(initIdentity, i.protocol.Exists)(w, r)
+	}
+}
+
+func (i *IdentityHandler) initIdentity(uid uuid.UUID, auth string, algorithm string) (csr []byte, err error) {
+	log.Infof("initializing new identity %s (%s)", uid, algorithm)
+
+	alg, err := lookupAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
 
 	// generate a new new pair
-	privKeyPEM, err := i.protocol.GenerateKey()
+	privKeyPEM, err := alg.crypto.GenerateKey()
 	if err != nil {
 		return nil, fmt.Errorf("generating new key for UUID %s failed: %v", uid, err)
 	}
+	defer func() {
+		if err != nil {
+			destroyTokenKeys(alg.name, privKeyPEM) // the new key was not stored
+		}
+	}()
+
+	pubKeyPEM, err := alg.crypto.GetPublicKeyFromPrivateKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
 
-	pubKeyPEM, err := i.protocol.GetPublicKeyFromPrivateKey(privKeyPEM)
+	authTokenHash, err := hashAuthToken(auth)
 	if err != nil {
 		return nil, err
 	}
@@ -87,47 +149,358 @@ func (i *IdentityHandler) initIdentity(uid uuid.UUID, auth string) (csr []byte,
 		Uid:        uid,
 		PrivateKey: privKeyPEM,
 		PublicKey:  pubKeyPEM,
-		AuthToken:  auth,
+		AuthToken:  authTokenHash,
+		Algorithm:  alg.name,
+	}
+
+	// register public key at the ubirch backend before the identity is stored, so that no transaction
+	// is kept open during the request and no identity is stored, whose public key is not registered
+	csr, err = i.registerPublicKey(alg.crypto, privKeyPEM, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.storeNewIdentity(newIdentity)
+	if err != nil {
+		// the identity could not be stored, e.g. because it was created by a concurrent request,
+		// so the public key, which was registered above, is deleted again
+		deregErr := i.deregisterPublicKey(&newIdentity)
+		if deregErr != nil {
+			log.Errorf("%s: unable to delete public key after identity could not be stored: %v", uid, deregErr)
+		}
+		return nil, err
 	}
 
+	infos := fmt.Sprintf("\"hwDeviceId\":\"%s\", \"algorithm\":\"%s\"", uid, alg.name)
+	auditlogger.AuditLog("create", "device", infos)
+
+	return csr, nil
+}
+
+// storeNewIdentity stores the new identity within its own transaction
+func (i *IdentityHandler) storeNewIdentity(newIdentity Identity) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	tx, err := i.protocol.StartTransaction(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	err = i.protocol.StoreNewIdentity(tx, newIdentity)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	return i.protocol.CloseTransaction(tx, Commit)
+}
+
+// deregister returns a handler for requests to delete the identity with the UUID from the request URL.
+// The public key is deleted at the ubirch key service, before the identity is removed from the context.
+func (i *IdentityHandler) deregister() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := getUUID(r)
+		if err != nil {
+			log.Warn(err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if !equalAuthTokens(r.Header.Get(AuthHeader), i.registerAuth) {
+			Error(uid, w, fmt.Errorf("invalid auth token"), http.StatusUnauthorized)
+			return
+		}
+
+		identity, err := i.protocol.GetIdentity(uid)
+		if err == ErrNotExist {
+			Error(uid, w, fmt.Errorf("unknown UUID"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Errorf("%s: %v", uid, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		err = i.deregisterPublicKey(identity)
+		if err != nil {
+			log.Errorf("%s: %v", uid, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		err = i.deleteIdentity(uid)
+		if err != nil {
+			log.Errorf("%s: %v", uid, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		destroyTokenKeys(identity.Algorithm, identity.PrivateKey, identity.NextPrivateKey, identity.PrevPrivateKey)
+
+		log.Infof("%s: identity deleted", uid)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (i *IdentityHandler) deregisterPublicKey(identity *Identity) error {
+	alg, err := lookupAlgorithm(identity.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	keyDeletion, err := getSignedKeyDeletion(alg.crypto, identity.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("error creating key deletion request: %v", err)
+	}
+	log.Debugf("%s: key deletion: %s", identity.Uid, keyDeletion)
+
+	err = i.protocol.SubmitKeyDeletion(identity.Uid, keyDeletion)
+	if err == ErrNotExist {
+		log.Warnf("%s: public key was not registered at key service", identity.Uid)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("key deletion for UUID %s failed: %v", identity.Uid, err)
+	}
+
+	return nil
+}
+
+func (i *IdentityHandler) deleteIdentity(uid uuid.UUID) error {
+	err := i.protocol.removeIdentity(uid)
+	if err != nil {
+		return err
+	}
+
+	infos := fmt.Sprintf("\"hwDeviceId\":\"%s\"", uid)
+	auditlogger.AuditLog("delete", "device", infos)
+
+	return nil
+}
+
+// rotate returns a handler for key rotation requests for the identity with the UUID from the request URL.
+// A new key pair is generated and registered at the ubirch key service as the successor of the active key.
+// The active key is used for signing until a certificate for the new public key is available.
+func (i *IdentityHandler) rotate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := getUUID(r)
+		if err != nil {
+			log.Warn(err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if !equalAuthTokens(r.Header.Get(AuthHeader), i.registerAuth) {
+			Error(uid, w, fmt.Errorf("invalid auth token"), http.StatusUnauthorized)
+			return
+		}
+
+		identity, err := i.protocol.GetIdentity(uid)
+		if err == ErrNotExist {
+			Error(uid, w, fmt.Errorf("unknown UUID"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Errorf("%s: %v", uid, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if len(identity.NextPublicKey) != 0 {
+			Error(uid, w, fmt.Errorf("key rotation already pending"), http.StatusConflict)
+			return
+		}
+
+		csr, err := i.rotateKey(uid)
+		if err != nil {
+			log.Errorf("%s: %v", uid, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+
+		w.Header().Set("Content-Type", BinType)
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(csrPEM)
+		if err != nil {
+			log.Errorf("unable to write response: %s", err)
+		}
 	}
+}
+
+// rotateKey generates a new key pair for the identity with the given UUID and registers it as
+// the successor of the active key pair. The new key pair is stored as pending until a certificate
+// for the new public key appears in the public key certificate list.
+// The pending key pair is committed before it is registered at the ubirch backend, so that no transaction
+// is kept open during the request. If the registration fails, the pending key pair is discarded again.
+func (i *IdentityHandler) rotateKey(uid uuid.UUID) (csr []byte, err error) {
+	log.Infof("%s: rotating key", uid)
+
+	var algorithm string
+	var c ubirch.Crypto
+	var privKey, nextPrivKey, nextPubKey []byte
+
+	err = i.protocol.updateKeys(uid, func(id *Identity) error {
+		if len(id.NextPublicKey) != 0 {
+			return fmt.Errorf("key rotation already pending")
+		}
+
+		alg, err := lookupAlgorithm(id.Algorithm)
+		if err != nil {
+			return err
+		}
 
-	// register public key at the ubirch backend
-	csr, err = i.registerPublicKey(privKeyPEM, uid)
+		// generate a new key pair
+		id.NextPrivateKey, err = alg.crypto.GenerateKey()
+		if err != nil {
+			return fmt.Errorf("generating new key for UUID %s failed: %v", uid, err)
+		}
+		algorithm, nextPrivKey = alg.name, id.NextPrivateKey
+
+		id.NextPublicKey, err = alg.crypto.GetPublicKeyFromPrivateKey(id.NextPrivateKey)
+		if err != nil {
+			return err
+		}
+
+		c, privKey, nextPubKey = alg.crypto, id.PrivateKey, id.NextPublicKey
+		return nil
+	})
 	if err != nil {
+		destroyTokenKeys(algorithm, nextPrivKey) // the new key was not stored
 		return nil, err
 	}
 
-	err = i.protocol.CloseTransaction(tx, Commit)
+	i.protocol.identityCache.Delete(uid)
+
+	// register new public key as successor of the active public key at the ubirch backend
+	csr, err = i.registerKeyUpdate(c, privKey, nextPrivKey, uid)
 	if err != nil {
+		discardErr := i.protocol.discardNextKey(uid, nextPubKey)
+		if discardErr != nil {
+			log.Errorf("%s: unable to discard pending key after failed key update: %v", uid, discardErr)
+		}
 		return nil, err
 	}
 
 	infos := fmt.Sprintf("\"hwDeviceId\":\"%s\"", uid)
-	auditlogger.AuditLog("create", "device", infos)
+	auditlogger.AuditLog("rotate", "key", infos)
+
+	return csr, nil
+}
+
+// tokenUpdate is the payload of an auth token update request
+type tokenUpdate struct {
+	AuthToken string `json:"token"`
+}
+
+// updateToken returns a handler for requests to replace the auth token of the identity with the UUID from the
+// request URL. The request is authorized either with the current auth token of the identity or with registerAuth.
+func (i *IdentityHandler) updateToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := getUUID(r)
+		if err != nil {
+			log.Warn(err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		identity, err := i.protocol.GetIdentity(uid)
+		if err == ErrNotExist {
+			Error(uid, w, fmt.Errorf("unknown UUID"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Errorf("%s: %v", uid, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		authorizedBy, ok := i.authorizeTokenUpdate(r, identity)
+		if !ok {
+			Error(uid, w, fmt.Errorf("invalid auth token"), http.StatusUnauthorized)
+			return
+		}
+
+		if ContentType(r.Header) != JSONType {
+			Error(uid, w, fmt.Errorf("invalid content-type: expected \"%s\"", JSONType), http.StatusBadRequest)
+			return
+		}
+
+		update := &tokenUpdate{}
+		err = json.NewDecoder(r.Body).Decode(update)
+		if err != nil {
+			Error(uid, w, fmt.Errorf("unable to parse request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(update.AuthToken) == 0 {
+			Error(uid, w, fmt.Errorf("empty auth token"), http.StatusBadRequest)
+			return
+		}
+
+		err = i.protocol.updateAuthToken(uid, update.AuthToken)
+		if err != nil {
+			log.Errorf("%s: %v", uid, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		infos := fmt.Sprintf("\"hwDeviceId\":\"%s\", \"authorizedBy\":\"%s\"", uid, authorizedBy)
+		auditlogger.AuditLog("update", "token", infos)
+
+		log.Infof("%s: auth token updated", uid)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// authorizeTokenUpdate checks if the request is authorized with registerAuth or with the current auth token
+// of the identity and returns which of them authorized the request
+func (i *IdentityHandler) authorizeTokenUpdate(r *http.Request, identity *Identity) (authorizedBy string, ok bool) {
+	authToken := r.Header.Get(AuthHeader)
+
+	if equalAuthTokens(authToken, i.registerAuth) {
+		return "registerAuth", true
+	}
+
+	ok, err := i.protocol.checkAuthToken(identity, authToken)
+	if err != nil {
+		log.Errorf("%s: unable to check auth token: %v", identity.Uid, err)
+	}
+	return "device", ok
+}
+
+func (i *IdentityHandler) registerKeyUpdate(c ubirch.Crypto, prevPrivKeyPEM, privKeyPEM []byte, uid uuid.UUID) (csr []byte, err error) {
+	keyUpdate, err := getSignedKeyUpdate(c, prevPrivKeyPEM, privKeyPEM, uid)
+	if err != nil {
+		return nil, fmt.Errorf("error creating key update: %v", err)
+	}
+	log.Debugf("%s: key update: %s", uid, keyUpdate)
+
+	csr, err = c.GetCSR(privKeyPEM, uid, i.subjectCountry, i.subjectOrganization)
+	if err != nil {
+		return nil, fmt.Errorf("creating CSR for UUID %s failed: %v", uid, err)
+	}
+	log.Debugf("%s: CSR [der]: %x", uid, csr)
+
+	err = i.protocol.SubmitKeyUpdate(uid, keyUpdate)
+	if err != nil {
+		return nil, fmt.Errorf("key update for UUID %s failed: %v", uid, err)
+	}
+
+	go i.submitCSROrLogError(uid, csr)
 
 	return csr, nil
 }
 
-func (i *IdentityHandler) registerPublicKey(privKeyPEM []byte, uid uuid.UUID) (csr []byte, err error) {
-	keyRegistration, err := i.protocol.GetSignedKeyRegistration(privKeyPEM, uid)
+func (i *IdentityHandler) registerPublicKey(c ubirch.Crypto, privKeyPEM []byte, uid uuid.UUID) (csr []byte, err error) {
+	keyRegistration, err := c.GetSignedKeyRegistration(privKeyPEM, uid)
 	if err != nil {
 		return nil, fmt.Errorf("error creating public key certificate: %v", err)
 	}
 	log.Debugf("%s: key certificate: %s", uid, keyRegistration)
 
-	csr, err = i.protocol.GetCSR(privKeyPEM, uid, i.subjectCountry, i.subjectOrganization)
+	csr, err = c.GetCSR(privKeyPEM, uid, i.subjectCountry, i.subjectOrganization)
 	if err != nil {
 		return nil, fmt.Errorf("creating CSR for UUID %s failed: %v", uid, err)
 	}
@@ -0,0 +1,689 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-client-go/main/adapters/encrypters"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+const testRegisterAuth = "registerAuth1234"
+
+func TestDeregister(t *testing.T) {
+	var keyDeletion *KeyDeletion
+
+	// stand-in for the ubirch key service
+	keyService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		keyDeletion = &KeyDeletion{}
+		err := json.NewDecoder(r.Body).Decode(keyDeletion)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer keyService.Close()
+
+	idHandler, router := setupIdentityHandler(t, keyService.URL)
+
+	id, err := idHandler.protocol.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeyPEM := id.PublicKey
+
+	// deregistration without registerAuth must fail
+	resp := sendDeregisterRequest(router, uid, "password1234")
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("deregistration with invalid auth token: unexpected response status code: %d", resp.Code)
+	}
+
+	resp = sendDeregisterRequest(router, uid, testRegisterAuth)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("deregistration failed: %d, %s", resp.Code, resp.Body.String())
+	}
+
+	// check key deletion request
+	if keyDeletion == nil {
+		t.Fatal("no key deletion request was sent to key service")
+	}
+
+	pubKeyBytes, err := idHandler.protocol.PublicKeyPEMToBytes(pubKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keyDeletion.PublicKey != base64.StdEncoding.EncodeToString(pubKeyBytes) {
+		t.Errorf("unexpected public key in key deletion request: %s", keyDeletion.PublicKey)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(keyDeletion.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := idHandler.protocol.Verify(pubKeyPEM, []byte(keyDeletion.PublicKey), signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("invalid signature of key deletion request")
+	}
+
+	// check identity was removed
+	exists, err := idHandler.protocol.Exists(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("identity still exists after deregistration")
+	}
+
+	_, err = idHandler.protocol.GetSKID(uid)
+	if err == nil {
+		t.Error("SKID still exists after deregistration")
+	}
+
+	resp = sendDeregisterRequest(router, uid, testRegisterAuth)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("deregistration of unknown identity: unexpected response status code: %d", resp.Code)
+	}
+}
+
+func TestDeregisterKeyServiceFailure(t *testing.T) {
+	keyService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer keyService.Close()
+
+	idHandler, router := setupIdentityHandler(t, keyService.URL)
+
+	resp := sendDeregisterRequest(router, uid, testRegisterAuth)
+	if resp.Code != http.StatusBadGateway {
+		t.Errorf("unexpected response status code: %d", resp.Code)
+	}
+
+	// identity must not be removed, if the public key could not be deleted at the key service
+	exists, err := idHandler.protocol.Exists(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Error("identity was removed although key deletion failed")
+	}
+}
+
+func TestInitIdentity_AuthTokenHash(t *testing.T) {
+	keyService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer keyService.Close()
+
+	idHandler, _ := setupIdentityHandler(t, keyService.URL)
+	idHandler.protocol.IdentityServiceURL = keyService.URL
+
+	// an auth token, which looks like a hash, is hashed like any other auth token
+	authToken := "$argon2id$v=19$m=19456,t=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2hoYXNoaGFzaA"
+	newUid := uuid.New()
+
+	_, err := idHandler.initIdentity(newUid, authToken, ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := idHandler.protocol.GetIdentity(newUid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.AuthToken == authToken {
+		t.Fatal("auth token was stored without hashing")
+	}
+
+	ok, err := idHandler.protocol.checkAuthToken(id, authToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("auth token was not accepted after registration")
+	}
+}
+
+func TestInitIdentity_KeyServiceFailure(t *testing.T) {
+	var idHandler *IdentityHandler
+	var txAvailable bool
+
+	keyService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// no transaction is kept open during the key registration
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		tx, err := idHandler.protocol.StartTransaction(ctx)
+		if err == nil {
+			txAvailable = true
+			_ = idHandler.protocol.CloseTransaction(tx, Rollback)
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer keyService.Close()
+
+	idHandler, _ = setupIdentityHandler(t, keyService.URL)
+	newUid := uuid.New()
+
+	_, err := idHandler.initIdentity(newUid, "password1234", ES256)
+	if err == nil {
+		t.Fatal("initIdentity did not return an error, although the key registration failed")
+	}
+	if !txAvailable {
+		t.Error("transaction was kept open during the key registration")
+	}
+
+	// the identity must not be stored, if its public key could not be registered
+	exists, err := idHandler.protocol.Exists(newUid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("identity was stored after failed key registration")
+	}
+}
+
+func TestInitIdentity_StoreFailure(t *testing.T) {
+	var methods []string
+
+	keyService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer keyService.Close()
+
+	idHandler, _ := setupIdentityHandler(t, keyService.URL)
+
+	storedIdentity, err := idHandler.protocol.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the identity exists already, e.g. because it was created by a concurrent request
+	_, err = idHandler.initIdentity(uid, "password1234", ES256)
+	if err != ErrExists {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the public key is registered first and deleted again, since the identity could not be stored
+	if len(methods) != 2 || methods[0] != http.MethodPost || methods[1] != http.MethodDelete {
+		t.Errorf("unexpected key service requests: %v", methods)
+	}
+
+	identity, err := idHandler.protocol.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(identity.PublicKey, storedIdentity.PublicKey) {
+		t.Error("existing identity was replaced")
+	}
+}
+
+func TestRotateKeyKeyServiceFailure(t *testing.T) {
+	var idHandler *IdentityHandler
+	var pendingKeyCommitted bool
+
+	keyService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the pending key is committed before the key update is sent, so that no transaction is open meanwhile
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		tx, err := idHandler.protocol.StartTransaction(ctx)
+		if err == nil {
+			id, err := idHandler.protocol.GetIdentityForUpdate(tx, uid)
+			pendingKeyCommitted = err == nil && len(id.NextPublicKey) != 0
+			_ = idHandler.protocol.CloseTransaction(tx, Rollback)
+		}
+
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer keyService.Close()
+
+	idHandler, router := setupIdentityHandler(t, keyService.URL)
+
+	resp := sendRotateRequest(router, uid, testRegisterAuth)
+	if resp.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected response status code: %d", resp.Code)
+	}
+	if !pendingKeyCommitted {
+		t.Error("pending key was not committed before the key update was sent")
+	}
+
+	// the pending key must be discarded, if the key update failed, so that the key rotation can be retried
+	id, err := idHandler.protocol.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id.NextPublicKey) != 0 {
+		t.Error("pending key was not discarded after failed key update")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	var keyUpdate *SignedKeyUpdate
+
+	// stand-in for the ubirch key service
+	keyService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/update" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		keyUpdate = &SignedKeyUpdate{}
+		err := json.NewDecoder(r.Body).Decode(keyUpdate)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer keyService.Close()
+
+	idHandler, router := setupIdentityHandler(t, keyService.URL)
+	p := idHandler.protocol
+	p.keyRotationGracePeriod = time.Hour
+
+	id, err := p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevPubKeyPEM := id.PublicKey
+
+	resp := sendRotateRequest(router, uid, "password1234")
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("key rotation with invalid auth token: unexpected response status code: %d", resp.Code)
+	}
+
+	resp = sendRotateRequest(router, uid, testRegisterAuth)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("key rotation failed: %d, %s", resp.Code, resp.Body.String())
+	}
+
+	// the active key must not change before a certificate for the new key is available
+	id, err = p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id.PublicKey, prevPubKeyPEM) {
+		t.Error("active key was replaced before certificate for new key was available")
+	}
+	if len(id.NextPublicKey) == 0 {
+		t.Fatal("new key was not stored")
+	}
+	nextPubKeyPEM := id.NextPublicKey
+
+	// check CSR
+	block, _ := pem.Decode(resp.Body.Bytes())
+	if block == nil {
+		t.Fatalf("unable to decode CSR: %s", resp.Body.String())
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPubKeyPEM, err := encodePKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePublicKey(csrPubKeyPEM, nextPubKeyPEM) {
+		t.Error("CSR does not contain the new public key")
+	}
+
+	// check key update request
+	if keyUpdate == nil {
+		t.Fatal("no key update request was sent to key service")
+	}
+	checkSignedKeyUpdate(t, p.Crypto, prevPubKeyPEM, nextPubKeyPEM, keyUpdate)
+
+	resp = sendRotateRequest(router, uid, testRegisterAuth)
+	if resp.Code != http.StatusConflict {
+		t.Errorf("key rotation while rotation is pending: unexpected response status code: %d", resp.Code)
+	}
+
+	// certificate for the new key appears in the public key certificate list
+	nextSkid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	err = p.activateNextKey(uid, nextPubKeyPEM, nextSkid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err = p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id.PublicKey, nextPubKeyPEM) {
+		t.Error("new key was not activated")
+	}
+	if !bytes.Equal(id.PrevPublicKey, prevPubKeyPEM) {
+		t.Error("replaced key was not kept")
+	}
+	if len(id.NextPublicKey) != 0 {
+		t.Error("pending key was not cleared")
+	}
+	if !id.PrevKeyExpiry.After(time.Now()) {
+		t.Errorf("unexpected end of grace period: %s", id.PrevKeyExpiry)
+	}
+
+	activeSkid, err := p.GetSKID(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(activeSkid, nextSkid) {
+		t.Errorf("unexpected SKID after key rotation: %x", activeSkid)
+	}
+
+	prevSkidUid, err := p.GetUuidForSKID(skid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prevSkidUid != uid {
+		t.Errorf("SKID of replaced key resolved to unexpected UUID: %s", prevSkidUid)
+	}
+
+	// the replaced key can not be discarded within the grace period
+	err = p.discardPrevKey(uid)
+	if err == nil {
+		t.Error("replaced key was discarded within grace period")
+	}
+}
+
+func TestDiscardExpiredPrevKeys(t *testing.T) {
+	idHandler, _ := setupIdentityHandler(t, "")
+	p := idHandler.protocol
+
+	prevPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevPubKeyPEM, err := p.GetPublicKeyFromPrivateKey(prevPrivKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the grace period is over, but no public key certificate list was loaded
+	err = p.updateKeys(uid, func(id *Identity) error {
+		id.PrevPrivateKey, id.PrevPublicKey = prevPrivKeyPEM, prevPubKeyPEM
+		id.PrevKeyExpiry = time.Now().Add(-time.Minute)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.identityCache.Delete(uid)
+
+	// the replaced key is kept within the grace period
+	p.discardExpiredPrevKeys(time.Now().Add(-time.Hour))
+
+	id, err := p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id.PrevPublicKey) == 0 {
+		t.Fatal("replaced key was discarded within grace period")
+	}
+
+	p.discardExpiredPrevKeys(time.Now())
+
+	id, err = p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id.PrevPublicKey) != 0 || len(id.PrevPrivateKey) != 0 || !id.PrevKeyExpiry.IsZero() {
+		t.Error("replaced key was not discarded after grace period")
+	}
+}
+
+func TestUpdateToken(t *testing.T) {
+	idHandler, router := setupIdentityHandler(t, "")
+	p := idHandler.protocol
+
+	// load the identity into the cache
+	checkProtocolAuthToken(t, p, Identity{Uid: uid}, "password1234", true)
+
+	testCases := []struct {
+		name       string
+		auth       string
+		body       string
+		statusCode int
+		authToken  string // valid auth token after the request
+	}{
+		{
+			name:       "invalid auth token",
+			auth:       "wrong-password",
+			body:       `{"token":"new-password"}`,
+			statusCode: http.StatusUnauthorized,
+			authToken:  "password1234",
+		},
+		{
+			name:       "empty new auth token",
+			auth:       "password1234",
+			body:       `{"token":""}`,
+			statusCode: http.StatusBadRequest,
+			authToken:  "password1234",
+		},
+		{
+			name:       "invalid body",
+			auth:       "password1234",
+			body:       `new-password`,
+			statusCode: http.StatusBadRequest,
+			authToken:  "password1234",
+		},
+		{
+			name:       "authorized by current auth token",
+			auth:       "password1234",
+			body:       `{"token":"password5678"}`,
+			statusCode: http.StatusOK,
+			authToken:  "password5678",
+		},
+		{
+			name:       "old auth token is invalid",
+			auth:       "password1234",
+			body:       `{"token":"password9012"}`,
+			statusCode: http.StatusUnauthorized,
+			authToken:  "password5678",
+		},
+		{
+			name:       "authorized by registerAuth",
+			auth:       testRegisterAuth,
+			body:       `{"token":"password9012"}`,
+			statusCode: http.StatusOK,
+			authToken:  "password9012",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			resp := sendUpdateTokenRequest(router, uid, c.auth, c.body)
+			if resp.Code != c.statusCode {
+				t.Errorf("unexpected response status code: %d, expected: %d, %s", resp.Code, c.statusCode, resp.Body.String())
+			}
+
+			checkProtocolAuthToken(t, p, Identity{Uid: uid}, c.authToken, true)
+
+			storedId, err := p.ctxManager.GetIdentity(uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := verifyAuthToken(storedId.AuthToken, c.authToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Error("unexpected stored auth token")
+			}
+		})
+	}
+
+	resp := sendUpdateTokenRequest(router, uuid.New(), testRegisterAuth, `{"token":"password1234"}`)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("auth token update for unknown UUID: unexpected response status code: %d", resp.Code)
+	}
+}
+
+func checkSignedKeyUpdate(t *testing.T, c ubirch.Crypto, prevPubKeyPEM, pubKeyPEM []byte, keyUpdate *SignedKeyUpdate) {
+	prevPubKeyBytes, err := c.PublicKeyPEMToBytes(prevPubKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyUpdate.PubKeyInfo.PrevPubKeyId != base64.StdEncoding.EncodeToString(prevPubKeyBytes) {
+		t.Errorf("unexpected previous public key ID in key update: %s", keyUpdate.PubKeyInfo.PrevPubKeyId)
+	}
+
+	pubKeyBytes, err := c.PublicKeyPEMToBytes(pubKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyUpdate.PubKeyInfo.PubKey != base64.StdEncoding.EncodeToString(pubKeyBytes) {
+		t.Errorf("unexpected public key in key update: %s", keyUpdate.PubKeyInfo.PubKey)
+	}
+
+	pubKeyInfo, err := json.Marshal(keyUpdate.PubKeyInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []struct {
+		pubKeyPEM []byte
+		signature string
+	}{
+		{pubKeyPEM, keyUpdate.Signature},
+		{prevPubKeyPEM, keyUpdate.PrevSignature},
+	} {
+		signature, err := base64.StdEncoding.DecodeString(s.signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok, err := c.Verify(s.pubKeyPEM, pubKeyInfo, signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Error("invalid key update signature")
+		}
+	}
+}
+
+func setupIdentityHandler(t *testing.T, keyServiceURL string) (*IdentityHandler, *chi.Mux) {
+	crypto := &ubirch.ECDSACryptoContext{}
+
+	enc, err := encrypters.NewKeyEncrypter(make([]byte, 32), crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &ExtendedClient{}
+	client.KeyServiceURL = keyServiceURL
+
+	p := &Protocol{
+		Crypto:         crypto,
+		ExtendedClient: client,
+		ctxManager:     NewMemoryContextManager(),
+		keyEncrypter:   enc,
+
+		identityCache: &sync.Map{},
+		uidCache:      &sync.Map{},
+		authCache:     &sync.Map{},
+
+		skidStore:      map[uuid.UUID][]byte{uid: skid},
+		prevSkidStore:  map[uuid.UUID][]byte{},
+		skidStoreMutex: &sync.RWMutex{},
+	}
+
+	privKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKeyPEM, err := p.GetPublicKeyFromPrivateKey(privKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeAndCommit(t, p, &Identity{
+		Uid:        uid,
+		PrivateKey: privKeyPEM,
+		PublicKey:  pubKeyPEM,
+		AuthToken:  hashTestAuthToken(t, "password1234"),
+	})
+
+	idHandler := &IdentityHandler{
+		protocol:     p,
+		registerAuth: testRegisterAuth,
+	}
+
+	router := chi.NewMux()
+	router.Delete(path.Join(RegisterEndpoint, UUIDPath), idHandler.deregister())
+	router.Post(path.Join(RegisterEndpoint, UUIDPath, RotateEndpoint), idHandler.rotate())
+	router.Put(path.Join(RegisterEndpoint, UUIDPath, TokenEndpoint), idHandler.updateToken())
+
+	return idHandler, router
+}
+
+func sendDeregisterRequest(router http.Handler, uid uuid.UUID, auth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, path.Join(RegisterEndpoint, uid.String()), nil)
+	req.Header.Set(AuthHeader, auth)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func sendRotateRequest(router http.Handler, uid uuid.UUID, auth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path.Join(RegisterEndpoint, uid.String(), RotateEndpoint), nil)
+	req.Header.Set(AuthHeader, auth)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+func sendUpdateTokenRequest(router http.Handler, uid uuid.UUID, auth, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, path.Join(RegisterEndpoint, uid.String(), TokenEndpoint), strings.NewReader(body))
+	req.Header.Set(AuthHeader, auth)
+	req.Header.Set("Content-Type", JSONType)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
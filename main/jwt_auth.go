@@ -0,0 +1,534 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BearerPrefix = "Bearer "
+
+	defaultJWTUUIDsClaim = "uuids"
+	jwtWildcard          = "*"
+	jwtTenantPrefix      = "tenant:"
+
+	jwtClockSkew          = 30 * time.Second // tolerance for the validation of the time claims
+	jwksRequestTimeout    = 10 * time.Second
+	jwksMinReloadInterval = time.Minute // keys are reloaded at most once per interval, if a token has an unknown key ID
+)
+
+// jwsCurves are the curves of the ECDSA signing algorithms
+var jwsCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// JWTVerifier validates JWT bearer tokens (RFC 7519) against the keys of a JSON Web Key Set (RFC 7517),
+// which is loaded from a file or a URL. A valid token authorizes signing requests for the UUIDs,
+// which are listed in the UUIDs claim of the token.
+type JWTVerifier struct {
+	jwksSource string // path to a JWKS file or URL of a JWKS endpoint
+	issuer     string
+	audience   string
+	uuidsClaim string // name of the claim, which lists the UUIDs the token may sign for
+	tenant     string // tenant of the client, tokens with the claim entry "tenant:<tenant>" may sign for all identities
+
+	keys         []*jsonWebKey
+	keysLoadedAt time.Time
+	keysMutex    *sync.RWMutex
+}
+
+// jsonWebKey is a public key of a JSON Web Key Set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	publicKey crypto.PublicKey
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// NewJWTVerifier creates a JWTVerifier and loads the JWKS from the given file path or URL.
+// A relative file path is relative to the config directory.
+func NewJWTVerifier(jwksSource, configDir, issuer, audience, uuidsClaim, tenant string) (*JWTVerifier, error) {
+	if issuer == "" {
+		return nil, fmt.Errorf("missing JWT issuer ('jwtIssuer')")
+	}
+	if audience == "" {
+		return nil, fmt.Errorf("missing JWT audience ('jwtAudience')")
+	}
+	if uuidsClaim == "" {
+		uuidsClaim = defaultJWTUUIDsClaim
+	}
+
+	if !isJWKSURL(jwksSource) && !filepath.IsAbs(jwksSource) {
+		jwksSource = filepath.Join(configDir, jwksSource)
+	}
+
+	v := &JWTVerifier{
+		jwksSource: jwksSource,
+		issuer:     issuer,
+		audience:   audience,
+		uuidsClaim: uuidsClaim,
+		tenant:     tenant,
+		keysMutex:  &sync.RWMutex{},
+	}
+
+	err := v.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// bearerToken returns the bearer token from the "Authorization" header of the request
+func bearerToken(r *http.Request) (token string, found bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(BearerPrefix) || !strings.EqualFold(auth[:len(BearerPrefix)], BearerPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(BearerPrefix):]), true
+}
+
+// Verify checks if the token is a valid JWT, which authorizes signing requests for the identity with the given UUID
+func (v *JWTVerifier) Verify(token string, uid uuid.UUID) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed token header: %v", err)
+	}
+
+	header := &jwtHeader{}
+	err = json.Unmarshal(headerBytes, header)
+	if err != nil {
+		return fmt.Errorf("malformed token header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	err = v.verifySignature(header, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return err
+	}
+
+	claimsBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed token claims: %v", err)
+	}
+
+	claims := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(claimsBytes))
+	decoder.UseNumber()
+	err = decoder.Decode(&claims)
+	if err != nil {
+		return fmt.Errorf("malformed token claims: %v", err)
+	}
+
+	err = v.checkRegisteredClaims(claims, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return v.checkUUIDsClaim(claims, uid)
+}
+
+func (v *JWTVerifier) verifySignature(header *jwtHeader, signingInput, signature []byte) error {
+	keys := v.lookupKeys(header.Kid)
+	if len(keys) == 0 && header.Kid != "" && v.reloadKeys() {
+		keys = v.lookupKeys(header.Kid)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("unknown key ID: %q", header.Kid)
+	}
+
+	for _, key := range keys {
+		if key.Alg != "" && key.Alg != header.Alg {
+			continue
+		}
+
+		ok, err := verifyJWS(header.Alg, key.publicKey, signingInput, signature)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid token signature")
+}
+
+// verifyJWS verifies the JWS signature (RFC 7518) of the signing input with the public key
+func verifyJWS(alg string, publicKey crypto.PublicKey, signingInput, signature []byte) (bool, error) {
+	var hash crypto.Hash
+
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		pub, ok := publicKey.(ed25519.PublicKey)
+		if !ok {
+			return false, nil
+		}
+		return ed25519.Verify(pub, signingInput, signature), nil
+	default:
+		return false, fmt.Errorf("unsupported token signing algorithm: %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil, nil
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil, nil
+		}
+	case *ecdsa.PublicKey:
+		if pub.Curve != jwsCurves[alg] {
+			return false, nil
+		}
+
+		l := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*l {
+			return false, nil
+		}
+
+		r := new(big.Int).SetBytes(signature[:l])
+		s := new(big.Int).SetBytes(signature[l:])
+
+		return ecdsa.Verify(pub, digest, r, s), nil
+	}
+
+	return false, nil
+}
+
+// checkRegisteredClaims checks the issuer, audience, expiration time and not before claims
+func (v *JWTVerifier) checkRegisteredClaims(claims map[string]interface{}, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return fmt.Errorf("unexpected token issuer: %q", iss)
+	}
+
+	if !containsString(stringValues(claims["aud"]), v.audience) {
+		return fmt.Errorf("token audience does not contain %q", v.audience)
+	}
+
+	exp, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if exp.IsZero() {
+		return fmt.Errorf("missing token expiration time")
+	}
+	if now.After(exp.Add(jwtClockSkew)) {
+		return fmt.Errorf("token expired")
+	}
+
+	nbf, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if now.Add(jwtClockSkew).Before(nbf) {
+		return fmt.Errorf("token not valid yet")
+	}
+
+	return nil
+}
+
+// checkUUIDsClaim checks if the UUIDs claim of the token contains the UUID, the wildcard or the tenant of the client
+func (v *JWTVerifier) checkUUIDsClaim(claims map[string]interface{}, uid uuid.UUID) error {
+	for _, entry := range stringValues(claims[v.uuidsClaim]) {
+		if entry == jwtWildcard || (v.tenant != "" && entry == jwtTenantPrefix+v.tenant) {
+			return nil
+		}
+
+		claimUid, err := uuid.Parse(entry)
+		if err == nil && claimUid == uid {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("token does not authorize signing for UUID %s", uid)
+}
+
+func (v *JWTVerifier) lookupKeys(kid string) []*jsonWebKey {
+	v.keysMutex.RLock()
+	defer v.keysMutex.RUnlock()
+
+	if kid == "" {
+		return v.keys
+	}
+
+	var keys []*jsonWebKey
+	for _, key := range v.keys {
+		if key.Kid == kid {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// reloadKeys reloads the JWKS, unless it was loaded recently, and returns true if the keys were reloaded
+func (v *JWTVerifier) reloadKeys() bool {
+	v.keysMutex.RLock()
+	loadedAt := v.keysLoadedAt
+	v.keysMutex.RUnlock()
+
+	if time.Since(loadedAt) < jwksMinReloadInterval {
+		return false
+	}
+
+	err := v.loadKeys()
+	if err != nil {
+		log.Errorf("unable to reload JWKS: %v", err)
+		return false
+	}
+	return true
+}
+
+func (v *JWTVerifier) loadKeys() error {
+	v.keysMutex.Lock()
+	defer v.keysMutex.Unlock()
+
+	// also delay the next attempt, if loading fails
+	v.keysLoadedAt = time.Now()
+
+	jwksBytes, err := v.readJWKS()
+	if err != nil {
+		return fmt.Errorf("unable to load JWKS from %s: %v", v.jwksSource, err)
+	}
+
+	keys, err := parseJWKS(jwksBytes)
+	if err != nil {
+		return fmt.Errorf("unable to load JWKS from %s: %v", v.jwksSource, err)
+	}
+
+	v.keys = keys
+
+	log.Infof("loaded %d keys for JWT verification from %s", len(keys), v.jwksSource)
+	return nil
+}
+
+func (v *JWTVerifier) readJWKS() ([]byte, error) {
+	if !isJWKSURL(v.jwksSource) {
+		return ioutil.ReadFile(v.jwksSource)
+	}
+
+	client := &http.Client{Timeout: jwksRequestTimeout}
+
+	resp, err := client.Get(v.jwksSource)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("(%d) %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parseJWKS returns the signature verification keys of the JWKS. Keys with unsupported types are ignored.
+func parseJWKS(jwksBytes []byte) ([]*jsonWebKey, error) {
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+
+	err := json.Unmarshal(jwksBytes, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*jsonWebKey
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+
+		key.publicKey, err = key.decodePublicKey()
+		if err != nil {
+			log.Warnf("ignoring JWKS key %q: %v", key.Kid, err)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signature verification keys")
+	}
+
+	return keys, nil
+}
+
+func (k *jsonWebKey) decodePublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := decodeBase64URLInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %q", k.Crv)
+		}
+		x, err := decodeBase64URLInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %v", err)
+		}
+		y, err := decodeBase64URLInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %q", k.Kty)
+	}
+}
+
+func isJWKSURL(jwksSource string) bool {
+	return strings.HasPrefix(jwksSource, "https://") || strings.HasPrefix(jwksSource, "http://")
+}
+
+func decodeBase64URLInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// numericDate returns the time of the NumericDate claim with the given name, or the zero time, if the claim is not set
+func numericDate(claims map[string]interface{}, name string) (time.Time, error) {
+	value, found := claims[name]
+	if !found {
+		return time.Time{}, nil
+	}
+
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid token claim %q", name)
+	}
+
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid token claim %q: %v", name, err)
+	}
+
+	return time.Unix(int64(seconds), 0), nil
+}
+
+// stringValues returns the values of a claim, which is either a string or an array of strings
+func stringValues(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	testJWTIssuer   = "https://id.example.com"
+	testJWTAudience = "cose-client"
+	testJWTTenant   = "test-tenant"
+)
+
+// testJWTKey is a key pair for the signing of test JWTs
+type testJWTKey struct {
+	kid  string
+	alg  string
+	priv crypto.Signer
+}
+
+func newTestJWTKeys(t *testing.T) []*testJWTKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []*testJWTKey{
+		{kid: "rsa", alg: "RS256", priv: rsaKey},
+		{kid: "rsa-pss", alg: "PS384", priv: rsaKey},
+		{kid: "ec", alg: "ES256", priv: ecKey},
+		{kid: "ed", alg: "EdDSA", priv: edKey},
+	}
+}
+
+func (k *testJWTKey) jwk() map[string]string {
+	enc := base64.RawURLEncoding
+
+	switch pub := k.priv.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": k.kid, "alg": k.alg, "use": "sig",
+			"n": enc.EncodeToString(pub.N.Bytes()), "e": enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": k.kid, "crv": "P-256",
+			"x": enc.EncodeToString(pub.X.FillBytes(make([]byte, 32))), "y": enc.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": k.kid, "crv": "Ed25519", "x": enc.EncodeToString(pub)}
+	default:
+		return nil
+	}
+}
+
+func (k *testJWTKey) sign(t *testing.T, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": k.alg, "kid": k.kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+
+	switch k.alg {
+	case "RS256":
+		digest := crypto.SHA256.New()
+		digest.Write([]byte(signingInput))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.priv.(*rsa.PrivateKey), crypto.SHA256, digest.Sum(nil))
+	case "PS384":
+		digest := crypto.SHA384.New()
+		digest.Write([]byte(signingInput))
+		signature, err = rsa.SignPSS(rand.Reader, k.priv.(*rsa.PrivateKey), crypto.SHA384, digest.Sum(nil),
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		digest := crypto.SHA256.New()
+		digest.Write([]byte(signingInput))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.priv.(*ecdsa.PrivateKey), digest.Sum(nil))
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(k.priv.(ed25519.PrivateKey), []byte(signingInput))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTestJWKS(t *testing.T, path string, keys []*testJWTKey) {
+	err := ioutil.WriteFile(path, marshalTestJWKS(t, keys), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func marshalTestJWKS(t *testing.T, keys []*testJWTKey) []byte {
+	var jwks []map[string]string
+	for _, k := range keys {
+		jwks = append(jwks, k.jwk())
+	}
+
+	jwksBytes, err := json.Marshal(map[string]interface{}{"keys": jwks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwksBytes
+}
+
+func newTestJWTVerifier(t *testing.T, keys []*testJWTKey) *JWTVerifier {
+	dir := t.TempDir()
+	writeTestJWKS(t, filepath.Join(dir, "jwks.json"), keys)
+
+	v, err := NewJWTVerifier("jwks.json", dir, testJWTIssuer, testJWTAudience, "", testJWTTenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func testJWTClaims(uuids interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   testJWTIssuer,
+		"aud":   []string{"other", testJWTAudience},
+		"sub":   "device-manager",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"uuids": uuids,
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	v := newTestJWTVerifier(t, keys)
+
+	for _, k := range keys {
+		t.Run(k.alg, func(t *testing.T) {
+			err := v.Verify(k.sign(t, testJWTClaims([]string{uuid.NewString(), uid.String()})), uid)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestJWTVerifier_UUIDsClaim(t *testing.T) {
+	key := newTestJWTKeys(t)[2]
+	v := newTestJWTVerifier(t, []*testJWTKey{key})
+
+	testCases := []struct {
+		name  string
+		uuids interface{}
+		valid bool
+	}{
+		{name: "single UUID", uuids: uid.String(), valid: true},
+		{name: "list of UUIDs", uuids: []string{uuid.NewString(), uid.String()}, valid: true},
+		{name: "wildcard", uuids: []string{jwtWildcard}, valid: true},
+		{name: "tenant", uuids: []string{jwtTenantPrefix + testJWTTenant}, valid: true},
+		{name: "other UUID", uuids: []string{uuid.NewString()}, valid: false},
+		{name: "other tenant", uuids: []string{jwtTenantPrefix + "other-tenant"}, valid: false},
+		{name: "missing claim", uuids: nil, valid: false},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			claims := testJWTClaims(c.uuids)
+			if c.uuids == nil {
+				delete(claims, "uuids")
+			}
+
+			err := v.Verify(key.sign(t, claims), uid)
+			if c.valid && err != nil {
+				t.Error(err)
+			}
+			if !c.valid && err == nil {
+				t.Error("invalid token was accepted")
+			}
+		})
+	}
+}
+
+func TestJWTVerifier_InvalidTokens(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	key := keys[2]
+	v := newTestJWTVerifier(t, keys)
+
+	unknownKey := newTestJWTKeys(t)[2]
+	unknownKey.kid = "unknown"
+
+	validToken := key.sign(t, testJWTClaims(uid.String()))
+
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{name: "wrong issuer", token: key.sign(t, withClaim(testJWTClaims(uid.String()), "iss", "https://evil.example.com"))},
+		{name: "wrong audience", token: key.sign(t, withClaim(testJWTClaims(uid.String()), "aud", "other"))},
+		{name: "expired", token: key.sign(t, withClaim(testJWTClaims(uid.String()), "exp", time.Now().Add(-time.Hour).Unix()))},
+		{name: "missing expiry", token: key.sign(t, withClaim(testJWTClaims(uid.String()), "exp", nil))},
+		{name: "not valid yet", token: key.sign(t, withClaim(testJWTClaims(uid.String()), "nbf", time.Now().Add(time.Hour).Unix()))},
+		{name: "unknown key", token: unknownKey.sign(t, testJWTClaims(uid.String()))},
+		{name: "wrong key", token: (&testJWTKey{kid: key.kid, alg: key.alg, priv: unknownKey.priv}).sign(t, testJWTClaims(uid.String()))},
+		{name: "algorithm not matching key", token: (&testJWTKey{kid: "rsa", alg: "ES256", priv: key.priv}).sign(t, testJWTClaims(uid.String()))},
+		{name: "unsigned", token: validToken[:len(validToken)-86] + "."},
+		{name: "alg none", token: base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+testJWTIssuer+`","aud":"`+testJWTAudience+`","uuids":"*"}`)) + "."},
+		{name: "malformed", token: "not a token"},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			err := v.Verify(c.token, uid)
+			if err == nil {
+				t.Error("invalid token was accepted")
+			}
+		})
+	}
+}
+
+func TestJWTVerifier_JWKSURL(t *testing.T) {
+	keys := newTestJWTKeys(t)
+
+	jwks := marshalTestJWKS(t, keys[:1])
+	jwksMutex := &sync.Mutex{}
+
+	// stand-in for the JWKS endpoint of the identity provider
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwksMutex.Lock()
+		defer jwksMutex.Unlock()
+
+		w.Header().Set("Content-Type", JSONType)
+		_, _ = w.Write(jwks)
+	}))
+	defer jwksServer.Close()
+
+	v, err := NewJWTVerifier(jwksServer.URL, "", testJWTIssuer, testJWTAudience, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = v.Verify(keys[0].sign(t, testJWTClaims(uid.String())), uid)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the identity provider adds a new key
+	jwksMutex.Lock()
+	jwks = marshalTestJWKS(t, keys)
+	jwksMutex.Unlock()
+
+	err = v.Verify(keys[2].sign(t, testJWTClaims(uid.String())), uid)
+	if err == nil {
+		t.Error("token with new key was accepted before keys were reloaded")
+	}
+
+	v.keysLoadedAt = v.keysLoadedAt.Add(-jwksMinReloadInterval)
+
+	err = v.Verify(keys[2].sign(t, testJWTClaims(uid.String())), uid)
+	if err != nil {
+		t.Errorf("token with new key was not accepted after keys were reloaded: %v", err)
+	}
+}
+
+func TestNewJWTVerifier_Errors(t *testing.T) {
+	dir := t.TempDir()
+	writeTestJWKS(t, filepath.Join(dir, "jwks.json"), newTestJWTKeys(t))
+
+	_, err := NewJWTVerifier("jwks.json", dir, "", testJWTAudience, "", "")
+	if err == nil {
+		t.Error("missing issuer was accepted")
+	}
+
+	_, err = NewJWTVerifier("jwks.json", dir, testJWTIssuer, "", "", "")
+	if err == nil {
+		t.Error("missing audience was accepted")
+	}
+
+	_, err = NewJWTVerifier("missing.json", dir, testJWTIssuer, testJWTAudience, "", "")
+	if err == nil {
+		t.Error("missing JWKS file was accepted")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "empty.json"), []byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewJWTVerifier("empty.json", dir, testJWTIssuer, testJWTAudience, "", "")
+	if err == nil {
+		t.Error("JWKS without signature verification keys was accepted")
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	key := newTestJWTKeys(t)[2]
+
+	coseSigner, _ := setupCoseVerifier(t)
+
+	service := &COSEService{
+		CoseSigner:  coseSigner,
+		jwtVerifier: newTestJWTVerifier(t, []*testJWTKey{key}),
+	}
+
+	testCases := []struct {
+		name       string
+		header     http.Header
+		statusCode int
+	}{
+		{
+			name:       "bearer token",
+			header:     http.Header{"Authorization": {"Bearer " + key.sign(t, testJWTClaims(uid.String()))}},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "bearer token for other UUID",
+			header:     http.Header{"Authorization": {"Bearer " + key.sign(t, testJWTClaims(uuid.NewString()))}},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "auth token",
+			header:     http.Header{AuthHeader: {"password1234"}},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "invalid auth token",
+			header:     http.Header{AuthHeader: {"password"}},
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/"+uid.String()+CBORPath, nil)
+			r.Header = c.header
+			w := httptest.NewRecorder()
+
+			_, _, ok := service.getAuthorizedIdentity(w, r, uid)
+			if ok != (c.statusCode == http.StatusOK) || (!ok && w.Code != c.statusCode) {
+				t.Errorf("unexpected authorization result: %t, %d", ok, w.Code)
+			}
+		})
+	}
+}
+
+func withClaim(claims map[string]interface{}, name string, value interface{}) map[string]interface{} {
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+	return claims
+}
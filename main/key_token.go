@@ -0,0 +1,213 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// keyHandlePrefix is the prefix of key handles, which are stored instead of the private key,
+// if the private key is held by a key token (PKCS#11 URI, RFC 7512)
+const keyHandlePrefix = "pkcs11:"
+
+// keyToken is a hardware or software token (e.g. an HSM), which generates and holds private keys. The private
+// keys never leave the token, they are referenced by key handles instead.
+type keyToken interface {
+	// GenerateKeyPair generates a new ECDSA key pair on the given curve and returns a handle for it
+	GenerateKeyPair(curve elliptic.Curve) (handle []byte, err error)
+	// PublicKey returns the public key of the key pair with the given handle
+	PublicKey(handle []byte) (*ecdsa.PublicKey, error)
+	// SignHash signs the hash with the private key of the key pair with the given handle and
+	// returns the signature as the concatenation of R and S
+	SignHash(handle []byte, hash []byte) ([]byte, error)
+	// DestroyKeyPair removes the key pair with the given handle from the token
+	DestroyKeyPair(handle []byte) error
+	Close() error
+}
+
+// isKeyHandle checks if the given private key is a handle for a private key held by a key token
+func isKeyHandle(privKey []byte) bool {
+	return bytes.HasPrefix(privKey, []byte(keyHandlePrefix))
+}
+
+// tokenCryptoContext implements the ubirch.Crypto interface for ECDSA keys, which are held by a key token.
+// New keys are generated in the token, the "private key PEM" of the interface methods is the key handle.
+// Private keys in PEM format, which were created before the token was used, are handled by the
+// embedded software crypto context.
+type tokenCryptoContext struct {
+	ubirch.Crypto
+	token                    keyToken
+	curve                    elliptic.Curve // curve for new keys, nil if the algorithm is not supported by the token
+	hash                     crypto.Hash
+	signatureAlgorithm       x509.SignatureAlgorithm
+	keyRegistrationAlgorithm string
+}
+
+// Ensure tokenCryptoContext implements the Crypto interface
+var _ ubirch.Crypto = (*tokenCryptoContext)(nil)
+
+// useKeyToken makes all signing algorithms generate new private keys in the given token
+func useKeyToken(token keyToken) {
+	for name, alg := range signingAlgorithms {
+		c := &tokenCryptoContext{
+			Crypto: alg.crypto,
+			token:  token,
+			hash:   alg.hash,
+		}
+
+		switch name {
+		case ES256:
+			c.curve, c.signatureAlgorithm, c.keyRegistrationAlgorithm = elliptic.P256(), x509.ECDSAWithSHA256, "ecdsa-p256v1"
+		case ES384:
+			c.curve, c.signatureAlgorithm, c.keyRegistrationAlgorithm = elliptic.P384(), x509.ECDSAWithSHA384, "ecdsa-p384v1"
+		case ES512:
+			c.curve, c.signatureAlgorithm, c.keyRegistrationAlgorithm = elliptic.P521(), x509.ECDSAWithSHA512, "ecdsa-p521v1"
+		default:
+			log.Warnf("signing algorithm %s is not supported with key token, new keys can not be generated", name)
+		}
+
+		alg.crypto = c
+	}
+}
+
+func (c *tokenCryptoContext) GenerateKey() (privKeyPEM []byte, err error) {
+	if c.curve == nil {
+		return nil, fmt.Errorf("key generation is not supported by key token for this signing algorithm")
+	}
+	return c.token.GenerateKeyPair(c.curve)
+}
+
+func (c *tokenCryptoContext) GetPublicKeyFromPrivateKey(privKeyPEM []byte) (pubKeyPEM []byte, err error) {
+	if !isKeyHandle(privKeyPEM) {
+		return c.Crypto.GetPublicKeyFromPrivateKey(privKeyPEM)
+	}
+
+	pub, err := c.token.PublicKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return encodePKIXPublicKey(pub)
+}
+
+func (c *tokenCryptoContext) GetSignedKeyRegistration(privKeyPEM []byte, uid uuid.UUID) ([]byte, error) {
+	if !isKeyHandle(privKeyPEM) {
+		return c.Crypto.GetSignedKeyRegistration(privKeyPEM, uid)
+	}
+	return getSignedKeyRegistration(c, c.keyRegistrationAlgorithm, privKeyPEM, uid)
+}
+
+func (c *tokenCryptoContext) GetCSR(privKeyPEM []byte, id uuid.UUID, subjectCountry string, subjectOrganization string) ([]byte, error) {
+	if !isKeyHandle(privKeyPEM) {
+		return c.Crypto.GetCSR(privKeyPEM, id, subjectCountry, subjectOrganization)
+	}
+
+	pub, err := c.token.PublicKey(privKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	signer := &tokenSigner{token: c.token, handle: privKeyPEM, pub: pub}
+	return createCSR(signer, c.signatureAlgorithm, id, subjectCountry, subjectOrganization)
+}
+
+func (c *tokenCryptoContext) Sign(privKeyPEM []byte, data []byte) ([]byte, error) {
+	if !isKeyHandle(privKeyPEM) {
+		return c.Crypto.Sign(privKeyPEM, data)
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty data")
+	}
+
+	h := c.hash.New()
+	h.Write(data)
+	return c.SignHash(privKeyPEM, h.Sum(nil))
+}
+
+func (c *tokenCryptoContext) SignHash(privKeyPEM []byte, hash []byte) ([]byte, error) {
+	if !isKeyHandle(privKeyPEM) {
+		return c.Crypto.SignHash(privKeyPEM, hash)
+	}
+
+	if len(hash) != c.HashLength() {
+		return nil, fmt.Errorf("invalid hash size: expected %d, got %d", c.HashLength(), len(hash))
+	}
+
+	return c.token.SignHash(privKeyPEM, hash)
+}
+
+// destroyTokenKeys removes the private keys, which are held by a key token, from the token.
+// Must be called after the removal of the keys from the identity was committed.
+func destroyTokenKeys(algorithm string, privKeys ...[]byte) {
+	alg, err := lookupAlgorithm(algorithm)
+	if err != nil {
+		log.Errorf("unable to destroy token keys: %v", err)
+		return
+	}
+
+	c, ok := alg.crypto.(*tokenCryptoContext)
+	if !ok {
+		return
+	}
+
+	for _, privKey := range privKeys {
+		if !isKeyHandle(privKey) {
+			continue
+		}
+
+		err = c.token.DestroyKeyPair(privKey)
+		if err != nil {
+			log.Errorf("unable to destroy token key %s: %v", privKey, err)
+		}
+	}
+}
+
+// tokenSigner implements the crypto.Signer interface for a private key, which is held by a key token
+type tokenSigner struct {
+	token  keyToken
+	handle []byte
+	pub    *ecdsa.PublicKey
+}
+
+func (s *tokenSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs the digest with the private key in the token and returns an ASN.1 encoded signature
+func (s *tokenSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	signature, err := s.token.SignHash(s.handle, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	l := len(signature) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		R: new(big.Int).SetBytes(signature[:l]),
+		S: new(big.Int).SetBytes(signature[l:]),
+	})
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-client-go/main/adapters/encrypters"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+// testKeyToken is a key token, which keeps the private keys in memory
+type testKeyToken struct {
+	keys  map[string]*ecdsa.PrivateKey
+	mutex *sync.Mutex
+	count int
+}
+
+func newTestKeyToken() *testKeyToken {
+	return &testKeyToken{
+		keys:  map[string]*ecdsa.PrivateKey{},
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (t *testKeyToken) GenerateKeyPair(curve elliptic.Curve) (handle []byte, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	t.count++
+	handle = []byte(fmt.Sprintf("%sid=%%%02x", keyHandlePrefix, t.count))
+	t.keys[string(handle)] = priv
+
+	return handle, nil
+}
+
+func (t *testKeyToken) PublicKey(handle []byte) (*ecdsa.PublicKey, error) {
+	priv, err := t.key(handle)
+	if err != nil {
+		return nil, err
+	}
+	return &priv.PublicKey, nil
+}
+
+func (t *testKeyToken) SignHash(handle []byte, hash []byte) ([]byte, error) {
+	priv, err := t.key(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, priv, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	l := (priv.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*l)
+	r.FillBytes(signature[:l])
+	s.FillBytes(signature[l:])
+
+	return signature, nil
+}
+
+func (t *testKeyToken) DestroyKeyPair(handle []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.keys, string(handle))
+	return nil
+}
+
+func (t *testKeyToken) Close() error {
+	return nil
+}
+
+func (t *testKeyToken) key(handle []byte) (*ecdsa.PrivateKey, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	priv, found := t.keys[string(handle)]
+	if !found {
+		return nil, fmt.Errorf("key %s not found", handle)
+	}
+	return priv, nil
+}
+
+// useTestKeyToken makes the signing algorithms use the key token until the end of the test
+func useTestKeyToken(t *testing.T, token keyToken) {
+	cryptoContexts := map[string]ubirch.Crypto{}
+	for name, alg := range signingAlgorithms {
+		cryptoContexts[name] = alg.crypto
+	}
+
+	useKeyToken(token)
+
+	t.Cleanup(func() {
+		for name, alg := range signingAlgorithms {
+			alg.crypto = cryptoContexts[name]
+		}
+	})
+}
+
+func TestTokenCryptoContext(t *testing.T) {
+	useTestKeyToken(t, newTestKeyToken())
+
+	for _, algorithm := range []string{ES256, ES384, ES512} {
+		t.Run(algorithm, func(t *testing.T) {
+			alg, err := lookupAlgorithm(algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := alg.crypto
+
+			handle, err := c.GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isKeyHandle(handle) {
+				t.Fatalf("GenerateKey did not return a key handle: %s", handle)
+			}
+
+			pubKeyPEM, err := c.GetPublicKeyFromPrivateKey(handle)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := []byte("data to be signed")
+
+			signature, err := c.Sign(handle, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(signature) != c.SignatureLength() {
+				t.Errorf("unexpected signature length: %d", len(signature))
+			}
+
+			ok, err := c.Verify(pubKeyPEM, data, signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Error("signature of token key could not be verified")
+			}
+
+			signature, err = c.SignHash(handle, alg.digest(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ok, err = c.Verify(pubKeyPEM, data, signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Error("signature of hash with token key could not be verified")
+			}
+
+			_, err = c.SignHash(handle, data)
+			if err == nil {
+				t.Error("SignHash did not fail for invalid hash size")
+			}
+
+			checkTokenCSR(t, c, handle, pubKeyPEM)
+			checkTokenKeyRegistration(t, c, handle, pubKeyPEM)
+		})
+	}
+}
+
+func TestTokenCryptoContext_PEMKeys(t *testing.T) {
+	useTestKeyToken(t, newTestKeyToken())
+
+	alg, err := lookupAlgorithm(ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keys, which were created before the token was used, are still usable
+	privKeyPEM, err := (&ubirch.ECDSACryptoContext{}).GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKeyPEM, err := alg.crypto.GetPublicKeyFromPrivateKey(privKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("data to be signed")
+
+	signature, err := alg.crypto.Sign(privKeyPEM, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := alg.crypto.Verify(pubKeyPEM, data, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("signature of PEM key could not be verified")
+	}
+
+	checkTokenCSR(t, alg.crypto, privKeyPEM, pubKeyPEM)
+}
+
+func TestTokenCryptoContext_UnsupportedAlgorithm(t *testing.T) {
+	useTestKeyToken(t, newTestKeyToken())
+
+	alg, err := lookupAlgorithm(EdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = alg.crypto.GenerateKey()
+	if err == nil {
+		t.Error("key generation for algorithm, which is not supported by the token, did not fail")
+	}
+}
+
+func TestProtocol_KeyHandle(t *testing.T) {
+	useTestKeyToken(t, newTestKeyToken())
+
+	alg, err := lookupAlgorithm(ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := encrypters.NewKeyEncrypter(newTestSecret(), alg.crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctxManager := NewMemoryContextManager()
+
+	p := &Protocol{
+		Crypto:       alg.crypto,
+		ctxManager:   ctxManager,
+		keyEncrypter: enc,
+
+		identityCache: &sync.Map{},
+		uidCache:      &sync.Map{},
+		authCache:     &sync.Map{},
+	}
+
+	handle, err := alg.crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKeyPEM, err := alg.crypto.GetPublicKeyFromPrivateKey(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeAndCommit(t, p, &Identity{
+		Uid:        uid,
+		PrivateKey: handle,
+		PublicKey:  pubKeyPEM,
+		AuthToken:  hashTestAuthToken(t, "password1234"),
+		Algorithm:  ES256,
+	})
+
+	// only the key handle is stored
+	storedId, err := ctxManager.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storedId.PrivateKey, handle) {
+		t.Errorf("stored private key is not the key handle: %s", storedId.PrivateKey)
+	}
+
+	id, err := p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id.PrivateKey, handle) {
+		t.Errorf("unexpected private key: %s", id.PrivateKey)
+	}
+	if !bytes.Equal(id.PublicKey, pubKeyPEM) {
+		t.Errorf("unexpected public key: %s", id.PublicKey)
+	}
+}
+
+func TestDestroyTokenKeys(t *testing.T) {
+	token := newTestKeyToken()
+	useTestKeyToken(t, token)
+
+	alg, err := lookupAlgorithm(ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := alg.crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destroyTokenKeys(ES256, handle, nil)
+
+	_, err = token.PublicKey(handle)
+	if err == nil {
+		t.Error("token key was not destroyed")
+	}
+}
+
+func checkTokenCSR(t *testing.T, c ubirch.Crypto, privKey, pubKeyPEM []byte) {
+	csrBytes, err := c.GetCSR(privKey, uid, "DE", "test GmbH")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		t.Errorf("invalid CSR signature: %v", err)
+	}
+
+	csrPubKeyPEM, err := encodePKIXPublicKey(csr.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(csrPubKeyPEM, pubKeyPEM) {
+		t.Error("unexpected public key in CSR")
+	}
+}
+
+func checkTokenKeyRegistration(t *testing.T, c ubirch.Crypto, privKey, pubKeyPEM []byte) {
+	keyRegBytes, err := c.GetSignedKeyRegistration(privKey, uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyReg := &ubirch.SignedKeyRegistration{}
+	err = json.Unmarshal(keyRegBytes, keyReg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKeyInfo, err := json.Marshal(keyReg.PubKeyInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(keyReg.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := c.Verify(pubKeyPEM, pubKeyInfo, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("invalid signature of key registration")
+	}
+}
@@ -20,7 +20,9 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/ubirch/ubirch-client-go/main/adapters/handlers"
 	"github.com/ubirch/ubirch-client-go/main/auditlogger"
@@ -56,12 +58,17 @@ func main() {
 		serviceName = "cose-client"
 		configFile  = "config.json"
 		MigrateArg  = "--migrate"
+
+		PendingMigrationsArg = "--pending-migrations"
+		RotateSecretArg      = "--rotate-secret"
 	)
 
 	var (
-		configDir string
-		migrate   bool
-		serverID  = fmt.Sprintf("%s/%s", serviceName, Version)
+		configDir         string
+		migrate           bool
+		pendingMigrations bool
+		rotateSecret      bool
+		serverID          = fmt.Sprintf("%s/%s", serviceName, Version)
 	)
 
 	if len(os.Args) > 1 {
@@ -69,6 +76,10 @@ func main() {
 			log.Infof("arg #%d: %s", i+1, arg)
 			if arg == MigrateArg {
 				migrate = true
+			} else if arg == PendingMigrationsArg {
+				pendingMigrations = true
+			} else if arg == RotateSecretArg {
+				rotateSecret = true
 			} else {
 				configDir = arg
 			}
@@ -86,6 +97,22 @@ func main() {
 		log.Fatalf("ERROR: unable to load configuration: %s", err)
 	}
 
+	if pendingMigrations {
+		err := PrintPendingMigrations(conf)
+		if err != nil {
+			log.Fatalf("unable to get pending database migrations: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if rotateSecret {
+		err := RotateSecret(conf)
+		if err != nil {
+			log.Fatalf("secret rotation failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	if migrate {
 		err := MigrateFileToDB(conf)
 		if err != nil {
@@ -103,7 +130,7 @@ func main() {
 	go shutdown(cancel)
 
 	// set up HTTP server
-	httpServer := handlers.HTTPServer{
+	httpServer := HTTPServer{
 		Router:   handlers.NewRouter(),
 		Addr:     conf.TCP_addr,
 		TLS:      conf.TLS,
@@ -111,6 +138,14 @@ func main() {
 		KeyFile:  conf.TLS_KeyFile,
 	}
 
+	// verify client certificates, if mutual TLS is enabled
+	if conf.TLS_ClientCAFile != "" {
+		httpServer.TLSConfig, err = newClientCertTLSConfig(conf.TLS_ClientCAFile, conf.TLS_RequireClientCert)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// start HTTP server
 	serverReadyCtx, serverReady := context.WithCancel(context.Background())
 	g.Go(func() error {
@@ -125,6 +160,18 @@ func main() {
 	// set up endpoint for liveliness checks
 	httpServer.Router.Get("/healtz", h.Health(serverID))
 
+	// keep signing keys in the PKCS#11 token, if configured
+	if conf.PKCS11Module != "" {
+		token, err := openPKCS11Token(conf.PKCS11Module, conf.PKCS11TokenLabel, conf.PKCS11Pin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		//noinspection GoUnhandledErrorResult
+		defer token.Close()
+
+		useKeyToken(token)
+	}
+
 	// initialize COSE service
 	ctxManager, err := GetCtxManager(conf)
 	if err != nil {
@@ -139,16 +186,38 @@ func main() {
 	client.CertificateServerURL = conf.CertificateServer
 	client.CertificateServerPubKeyURL = conf.CertificateServerPubKey
 	client.ServerTLSCertFingerprints = conf.ServerTLSCertFingerprints
-
-	protocol, err := NewProtocol(ctxManager, conf.secretBytes, client, conf.ReloadCertsEveryMinute)
+	client.CertificateListFile = conf.CertificateListFile
+	client.CertificateListKeyFile = conf.CertificateListKeyFile
+
+	protocol, err := NewProtocol(ctxManager, conf.secretBytes, conf.prevSecretBytes, client, conf.ReloadCertsEveryMinute,
+		time.Duration(conf.KeyRotationGracePeriod)*time.Hour, filepath.Join(conf.configDir, trustListFileName),
+		CertificateFilter{
+			Types:         conf.CertificateTypes,
+			Countries:     conf.CertificateCountries,
+			ExpiryWarning: time.Duration(conf.CertExpiryWarning) * time.Hour,
+		})
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// load the public key certificate list and check for new certificates frequently
+	g.Go(func() error {
+		protocol.ReloadCertificateList(ctx)
+		return nil
+	})
+
+	// discard replaced keys after the key rotation grace period
+	g.Go(func() error {
+		protocol.DiscardExpiredPrevKeys(ctx)
+		return nil
+	})
+
 	idHandler := &IdentityHandler{
 		protocol:            protocol,
 		subjectCountry:      conf.CSR_Country,
 		subjectOrganization: conf.CSR_Organization,
+		defaultAlgorithm:    conf.SigningAlgorithm,
+		registerAuth:        conf.RegisterAuth,
 	}
 
 	coseSigner, err := NewCoseSigner(protocol)
@@ -157,12 +226,40 @@ func main() {
 	}
 
 	service := &COSEService{
-		CoseSigner: coseSigner,
+		CoseSigner:     coseSigner,
+		maxBatchSize:   conf.MaxBatchSize,
+		clientCertAuth: conf.TLS_ClientCertAuth,
+	}
+
+	if conf.JWTJWKS != "" {
+		service.jwtVerifier, err = NewJWTVerifier(conf.JWTJWKS, conf.configDir, conf.JWTIssuer, conf.JWTAudience,
+			conf.JWTUUIDsClaim, conf.JWTTenant)
+		if err != nil {
+			log.Fatalf("JWT authentication setup failed: %v", err)
+		}
+	}
+
+	coseVerifier, err := NewCoseVerifier(protocol)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	verificationService := &VerificationService{
+		CoseVerifier: coseVerifier,
 	}
 
 	// set up endpoint for identity registration
 	creator := handlers.NewIdentityCreator(conf.RegisterAuth)
-	httpServer.Router.Put("/register", creator.Put(idHandler.initIdentity, idHandler.protocol.Exists))
+	httpServer.Router.Put(RegisterEndpoint, idHandler.register(creator))
+
+	// set up endpoint for identity deregistration
+	httpServer.Router.Delete(path.Join(RegisterEndpoint, UUIDPath), idHandler.deregister()) // /register/<uuid>
+
+	// set up endpoint for key rotation
+	httpServer.Router.Post(path.Join(RegisterEndpoint, UUIDPath, RotateEndpoint), idHandler.rotate()) // /register/<uuid>/rotate
+
+	// set up endpoint for auth token updates
+	httpServer.Router.Put(path.Join(RegisterEndpoint, UUIDPath, TokenEndpoint), idHandler.updateToken()) // /register/<uuid>/token
 
 	// set up endpoints for COSE signing (UUID as URL parameter)
 	directUuidEndpoint := path.Join(UUIDPath, CBORPath) // /<uuid>/cbor
@@ -171,8 +268,30 @@ func main() {
 	directUuidHashEndpoint := path.Join(directUuidEndpoint, HashEndpoint) // /<uuid>/cbor/hash
 	httpServer.Router.Post(directUuidHashEndpoint, service.directUUID())
 
+	// set up endpoints for batch signing
+	directUuidBatchEndpoint := path.Join(directUuidEndpoint, BatchEndpoint) // /<uuid>/cbor/batch
+	httpServer.Router.Post(directUuidBatchEndpoint, service.batchUUID())
+
+	directUuidHashBatchEndpoint := path.Join(directUuidHashEndpoint, BatchEndpoint) // /<uuid>/cbor/hash/batch
+	httpServer.Router.Post(directUuidHashBatchEndpoint, service.batchUUID())
+
+	// set up endpoints for COSE verification
+	httpServer.Router.Post(VerifyEndpoint, verificationService.verify()) // /verify
+
+	directUuidVerifyEndpoint := path.Join(directUuidEndpoint, VerifyEndpoint) // /<uuid>/cbor/verify
+	httpServer.Router.Post(directUuidVerifyEndpoint, verificationService.verifyUUID())
+
+	directUuidAttachEndpoint := path.Join(directUuidEndpoint, AttachEndpoint) // /<uuid>/cbor/attach
+	httpServer.Router.Post(directUuidAttachEndpoint, verificationService.attachUUID())
+
 	// set up endpoint for readiness checks
-	httpServer.Router.Get("/readiness", h.Health(serverID))
+	readinessChecker := &ReadinessChecker{
+		Protocol:        protocol,
+		serverID:        serverID,
+		maxTrustListAge: time.Duration(conf.ReadinessMaxCertAge) * time.Minute,
+		minSKIDs:        conf.ReadinessMinSKIDs,
+	}
+	httpServer.Router.Get("/readiness", readinessChecker.readiness())
 	log.Info("ready")
 
 	// wait for all go routines of the waitgroup to return
@@ -0,0 +1,338 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryTransaction collects the changes of a transaction until it is closed. Like a database transaction,
+// it is rolled back, if its context is done before it was closed.
+type memoryTransaction struct {
+	changes map[uuid.UUID]*Identity // a nil identity marks a deletion
+	mutex   *sync.Mutex
+	closed  bool
+	done    chan struct{}
+}
+
+// MemoryContextManager is an identity store, which keeps the identities in memory only.
+// Transactions are serialized, i.e. only one transaction can be open at a time, and changes
+// of a transaction are not visible to readers before the transaction was committed.
+// Since all writers wait for the open transaction, transactions must not be kept open
+// during remote calls or other slow operations, like the hashing of auth tokens.
+type MemoryContextManager struct {
+	identities  map[uuid.UUID]Identity
+	pubKeyIndex map[string]uuid.UUID
+	mutex       *sync.RWMutex
+	txLock      chan struct{}
+
+	// persist is called with the changes of a transaction before they are committed, optional.
+	// If it returns an error, the transaction is rolled back.
+	persist func(changes map[uuid.UUID]*Identity) error
+}
+
+// Ensure MemoryContextManager implements the ContextManager interface
+var _ ContextManager = (*MemoryContextManager)(nil)
+
+func NewMemoryContextManager() *MemoryContextManager {
+	return &MemoryContextManager{
+		identities:  map[uuid.UUID]Identity{},
+		pubKeyIndex: map[string]uuid.UUID{},
+		mutex:       &sync.RWMutex{},
+		txLock:      make(chan struct{}, 1),
+	}
+}
+
+func (m *MemoryContextManager) IsReady(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryContextManager) Close() {}
+
+func (m *MemoryContextManager) StartTransaction(ctx context.Context) (transactionCtx interface{}, err error) {
+	select {
+	case m.txLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	tx := &memoryTransaction{
+		changes: map[uuid.UUID]*Identity{},
+		mutex:   &sync.Mutex{},
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = m.CloseTransaction(tx, Rollback)
+		case <-tx.done:
+		}
+	}()
+
+	return tx, nil
+}
+
+func (m *MemoryContextManager) CloseTransaction(transactionCtx interface{}, commit bool) error {
+	return m.withTransaction(transactionCtx, func(tx *memoryTransaction) error {
+		tx.closed = true
+		close(tx.done)
+		defer func() { <-m.txLock }()
+
+		if !commit || len(tx.changes) == 0 {
+			return nil
+		}
+
+		return m.commit(tx.changes)
+	})
+}
+
+func (m *MemoryContextManager) StoreNewIdentity(transactionCtx interface{}, identity Identity) error {
+	return m.withTransaction(transactionCtx, func(tx *memoryTransaction) error {
+		if m.exists(tx, identity.Uid) {
+			return ErrExists
+		}
+
+		tx.changes[identity.Uid] = &identity
+		return nil
+	})
+}
+
+func (m *MemoryContextManager) UpdateIdentity(transactionCtx interface{}, identity Identity) error {
+	return m.withTransaction(transactionCtx, func(tx *memoryTransaction) error {
+		if !m.exists(tx, identity.Uid) {
+			return ErrNotExist
+		}
+
+		tx.changes[identity.Uid] = &identity
+		return nil
+	})
+}
+
+func (m *MemoryContextManager) GetIdentity(uid uuid.UUID) (*Identity, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	id, found := m.identities[uid]
+	if !found {
+		return nil, ErrNotExist
+	}
+
+	return &id, nil
+}
+
+// GetIdentityForUpdate returns the identity, taking into account the changes of the transaction.
+// Since transactions are serialized, the identity can not be updated concurrently.
+func (m *MemoryContextManager) GetIdentityForUpdate(transactionCtx interface{}, uid uuid.UUID) (*Identity, error) {
+	var id *Identity
+
+	err := m.withTransaction(transactionCtx, func(tx *memoryTransaction) error {
+		if changedId, changed := tx.changes[uid]; changed {
+			if changedId == nil {
+				return ErrNotExist
+			}
+			changedIdCopy := *changedId
+			id = &changedIdCopy
+			return nil
+		}
+
+		var err error
+		id, err = m.GetIdentity(uid)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+func (m *MemoryContextManager) DeleteIdentity(transactionCtx interface{}, uid uuid.UUID) error {
+	return m.withTransaction(transactionCtx, func(tx *memoryTransaction) error {
+		if !m.exists(tx, uid) {
+			return ErrNotExist
+		}
+
+		tx.changes[uid] = nil
+		return nil
+	})
+}
+
+func (m *MemoryContextManager) GetIdentitiesWithOtherKeyVersion(transactionCtx interface{}, keyVersion string, limit int) ([]Identity, error) {
+	var identities []Identity
+
+	err := m.withTransaction(transactionCtx, func(tx *memoryTransaction) error {
+		m.mutex.RLock()
+		defer m.mutex.RUnlock()
+
+		for uid, id := range m.identities {
+			if changedId, changed := tx.changes[uid]; changed {
+				if changedId == nil {
+					continue
+				}
+				id = *changedId
+			}
+			if id.KeyVersion != keyVersion {
+				identities = append(identities, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].Uid.String() < identities[j].Uid.String()
+	})
+
+	if len(identities) > limit {
+		identities = identities[:limit]
+	}
+
+	return identities, nil
+}
+
+func (m *MemoryContextManager) GetUuidForPublicKey(pubKey []byte) (uuid.UUID, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	uid, found := m.pubKeyIndex[string(pubKey)]
+	if !found {
+		return uuid.Nil, ErrNotExist
+	}
+
+	return uid, nil
+}
+
+func (m *MemoryContextManager) GetUuidsForPublicKeys(pubKeys [][]byte) (map[string]uuid.UUID, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	uids := map[string]uuid.UUID{}
+	for _, pubKey := range pubKeys {
+		if uid, found := m.pubKeyIndex[string(pubKey)]; found {
+			uids[string(pubKey)] = uid
+		}
+	}
+
+	return uids, nil
+}
+
+func (m *MemoryContextManager) GetUuidsWithExpiredPrevKey(now time.Time) ([]uuid.UUID, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var uids []uuid.UUID
+	for uid, id := range m.identities {
+		if len(id.PrevPublicKey) != 0 && now.After(id.PrevKeyExpiry) {
+			uids = append(uids, uid)
+		}
+	}
+
+	return uids, nil
+}
+
+// withTransaction calls the given function with exclusive access to the open transaction
+func (m *MemoryContextManager) withTransaction(transactionCtx interface{}, do func(tx *memoryTransaction) error) error {
+	tx, ok := transactionCtx.(*memoryTransaction)
+	if !ok {
+		return fmt.Errorf("transactionCtx for context manager is not of expected type *memoryTransaction")
+	}
+
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.closed {
+		return fmt.Errorf("transaction has already been closed")
+	}
+
+	return do(tx)
+}
+
+// exists checks if an identity exists, taking into account the changes of the transaction
+func (m *MemoryContextManager) exists(tx *memoryTransaction, uid uuid.UUID) bool {
+	if id, changed := tx.changes[uid]; changed {
+		return id != nil
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	_, found := m.identities[uid]
+	return found
+}
+
+// commit applies the changes of a transaction to the identities, after persisting them, if required
+func (m *MemoryContextManager) commit(changes map[uuid.UUID]*Identity) error {
+	if m.persist != nil {
+		err := m.persist(changes)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for uid, id := range changes {
+		m.removeFromIndex(uid)
+		if id == nil {
+			delete(m.identities, uid)
+		} else {
+			m.identities[uid] = *id
+			m.addToIndex(*id)
+		}
+	}
+
+	return nil
+}
+
+// load adds an identity without a transaction, e.g. when the identity store is initialized from persistent storage
+func (m *MemoryContextManager) load(id Identity) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.removeFromIndex(id.Uid)
+	m.identities[id.Uid] = id
+	m.addToIndex(id)
+}
+
+func (m *MemoryContextManager) addToIndex(id Identity) {
+	for _, pubKey := range [][]byte{id.PublicKey, id.NextPublicKey, id.PrevPublicKey} {
+		if len(pubKey) != 0 {
+			m.pubKeyIndex[string(pubKey)] = id.Uid
+		}
+	}
+}
+
+func (m *MemoryContextManager) removeFromIndex(uid uuid.UUID) {
+	id, found := m.identities[uid]
+	if !found {
+		return
+	}
+
+	for _, pubKey := range [][]byte{id.PublicKey, id.NextPublicKey, id.PrevPublicKey} {
+		if indexedUid, found := m.pubKeyIndex[string(pubKey)]; found && indexedUid == uid {
+			delete(m.pubKeyIndex, string(pubKey))
+		}
+	}
+}
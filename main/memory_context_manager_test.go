@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryContextManager_Rollback(t *testing.T) {
+	m := NewMemoryContextManager()
+
+	testIdentity := generateRandomIdentity()
+
+	tx, err := m.StartTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.StoreNewIdentity(tx, *testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.CloseTransaction(tx, Rollback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.GetIdentity(testIdentity.Uid)
+	if err != ErrNotExist {
+		t.Errorf("GetIdentity did not return ErrNotExist after rollback: %v", err)
+	}
+
+	err = m.CloseTransaction(tx, Commit)
+	if err == nil {
+		t.Error("closed transaction was committed")
+	}
+
+	// transaction is rolled back when its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+
+	tx, err = m.StartTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.StoreNewIdentity(tx, *testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Second)
+	defer cancel2()
+
+	tx2, err := m.StartTransaction(ctx2)
+	if err != nil {
+		t.Fatalf("transaction was not released after its context was done: %v", err)
+	}
+
+	err = m.CloseTransaction(tx2, Rollback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.GetIdentity(testIdentity.Uid)
+	if err != ErrNotExist {
+		t.Errorf("GetIdentity did not return ErrNotExist after context was done: %v", err)
+	}
+}
+
+func TestMemoryContextManager_Isolation(t *testing.T) {
+	m := NewMemoryContextManager()
+
+	testIdentity := generateRandomIdentity()
+
+	tx, err := m.StartTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.StoreNewIdentity(tx, *testIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.StoreNewIdentity(tx, *testIdentity)
+	if err != ErrExists {
+		t.Errorf("StoreNewIdentity did not return ErrExists for identity stored in same transaction: %v", err)
+	}
+
+	// uncommitted changes are not visible
+	_, err = m.GetIdentity(testIdentity.Uid)
+	if err != ErrNotExist {
+		t.Errorf("GetIdentity returned uncommitted identity: %v", err)
+	}
+
+	_, err = m.GetUuidForPublicKey(testIdentity.PublicKey)
+	if err != ErrNotExist {
+		t.Errorf("GetUuidForPublicKey returned uuid of uncommitted identity: %v", err)
+	}
+
+	// concurrent transaction has to wait until the open transaction is closed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = m.StartTransaction(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("concurrent transaction was started: %v", err)
+	}
+
+	err = m.CloseTransaction(tx, Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// committed changes are visible
+	err = checkIdentity(m, testIdentity, newDoneWaitGroup())
+	if err != nil {
+		t.Error(err)
+	}
+
+	// modifying the returned identity does not modify the stored identity
+	storedIdentity, err := m.GetIdentity(testIdentity.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedIdentity.AuthToken = "modified"
+
+	err = checkIdentity(m, testIdentity, newDoneWaitGroup())
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var CertificateExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "certificate_expiry_timestamp_seconds",
+	Help: "Expiry of the public key certificate in use for the identity as unix timestamp",
+}, []string{"uuid"})
+
+var CertificateListLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "certificate_list_last_success_timestamp_seconds",
+	Help: "Time of the last successful attempt to load the public key certificate list as unix timestamp",
+})
+
+var CertificateListLastFailure = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "certificate_list_last_failure_timestamp_seconds",
+	Help: "Time of the last failed attempt to load the public key certificate list as unix timestamp",
+})
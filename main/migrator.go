@@ -24,10 +24,11 @@ func MigrateFileToDB(c *Config) error {
 		return err
 	}
 
-	dbManager, err := NewSqlDatabaseInfo(c.PostgresDSN, PostgreSqlIdentityTableName, &c.dbParams)
+	dbManager, err := GetCtxManager(c)
 	if err != nil {
 		return err
 	}
+	defer dbManager.Close()
 
 	err = migrateIdentities(dbManager, identities)
 	if err != nil {
@@ -59,9 +60,21 @@ func getKeysFromFile(configDir string, identities *[]*Identity) (err error) {
 	return nil
 }
 
-func migrateIdentities(dm *DatabaseManager, identities *[]*Identity) error {
+func migrateIdentities(dm ContextManager, identities *[]*Identity) error {
 	log.Infof("starting migration...")
 
+	for _, id := range *identities {
+		if len(id.AuthToken) == 0 {
+			return fmt.Errorf("%s: empty auth token", id.Uid)
+		}
+
+		authTokenHash, err := hashAuthToken(id.AuthToken)
+		if err != nil {
+			return err
+		}
+		id.AuthToken = authTokenHash
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -89,9 +102,8 @@ func migrateIdentities(dm *DatabaseManager, identities *[]*Identity) error {
 			return fmt.Errorf("%s: empty public key", id.Uid)
 		}
 
-		if len(id.AuthToken) == 0 {
-			return fmt.Errorf("%s: empty auth token", id.Uid)
-		}
+		// keys of the file based context are ECDSA P-256 keys
+		id.Algorithm = ES256
 
 		err = dm.StoreNewIdentity(tx, *id)
 		if err != nil {
@@ -0,0 +1,380 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pkcs11KeyLabel        = "ubirch-cose-client"
+	pkcs11KeyIDLength     = 16
+	pkcs11SessionPoolSize = 8
+)
+
+// named curves (RFC 5480)
+var (
+	oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidNamedCurveP521 = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+)
+
+// pkcs11Token is a key token, which keeps the private keys in a PKCS#11 token, e.g. an HSM or SoftHSM.
+// Key pairs are identified by their CKA_ID, key handles are PKCS#11 URIs of the form "pkcs11:id=%01%02...".
+type pkcs11Token struct {
+	ctx      *pkcs11.Ctx
+	sessions chan pkcs11.SessionHandle // pool of logged in sessions, a session must not be used concurrently
+}
+
+// Ensure pkcs11Token implements the keyToken interface
+var _ keyToken = (*pkcs11Token)(nil)
+
+// openPKCS11Token loads the PKCS#11 module and logs in to the token with the given label
+func openPKCS11Token(module, tokenLabel, pin string) (keyToken, error) {
+	log.Infof("preparing PKCS#11 key token usage: %s", module)
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("unable to load PKCS#11 module %s", module)
+	}
+
+	err := ctx.Initialize()
+	if err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("unable to initialize PKCS#11 module: %v", err)
+	}
+
+	t := &pkcs11Token{
+		ctx:      ctx,
+		sessions: make(chan pkcs11.SessionHandle, pkcs11SessionPoolSize),
+	}
+
+	err = t.openSessions(tokenLabel, pin)
+	if err != nil {
+		_ = t.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *pkcs11Token) openSessions(tokenLabel, pin string) error {
+	slot, err := t.findSlot(tokenLabel)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < pkcs11SessionPoolSize; i++ {
+		session, err := t.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return fmt.Errorf("unable to open PKCS#11 session: %v", err)
+		}
+		t.sessions <- session
+
+		// the login state is shared by all sessions of the application
+		if i == 0 {
+			err = t.ctx.Login(session, pkcs11.CKU_USER, pin)
+			if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+				return fmt.Errorf("PKCS#11 login failed: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *pkcs11Token) findSlot(tokenLabel string) (uint, error) {
+	slots, err := t.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get PKCS#11 slots: %v", err)
+	}
+
+	for _, slot := range slots {
+		info, err := t.ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("unable to get PKCS#11 token info: %v", err)
+		}
+		if strings.TrimSpace(info.Label) == tokenLabel {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("PKCS#11 token with label %q not found", tokenLabel)
+}
+
+// withSession calls the given function with a session from the pool
+func (t *pkcs11Token) withSession(do func(session pkcs11.SessionHandle) error) error {
+	session := <-t.sessions
+	defer func() { t.sessions <- session }()
+
+	return do(session)
+}
+
+func (t *pkcs11Token) Close() error {
+	for len(t.sessions) > 0 {
+		if err := t.ctx.CloseSession(<-t.sessions); err != nil {
+			log.Warnf("unable to close PKCS#11 session: %v", err)
+		}
+	}
+
+	err := t.ctx.Finalize()
+	t.ctx.Destroy()
+	return err
+}
+
+func (t *pkcs11Token) GenerateKeyPair(curve elliptic.Curve) (handle []byte, err error) {
+	ecParams, err := marshalNamedCurve(curve)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, pkcs11KeyIDLength)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	pubTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParams),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, pkcs11KeyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	privTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, pkcs11KeyLabel),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)}
+
+	err = t.withSession(func(session pkcs11.SessionHandle) error {
+		_, _, err := t.ctx.GenerateKeyPair(session, mechanism, pubTemplate, privTemplate)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 key generation failed: %v", err)
+	}
+
+	return encodeKeyHandle(id), nil
+}
+
+func (t *pkcs11Token) PublicKey(handle []byte) (*ecdsa.PublicKey, error) {
+	id, err := decodeKeyHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	var attributes []*pkcs11.Attribute
+
+	err = t.withSession(func(session pkcs11.SessionHandle) error {
+		obj, err := t.findObject(session, pkcs11.CKO_PUBLIC_KEY, id)
+		if err != nil {
+			return err
+		}
+
+		attributes, err = t.ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get public key from PKCS#11 token: %v", err)
+	}
+
+	var ecParams, ecPoint []byte
+	for _, a := range attributes {
+		switch a.Type {
+		case pkcs11.CKA_EC_PARAMS:
+			ecParams = a.Value
+		case pkcs11.CKA_EC_POINT:
+			ecPoint = a.Value
+		}
+	}
+
+	curve, err := unmarshalNamedCurve(ecParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// the EC point is a DER encoded octet string, but some tokens return the raw point
+	var point []byte
+	if rest, err := asn1.Unmarshal(ecPoint, &point); err != nil || len(rest) != 0 {
+		point = ecPoint
+	}
+
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, fmt.Errorf("invalid EC point of public key in PKCS#11 token")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func (t *pkcs11Token) SignHash(handle []byte, hash []byte) (signature []byte, err error) {
+	id, err := decodeKeyHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+
+	err = t.withSession(func(session pkcs11.SessionHandle) error {
+		obj, err := t.findObject(session, pkcs11.CKO_PRIVATE_KEY, id)
+		if err != nil {
+			return err
+		}
+
+		err = t.ctx.SignInit(session, mechanism, obj)
+		if err != nil {
+			return err
+		}
+
+		// the signature is the concatenation of R and S (PKCS#11 v2.40, section 2.3.1)
+		signature, err = t.ctx.Sign(session, hash)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 signing failed: %v", err)
+	}
+
+	return signature, nil
+}
+
+func (t *pkcs11Token) DestroyKeyPair(handle []byte) error {
+	id, err := decodeKeyHandle(handle)
+	if err != nil {
+		return err
+	}
+
+	return t.withSession(func(session pkcs11.SessionHandle) error {
+		for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+			obj, err := t.findObject(session, class, id)
+			if err != nil {
+				return err
+			}
+
+			err = t.ctx.DestroyObject(session, obj)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// findObject returns the object of the given class with the given CKA_ID
+func (t *pkcs11Token) findObject(session pkcs11.SessionHandle, class uint, id []byte) (pkcs11.ObjectHandle, error) {
+	err := t.ctx.FindObjectsInit(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	objects, _, err := t.ctx.FindObjects(session, 1)
+	if finalErr := t.ctx.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if len(objects) == 0 {
+		return 0, fmt.Errorf("key with ID %x not found in PKCS#11 token", id)
+	}
+
+	return objects[0], nil
+}
+
+// encodeKeyHandle returns a PKCS#11 URI (RFC 7512) for the key pair with the given CKA_ID
+func encodeKeyHandle(id []byte) []byte {
+	var uri strings.Builder
+	uri.WriteString(keyHandlePrefix + "id=")
+	for _, b := range id {
+		uri.WriteString("%" + hex.EncodeToString([]byte{b}))
+	}
+	return []byte(uri.String())
+}
+
+// decodeKeyHandle returns the CKA_ID from a key handle, which was created by encodeKeyHandle
+func decodeKeyHandle(handle []byte) ([]byte, error) {
+	encodedID := strings.TrimPrefix(string(handle), keyHandlePrefix+"id=")
+	if len(encodedID) == len(handle) || len(encodedID)%3 != 0 {
+		return nil, fmt.Errorf("invalid PKCS#11 key handle: %s", handle)
+	}
+
+	id, err := hex.DecodeString(strings.ReplaceAll(encodedID, "%", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PKCS#11 key handle: %s", handle)
+	}
+
+	return id, nil
+}
+
+func marshalNamedCurve(curve elliptic.Curve) ([]byte, error) {
+	switch curve {
+	case elliptic.P256():
+		return asn1.Marshal(oidNamedCurveP256)
+	case elliptic.P384():
+		return asn1.Marshal(oidNamedCurveP384)
+	case elliptic.P521():
+		return asn1.Marshal(oidNamedCurveP521)
+	default:
+		return nil, fmt.Errorf("unsupported elliptic curve: %s", curve.Params().Name)
+	}
+}
+
+func unmarshalNamedCurve(ecParams []byte) (elliptic.Curve, error) {
+	var oid asn1.ObjectIdentifier
+	_, err := asn1.Unmarshal(ecParams, &oid)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse EC parameters of public key in PKCS#11 token: %v", err)
+	}
+
+	switch {
+	case oid.Equal(oidNamedCurveP256):
+		return elliptic.P256(), nil
+	case oid.Equal(oidNamedCurveP384):
+		return elliptic.P384(), nil
+	case oid.Equal(oidNamedCurveP521):
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("unsupported elliptic curve of public key in PKCS#11 token: %s", oid)
+	}
+}
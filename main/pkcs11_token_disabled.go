@@ -0,0 +1,25 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !pkcs11
+// +build !pkcs11
+
+package main
+
+import "fmt"
+
+// openPKCS11Token is not available, since PKCS#11 support requires cgo and the build tag 'pkcs11'
+func openPKCS11Token(module, tokenLabel, pin string) (keyToken, error) {
+	return nil, fmt.Errorf("PKCS#11 key storage is not supported by this build (build with tag 'pkcs11')")
+}
@@ -0,0 +1,128 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"crypto/elliptic"
+	"os"
+	"testing"
+)
+
+// openTestPKCS11Token opens the PKCS#11 token, which is configured by the environment variables
+// PKCS11_TEST_MODULE, PKCS11_TEST_TOKEN_LABEL and PKCS11_TEST_PIN, e.g. a SoftHSM token:
+//
+//	softhsm2-util --init-token --free --label cose-client-test --pin 1234 --so-pin 5678
+//	PKCS11_TEST_MODULE=/usr/lib/softhsm/libsofthsm2.so PKCS11_TEST_TOKEN_LABEL=cose-client-test PKCS11_TEST_PIN=1234 \
+//	  go test -tags pkcs11 -run PKCS11 .
+func openTestPKCS11Token(t *testing.T) keyToken {
+	module := os.Getenv("PKCS11_TEST_MODULE")
+	if module == "" {
+		t.Skip("PKCS11_TEST_MODULE not set")
+	}
+
+	token, err := openPKCS11Token(module, os.Getenv("PKCS11_TEST_TOKEN_LABEL"), os.Getenv("PKCS11_TEST_PIN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := token.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return token
+}
+
+func TestPKCS11Token(t *testing.T) {
+	token := openTestPKCS11Token(t)
+
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			handle, err := token.GenerateKeyPair(curve)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := token.DestroyKeyPair(handle); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			pub, err := token.PublicKey(handle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pub.Curve != curve {
+				t.Errorf("unexpected curve of public key: %s", pub.Curve.Params().Name)
+			}
+		})
+	}
+}
+
+func TestPKCS11Token_CryptoContext(t *testing.T) {
+	useTestKeyToken(t, openTestPKCS11Token(t))
+
+	for _, algorithm := range []string{ES256, ES384, ES512} {
+		t.Run(algorithm, func(t *testing.T) {
+			alg, err := lookupAlgorithm(algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := alg.crypto
+
+			handle, err := c.GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer destroyTokenKeys(algorithm, handle)
+
+			pubKeyPEM, err := c.GetPublicKeyFromPrivateKey(handle)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := []byte("data to be signed")
+
+			signature, err := c.SignHash(handle, alg.digest(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ok, err := c.Verify(pubKeyPEM, data, signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Error("signature of PKCS#11 token key could not be verified")
+			}
+
+			checkTokenCSR(t, c, handle, pubKeyPEM)
+			checkTokenKeyRegistration(t, c, handle, pubKeyPEM)
+		})
+	}
+}
+
+func TestPKCS11KeyHandle(t *testing.T) {
+	id := []byte{0x00, 0x01, 0xab, 0xff}
+
+	handle := encodeKeyHandle(id)
+	if string(handle) != "pkcs11:id=%00%01%ab%ff" {
+		t.Errorf("unexpected key handle: %s", handle)
+	}
+
+	decodedID, err := decodeKeyHandle(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decodedID) != string(id) {
+		t.Errorf("unexpected key ID: %x", decodedID)
+	}
+
+	for _, invalid := range []string{"pkcs11:id=%0", "pkcs11:object=key", "id=%00"} {
+		_, err = decodeKeyHandle([]byte(invalid))
+		if err == nil {
+			t.Errorf("invalid key handle was accepted: %s", invalid)
+		}
+	}
+}
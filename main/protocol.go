@@ -15,16 +15,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/x509"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/ubirch/ubirch-client-go/main/adapters/encrypters"
+	"github.com/ubirch/ubirch-client-go/main/auditlogger"
 	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
 
 	log "github.com/sirupsen/logrus"
@@ -33,41 +40,38 @@ import (
 const (
 	SkidLen           = 8
 	maxDbConnAttempts = 5
-)
 
-var (
-	certLoadInterval     time.Duration
-	maxCertLoadFailCount int
+	prevKeyExpiryCheckInterval = time.Minute // interval of the check for replaced keys after the key rotation grace period
 )
 
-func setInterval(reloadEveryMinute bool) {
-	if reloadEveryMinute {
-		certLoadInterval = time.Minute
-		maxCertLoadFailCount = 60
-	} else {
-		certLoadInterval = time.Hour
-		maxCertLoadFailCount = 3
-	}
-}
-
 type Protocol struct {
 	ubirch.Crypto
 	*ExtendedClient
 	ctxManager   ContextManager
 	keyEncrypter *encrypters.KeyEncrypter
+	prevSecret   []byte // secret, which was replaced by a secret rotation, for the decryption of not yet re-encrypted keys
 
 	identityCache *sync.Map // {<uid>: <*identity>}
 	uidCache      *sync.Map // {<pub>: <uid>}
+	authCache     *sync.Map // {<uid>: <*verifiedAuthToken>}
 
 	skidStore           map[uuid.UUID][]byte
+	prevSkidStore       map[uuid.UUID][]byte // SKIDs of replaced keys within the key rotation grace period
 	skidStoreMutex      *sync.RWMutex
-	certLoadFailCounter int
+	trustListFile       string    // file where the last verified public key certificate list is persisted
+	trustListVerifiedAt time.Time // time of the verification of the public key certificate list in use
+	certFilter          CertificateFilter
+	certMatches         certMatchCache // results of matching the certificates of the last processed list
+	reloadEveryMinute   bool           // reload the public key certificate list every minute instead of every hour
+
+	keyRotationGracePeriod time.Duration
 }
 
 // Ensure Protocol implements the ContextManager interface
 var _ ContextManager = (*Protocol)(nil)
 
-func NewProtocol(ctxManager ContextManager, secret []byte, client *ExtendedClient, reloadCertsEveryMinute bool) (*Protocol, error) {
+func NewProtocol(ctxManager ContextManager, secret, prevSecret []byte, client *ExtendedClient, reloadCertsEveryMinute bool,
+	keyRotationGracePeriod time.Duration, trustListFile string, certFilter CertificateFilter) (*Protocol, error) {
 	crypto := &ubirch.ECDSACryptoContext{}
 
 	enc, err := encrypters.NewKeyEncrypter(secret, crypto)
@@ -80,31 +84,60 @@ func NewProtocol(ctxManager ContextManager, secret []byte, client *ExtendedClien
 		ExtendedClient: client,
 		ctxManager:     ctxManager,
 		keyEncrypter:   enc,
+		prevSecret:     prevSecret,
 
 		identityCache: &sync.Map{},
 		uidCache:      &sync.Map{},
+		authCache:     &sync.Map{},
 
 		skidStore:      map[uuid.UUID][]byte{},
+		prevSkidStore:  map[uuid.UUID][]byte{},
 		skidStoreMutex: &sync.RWMutex{},
-	}
+		trustListFile:  trustListFile,
+		certFilter:     certFilter,
 
-	// load public key certificate list from server and check for new certificates frequently
-	go func() {
-		setInterval(reloadCertsEveryMinute)
+		reloadEveryMinute: reloadCertsEveryMinute,
 
-		p.loadSKIDs()
-		for range time.Tick(certLoadInterval) {
-			p.loadSKIDs()
-		}
-	}()
+		keyRotationGracePeriod: keyRotationGracePeriod,
+	}
+
+	// load the last verified public key certificate list, so that known SKIDs
+	// are available before the list was retrieved from the server
+	p.loadPersistedSKIDs()
 
 	return p, nil
 }
 
+// ReloadCertificateList loads the public key certificate list from the server (or the local files) and checks for
+// new certificates frequently, until the context is cancelled. Failed attempts are retried with exponential backoff.
+func (p *Protocol) ReloadCertificateList(ctx context.Context) {
+	interval, maxFailDuration := certLoadIntervals(p.reloadEveryMinute)
+
+	reloader := &certListReloader{
+		load:            p.loadSKIDs,
+		clear:           func() { p.updateSKIDs(nil) },
+		interval:        interval,
+		minBackoff:      certLoadMinBackoff,
+		maxFailDuration: maxFailDuration,
+		rand:            rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	// a local certificate list is reloaded as soon as one of the files changed
+	if p.CertificateListFile != "" {
+		reloader.changed = watchFiles(ctx, fileWatchInterval, p.CertificateListFile, p.CertificateListKeyFile)
+	}
+
+	reloader.run(ctx)
+}
+
 func (p *Protocol) Close() {
 	p.ctxManager.Close()
 }
 
+func (p *Protocol) IsReady(ctx context.Context) error {
+	return p.ctxManager.IsReady(ctx)
+}
+
 func (p *Protocol) StartTransaction(ctx context.Context) (transactionCtx interface{}, err error) {
 	for i := 0; i < maxDbConnAttempts; i++ {
 		transactionCtx, err = p.ctxManager.StartTransaction(ctx)
@@ -119,7 +152,20 @@ func (p *Protocol) StartTransaction(ctx context.Context) (transactionCtx interfa
 }
 
 func (p *Protocol) CloseTransaction(tx interface{}, commit bool) error {
-	return p.ctxManager.CloseTransaction(tx, commit)
+	pubKeysChanged := p.pubKeysChanged(tx)
+
+	err := p.ctxManager.CloseTransaction(tx, commit)
+	if err != nil || !commit || !pubKeysChanged {
+		return err
+	}
+
+	// the changed public keys might match certificates, which were not matched before, or no longer match
+	// certificates, which were matched before. The matches are invalidated only after the commit, so that a
+	// concurrent reload of the certificate list can not remember a certificate as unmatched, because it did
+	// not see the identity yet. Changes of other attributes, like the auth token, do not affect the matches.
+	p.invalidateCertMatches()
+
+	return nil
 }
 
 func (p *Protocol) StoreNewIdentity(tx interface{}, id Identity) error {
@@ -128,19 +174,423 @@ func (p *Protocol) StoreNewIdentity(tx interface{}, id Identity) error {
 		return err
 	}
 
-	// encrypt private key
-	id.PrivateKey, err = p.keyEncrypter.Encrypt(id.PrivateKey)
+	err = p.encodeKeys(&id)
+	if err != nil {
+		return err
+	}
+
+	// the auth token of a new identity must have been hashed by the caller
+	_, err = parseAuthTokenHash(id.AuthToken)
+	if err != nil {
+		return fmt.Errorf("auth token of new identity is not a valid hash: %v", err)
+	}
+
+	err = p.ctxManager.StoreNewIdentity(tx, id)
+	if err != nil {
+		return err
+	}
+
+	p.markPubKeysChanged(tx)
+	return nil
+}
+
+// UpdateIdentity replaces the stored keys and auth token of an existing identity
+func (p *Protocol) UpdateIdentity(tx interface{}, id Identity) error {
+	err := p.checkIdentityAttributesNotNil(&id)
+	if err != nil {
+		return err
+	}
+
+	err = p.encodeKeys(&id)
+	if err != nil {
+		return err
+	}
+
+	err = encodeAuthToken(&id)
+	if err != nil {
+		return err
+	}
+
+	return p.ctxManager.UpdateIdentity(tx, id)
+}
+
+// encodeKeys encrypts the private keys and converts the public keys
+// of the identity to their raw bytes representation for storage
+func (p *Protocol) encodeKeys(id *Identity) error {
+	alg, err := lookupAlgorithm(id.Algorithm)
+	if err != nil {
+		return err
+	}
+	id.Algorithm = alg.name
+
+	enc := p.getKeyEncrypter(alg)
+	id.KeyVersion = secretKeyVersion(enc.Secret)
+
+	for _, privKey := range []*[]byte{&id.PrivateKey, &id.NextPrivateKey, &id.PrevPrivateKey} {
+		if len(*privKey) == 0 || isKeyHandle(*privKey) { // keys held by a key token are stored as handle
+			continue
+		}
+		*privKey, err = enc.Encrypt(*privKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, pubKey := range []*[]byte{&id.PublicKey, &id.NextPublicKey, &id.PrevPublicKey} {
+		if len(*pubKey) == 0 {
+			continue
+		}
+		*pubKey, err = alg.crypto.PublicKeyPEMToBytes(*pubKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeKeys decrypts the private keys and converts the public keys
+// of the identity from their stored representation to PEM format
+func (p *Protocol) decodeKeys(id *Identity) error {
+	alg, err := lookupAlgorithm(id.Algorithm)
+	if err != nil {
+		return err
+	}
+	id.Algorithm = alg.name
+
+	secrets, err := p.decryptionSecrets(id.KeyVersion)
+	if err != nil {
+		return err
+	}
+
+	for _, privKey := range []*[]byte{&id.PrivateKey, &id.NextPrivateKey, &id.PrevPrivateKey} {
+		if len(*privKey) == 0 || isKeyHandle(*privKey) {
+			continue
+		}
+		*privKey, err = decryptPrivateKey(alg, secrets, *privKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, pubKey := range []*[]byte{&id.PublicKey, &id.NextPublicKey, &id.PrevPublicKey} {
+		if len(*pubKey) == 0 {
+			continue
+		}
+		*pubKey, err = alg.crypto.PublicKeyBytesToPEM(*pubKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Protocol) DeleteIdentity(tx interface{}, uid uuid.UUID) error {
+	err := p.ctxManager.DeleteIdentity(tx, uid)
+	if err != nil {
+		return err
+	}
+
+	p.markPubKeysChanged(tx)
+	return nil
+}
+
+func (p *Protocol) GetIdentitiesWithOtherKeyVersion(tx interface{}, keyVersion string, limit int) ([]Identity, error) {
+	return p.ctxManager.GetIdentitiesWithOtherKeyVersion(tx, keyVersion, limit)
+}
+
+func (p *Protocol) GetUuidsWithExpiredPrevKey(now time.Time) ([]uuid.UUID, error) {
+	return p.ctxManager.GetUuidsWithExpiredPrevKey(now)
+}
+
+// evictIdentity removes all cached data of the identity with the given UUID.
+// Must be called after the deletion of the identity was committed.
+func (p *Protocol) evictIdentity(uid uuid.UUID) {
+	p.identityCache.Delete(uid)
+	p.authCache.Delete(uid)
+
+	p.uidCache.Range(func(pub, cachedUid interface{}) bool {
+		if cachedUid == uid {
+			p.uidCache.Delete(pub)
+		}
+		return true
+	})
+
+	p.skidStoreMutex.Lock()
+	delete(p.skidStore, uid)
+	delete(p.prevSkidStore, uid)
+	p.skidStoreMutex.Unlock()
+}
+
+// removeIdentity deletes the identity with the given UUID from the store and evicts it from the caches
+func (p *Protocol) removeIdentity(uid uuid.UUID) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tx, err := p.StartTransaction(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = p.DeleteIdentity(tx, uid)
+	if err != nil {
+		return err
+	}
+
+	err = p.CloseTransaction(tx, Commit)
 	if err != nil {
 		return err
 	}
 
-	// store public key raw bytes
-	id.PublicKey, err = p.PublicKeyPEMToBytes(id.PublicKey)
+	p.evictIdentity(uid)
+
+	return nil
+}
+
+// activateNextKey completes a pending key rotation of the identity with the given UUID, after a certificate
+// with the given SKID was issued for the new public key. The new key pair replaces the active key pair,
+// which is kept inactive until the end of the key rotation grace period.
+func (p *Protocol) activateNextKey(uid uuid.UUID, pubKeyPEM []byte, skid []byte) error {
+	err := p.updateKeys(uid, func(id *Identity) error {
+		if !samePublicKey(id.NextPublicKey, pubKeyPEM) {
+			return fmt.Errorf("public key of certificate does not match pending key")
+		}
+
+		id.PrevPrivateKey, id.PrevPublicKey = id.PrivateKey, id.PublicKey
+		id.PrivateKey, id.PublicKey = id.NextPrivateKey, id.NextPublicKey
+		id.NextPrivateKey, id.NextPublicKey = nil, nil
+		id.PrevKeyExpiry = time.Now().UTC().Add(p.keyRotationGracePeriod)
+
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	return p.ctxManager.StoreNewIdentity(tx, id)
+	// switch the SKID before the new key is loaded into the identity cache
+	p.skidStoreMutex.Lock()
+	if prevSkid, found := p.skidStore[uid]; found {
+		p.prevSkidStore[uid] = prevSkid
+	}
+	p.skidStore[uid] = skid
+	p.skidStoreMutex.Unlock()
+
+	p.identityCache.Delete(uid)
+
+	infos := fmt.Sprintf("\"hwDeviceId\":\"%s\", \"skid\":\"%s\"", uid, base64.StdEncoding.EncodeToString(skid))
+	auditlogger.AuditLog("activate", "key", infos)
+
+	return nil
+}
+
+// discardPrevKey removes the replaced key pair of the identity with the given UUID,
+// if the key rotation grace period is over
+func (p *Protocol) discardPrevKey(uid uuid.UUID) error {
+	var algorithm string
+	var prevPrivKey []byte
+
+	err := p.updateKeys(uid, func(id *Identity) error {
+		if time.Now().Before(id.PrevKeyExpiry) {
+			return fmt.Errorf("key rotation grace period is not over yet")
+		}
+
+		algorithm, prevPrivKey = id.Algorithm, id.PrevPrivateKey
+		id.PrevPrivateKey, id.PrevPublicKey = nil, nil
+		id.PrevKeyExpiry = time.Time{}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.skidStoreMutex.Lock()
+	delete(p.prevSkidStore, uid)
+	p.skidStoreMutex.Unlock()
+
+	p.identityCache.Delete(uid)
+
+	destroyTokenKeys(algorithm, prevPrivKey)
+
+	return nil
+}
+
+// DiscardExpiredPrevKeys checks for replaced keys after the key rotation grace period in the regular
+// interval and discards them, until the context is cancelled. The check does not depend on the
+// public key certificate list, so replaced keys are discarded even if the list can not be loaded.
+func (p *Protocol) DiscardExpiredPrevKeys(ctx context.Context) {
+	ticker := time.NewTicker(prevKeyExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		p.discardExpiredPrevKeys(time.Now())
+
+		select {
+		case <-ctx.Done():
+			log.Debug("stopped checking for replaced keys after the key rotation grace period")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discardExpiredPrevKeys discards the replaced keys of all identities, the key rotation grace period of which is over
+func (p *Protocol) discardExpiredPrevKeys(now time.Time) {
+	uids, err := p.GetUuidsWithExpiredPrevKey(now)
+	if err != nil {
+		log.Errorf("unable to look up identities with replaced keys after the key rotation grace period: %v", err)
+		return
+	}
+
+	for _, uid := range uids {
+		err = p.discardPrevKey(uid)
+		if err != nil {
+			log.Errorf("%s: discarding replaced key failed: %v", uid, err)
+			continue
+		}
+		log.Infof("%s: key rotation grace period is over, discarded replaced key", uid)
+	}
+}
+
+// discardNextKey removes the pending key pair with the given public key from the identity with the given UUID,
+// e.g. if its registration at the ubirch backend failed, so that the key rotation can be retried
+func (p *Protocol) discardNextKey(uid uuid.UUID, nextPubKeyPEM []byte) error {
+	var algorithm string
+	var nextPrivKey []byte
+
+	err := p.updateKeys(uid, func(id *Identity) error {
+		if !samePublicKey(id.NextPublicKey, nextPubKeyPEM) {
+			return fmt.Errorf("pending key was already replaced")
+		}
+
+		algorithm, nextPrivKey = id.Algorithm, id.NextPrivateKey
+		id.NextPrivateKey, id.NextPublicKey = nil, nil
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.identityCache.Delete(uid)
+
+	destroyTokenKeys(algorithm, nextPrivKey)
+
+	return nil
+}
+
+// updateKeys applies the given update to the stored identity with the given UUID within a transaction.
+// The caller is responsible for removing the outdated identity from the cache.
+func (p *Protocol) updateKeys(uid uuid.UUID, update func(id *Identity) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tx, err := p.StartTransaction(ctx)
+	if err != nil {
+		return err
+	}
+
+	// read the identity within the transaction, so that concurrent updates of its keys are serialized
+	id, err := p.GetIdentityForUpdate(tx, uid)
+	if err != nil {
+		return err
+	}
+
+	pubKeys := [][]byte{id.PublicKey, id.NextPublicKey, id.PrevPublicKey}
+
+	err = update(id)
+	if err != nil {
+		return err
+	}
+
+	err = p.UpdateIdentity(tx, *id)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(pubKeys[0], id.PublicKey) || !bytes.Equal(pubKeys[1], id.NextPublicKey) || !bytes.Equal(pubKeys[2], id.PrevPublicKey) {
+		p.markPubKeysChanged(tx)
+	}
+
+	return p.CloseTransaction(tx, Commit)
+}
+
+// checkAuthToken checks if the auth token authorizes requests for the given identity. If the auth token of the
+// identity is still stored in plaintext, it is replaced by its hash after the first successful authentication.
+func (p *Protocol) checkAuthToken(id *Identity, authToken string) (bool, error) {
+	tokenDigest := sha256.Sum256([]byte(authToken))
+
+	_verified, found := p.authCache.Load(id.Uid)
+	if found {
+		verified, ok := _verified.(*verifiedAuthToken)
+		if ok && verified.storedHash == id.AuthToken {
+			return subtle.ConstantTimeCompare(verified.tokenDigest[:], tokenDigest[:]) == 1, nil
+		}
+	}
+
+	ok, err := verifyAuthToken(id.AuthToken, authToken)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if !isHashedAuthToken(id.AuthToken) {
+		p.hashStoredAuthToken(id.Uid, authToken)
+		return true, nil
+	}
+
+	p.authCache.Store(id.Uid, &verifiedAuthToken{storedHash: id.AuthToken, tokenDigest: tokenDigest})
+
+	return true, nil
+}
+
+// hashStoredAuthToken replaces the plaintext auth token of the stored identity with the given UUID by its hash,
+// unless the auth token was changed meanwhile. A failure is not fatal, since the auth token will be hashed after
+// the next successful authentication.
+func (p *Protocol) hashStoredAuthToken(uid uuid.UUID, authToken string) {
+	authTokenHash, err := hashAuthToken(authToken)
+	if err != nil {
+		log.Warnf("%s: unable to hash plaintext auth token: %v", uid, err)
+		return
+	}
+
+	err = p.updateKeys(uid, func(id *Identity) error {
+		if isHashedAuthToken(id.AuthToken) || !equalAuthTokens(id.AuthToken, authToken) {
+			return fmt.Errorf("auth token was changed")
+		}
+
+		id.AuthToken = authTokenHash
+		return nil
+	})
+	if err != nil {
+		log.Warnf("%s: unable to replace plaintext auth token by its hash: %v", uid, err)
+		return
+	}
+
+	p.identityCache.Delete(uid)
+
+	log.Infof("%s: replaced plaintext auth token by its hash", uid)
+}
+
+// updateAuthToken replaces the auth token of the identity with the given UUID
+func (p *Protocol) updateAuthToken(uid uuid.UUID, authToken string) error {
+	authTokenHash, err := hashAuthToken(authToken)
+	if err != nil {
+		return err
+	}
+
+	err = p.updateKeys(uid, func(id *Identity) error {
+		id.AuthToken = authTokenHash
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.identityCache.Delete(uid)
+	p.authCache.Delete(uid)
+
+	return nil
 }
 
 func (p *Protocol) GetIdentity(uid uuid.UUID) (id *Identity, err error) {
@@ -175,12 +625,21 @@ func (p *Protocol) fetchIdentityFromStorage(uid uuid.UUID) (id *Identity, err er
 		return nil, err
 	}
 
-	id.PrivateKey, err = p.keyEncrypter.Decrypt(id.PrivateKey)
+	return p.decodeIdentity(id)
+}
+
+// GetIdentityForUpdate reads the identity within the transaction and locks it against concurrent updates
+func (p *Protocol) GetIdentityForUpdate(tx interface{}, uid uuid.UUID) (*Identity, error) {
+	id, err := p.ctxManager.GetIdentityForUpdate(tx, uid)
 	if err != nil {
 		return nil, err
 	}
 
-	id.PublicKey, err = p.PublicKeyBytesToPEM(id.PublicKey)
+	return p.decodeIdentity(id)
+}
+
+func (p *Protocol) decodeIdentity(id *Identity) (*Identity, error) {
+	err := p.decodeKeys(id)
 	if err != nil {
 		return nil, err
 	}
@@ -193,8 +652,38 @@ func (p *Protocol) fetchIdentityFromStorage(uid uuid.UUID) (id *Identity, err er
 	return id, nil
 }
 
+// getKeyEncrypter returns a key encrypter for private keys of the given algorithm
+func (p *Protocol) getKeyEncrypter(alg *signingAlgorithm) *encrypters.KeyEncrypter {
+	return &encrypters.KeyEncrypter{
+		Secret: p.keyEncrypter.Secret,
+		Crypto: alg.crypto,
+	}
+}
+
+// decryptionSecrets returns the secrets, which may have been used for the encryption of private keys with the given
+// key version. If the key version is unknown, because the keys were stored before key versions were recorded, all
+// configured secrets are returned.
+func (p *Protocol) decryptionSecrets(keyVersion string) ([][]byte, error) {
+	secrets := [][]byte{p.keyEncrypter.Secret}
+	if len(p.prevSecret) != 0 {
+		secrets = append(secrets, p.prevSecret)
+	}
+
+	if keyVersion == "" {
+		return secrets, nil
+	}
+
+	for _, secret := range secrets {
+		if secretKeyVersion(secret) == keyVersion {
+			return [][]byte{secret}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no secret configured for key version %s", keyVersion)
+}
+
 func (p *Protocol) GetUuidForPublicKey(publicKeyPEM []byte) (uid uuid.UUID, err error) {
-	publicKeyBytes, err := p.PublicKeyPEMToBytes(publicKeyPEM)
+	publicKeyBytes, err := decodePublicKeyBytes(publicKeyPEM)
 	if err != nil {
 		return uuid.Nil, err
 	}
@@ -219,6 +708,76 @@ func (p *Protocol) GetUuidForPublicKey(publicKeyPEM []byte) (uid uuid.UUID, err
 	return uid, nil
 }
 
+// GetUuidsForPublicKeys returns the UUIDs of the identities with the given PEM encoded public keys, mapped by the
+// public key. Public keys, which are not in the cache, are looked up in the storage with a single query.
+func (p *Protocol) GetUuidsForPublicKeys(publicKeysPEM [][]byte) (map[string]uuid.UUID, error) {
+	uids := map[string]uuid.UUID{}
+
+	var lookup [][]byte
+	lookupPEM := map[string][]byte{}
+
+	for _, publicKeyPEM := range publicKeysPEM {
+		publicKeyBytes, err := decodePublicKeyBytes(publicKeyPEM)
+		if err != nil {
+			return nil, err
+		}
+
+		_uid, found := p.uidCache.Load(base64.StdEncoding.EncodeToString(publicKeyBytes))
+		if found {
+			if uid, ok := _uid.(uuid.UUID); ok {
+				uids[string(publicKeyPEM)] = uid
+				continue
+			}
+		}
+
+		if _, pending := lookupPEM[string(publicKeyBytes)]; !pending {
+			lookup = append(lookup, publicKeyBytes)
+		}
+		lookupPEM[string(publicKeyBytes)] = publicKeyPEM
+	}
+
+	if len(lookup) == 0 {
+		return uids, nil
+	}
+
+	var found map[string]uuid.UUID
+	var err error
+
+	for i := 0; i < maxDbConnAttempts; i++ {
+		found, err = p.ctxManager.GetUuidsForPublicKeys(lookup)
+		if err != nil && isConnectionNotAvailable(err) {
+			log.Debugf("GetUuidsForPublicKeys connectionNotAvailable (%d of %d): %s", i+1, maxDbConnAttempts, err.Error())
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for publicKeyBytes, uid := range found {
+		p.uidCache.Store(base64.StdEncoding.EncodeToString([]byte(publicKeyBytes)), uid)
+		uids[string(lookupPEM[publicKeyBytes])] = uid
+	}
+
+	return uids, nil
+}
+
+// decodePublicKeyBytes returns the raw public key bytes of a PEM encoded public key, as they are stored
+func decodePublicKeyBytes(publicKeyPEM []byte) ([]byte, error) {
+	pub, err := decodePKIXPublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := lookupAlgorithmForPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return alg.crypto.PublicKeyPEMToBytes(publicKeyPEM)
+}
+
 func (p *Protocol) fetchUuidForPublicKeyFromStorage(publicKeyBytes []byte) (uid uuid.UUID, err error) {
 	for i := 0; i < maxDbConnAttempts; i++ {
 		uid, err = p.ctxManager.GetUuidForPublicKey(publicKeyBytes)
@@ -275,76 +834,251 @@ func (p *Protocol) GetSKID(uid uuid.UUID) ([]byte, error) {
 	return skid, nil
 }
 
-func (p *Protocol) setSkidStore(newSkidStore map[uuid.UUID][]byte) {
+// GetUuidForSKID returns the UUID of the identity whose public key certificate has the given SKID
+func (p *Protocol) GetUuidForSKID(skid []byte) (uuid.UUID, error) {
+	p.skidStoreMutex.RLock()
+	defer p.skidStoreMutex.RUnlock()
+
+	for uid, s := range p.skidStore {
+		if bytes.Equal(s, skid) {
+			return uid, nil
+		}
+	}
+
+	// the SKID might belong to a key which was replaced within the key rotation grace period
+	for uid, s := range p.prevSkidStore {
+		if bytes.Equal(s, skid) {
+			return uid, nil
+		}
+	}
+
+	return uuid.Nil, fmt.Errorf("unknown SKID: %x", skid)
+}
+
+func (p *Protocol) setSkidStore(newSkidStore, newPrevSkidStore map[uuid.UUID][]byte) {
 	p.skidStoreMutex.Lock()
 	p.skidStore = newSkidStore
+	p.prevSkidStore = newPrevSkidStore
 	p.skidStoreMutex.Unlock()
 }
 
-func (p *Protocol) loadSKIDs() {
-	certs, err := p.RequestCertificateList(p.Verify)
+// TrustListVerifiedAt returns the time of the verification of the public key certificate list in use.
+// Returns false, if no certificate list was loaded yet.
+func (p *Protocol) TrustListVerifiedAt() (time.Time, bool) {
+	p.skidStoreMutex.RLock()
+	defer p.skidStoreMutex.RUnlock()
+
+	return p.trustListVerifiedAt, !p.trustListVerifiedAt.IsZero()
+}
+
+// SKIDCount returns the number of identities with a known SKID
+func (p *Protocol) SKIDCount() int {
+	p.skidStoreMutex.RLock()
+	defer p.skidStoreMutex.RUnlock()
+
+	return len(p.skidStore)
+}
+
+func (p *Protocol) setTrustListVerifiedAt(verifiedAt time.Time) {
+	p.skidStoreMutex.Lock()
+	p.trustListVerifiedAt = verifiedAt
+	p.skidStoreMutex.Unlock()
+}
+
+// loadPersistedSKIDs loads the SKIDs from the public key certificate list,
+// which was persisted after its last successful verification
+func (p *Protocol) loadPersistedSKIDs() {
+	if p.trustListFile == "" {
+		return
+	}
+
+	trustList := &VerifiedTrustList{}
+	err := loadFile(p.trustListFile, trustList)
 	if err != nil {
-		log.Error(err)
+		log.Warnf("unable to load persisted public key certificate list: %v", err)
+		return
+	}
+	if len(trustList.SignedList) == 0 {
+		return
+	}
 
-		p.certLoadFailCounter++
-		log.Debugf("loading certificate list failed %d times,"+
-			" clearing local KID lookup after %d failed attempts",
-			p.certLoadFailCounter, maxCertLoadFailCount)
+	// make sure the persisted certificate list was not altered. The public key for the verification is not
+	// persisted in the list file, so that whoever is able to write the file can not forge the list. The key is
+	// read without a request to the certificate server, so that the list is available while the server is not.
+	// Without the key, the persisted list is dropped.
+	pubKeyPEM, err := p.persistedTrustListPublicKey()
+	if err != nil {
+		log.Warnf("dropping persisted public key certificate list: %v", err)
+		return
+	}
 
-		// if we have not yet reached the maximum amount of failed attempts to load the certificate list,
-		// return and try again later
-		if p.certLoadFailCounter != maxCertLoadFailCount {
-			return
+	trustList.Certificates, err = VerifyCertificateList(trustList.SignedList, pubKeyPEM, p.Verify)
+	if err != nil {
+		log.Warnf("persisted public key certificate list: %v", err)
+		return
+	}
+
+	generation := p.certMatchGeneration()
+	skidStore := p.updateSKIDs(trustList.Certificates)
+	p.setCertListProcessed(trustList.SignedList, generation)
+	p.setTrustListVerifiedAt(trustList.VerifiedAt)
+
+	skids, _ := json.Marshal(skidStore)
+	log.Infof("loaded %d matching certificates from persisted certificate list (verified at %s): %s",
+		len(skidStore), trustList.VerifiedAt.Format(time.RFC3339), skids)
+}
+
+// persistTrustList persists the verified public key certificate list and, if the list was retrieved from
+// the certificate server, the public key for its verification in a separate file next to the list
+func (p *Protocol) persistTrustList(trustList *VerifiedTrustList) error {
+	if p.CertificateListFile == "" {
+		keyFile := p.trustListKeyFile()
+		err := writeFileSync(keyFile+".tmp", trustList.PublicKey, filePerm)
+		if err != nil {
+			return fmt.Errorf("unable to persist public key for certificate list verification: %v", err)
+		}
+		err = os.Rename(keyFile+".tmp", keyFile)
+		if err != nil {
+			return fmt.Errorf("unable to persist public key for certificate list verification: %v", err)
+		}
+	}
+
+	return persistFile(p.trustListFile, trustList)
+}
+
+// persistedTrustListPublicKey returns the public key for the verification of the persisted certificate list,
+// i.e. the key from the local key file, if the certificate list is loaded from a local file, or else the key
+// which was persisted with the list after its verification
+func (p *Protocol) persistedTrustListPublicKey() ([]byte, error) {
+	if p.CertificateListFile != "" {
+		return p.ReadCertificateListKeyFile()
+	}
+
+	pubKeyPEM, err := ioutil.ReadFile(p.trustListKeyFile())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read persisted public key for certificate list verification: %v", err)
+	}
+
+	return pubKeyPEM, nil
+}
+
+// trustListKeyFile returns the file where the public key for the verification
+// of the persisted certificate list is persisted
+func (p *Protocol) trustListKeyFile() string {
+	return filepath.Join(filepath.Dir(p.trustListFile), trustListKeyFileName)
+}
+
+// loadSKIDs loads the public key certificate list and updates the SKID store
+func (p *Protocol) loadSKIDs() error {
+	trustList, err := p.RequestCertificateList(p.Verify)
+	if err != nil {
+		return err
+	}
+
+	p.setTrustListVerifiedAt(trustList.VerifiedAt)
+
+	if p.trustListFile != "" {
+		err = p.persistTrustList(trustList)
+		if err != nil {
+			log.Warnf("unable to persist public key certificate list: %v", err)
 		}
+	}
 
-		// if we have reached the maximum amount of failed attempts to load the certificate list,
-		// clear the SKID lookup
-		log.Warnf("clearing local KID lookup after %d failed attempts to load public key certificate list",
-			p.certLoadFailCounter)
-	} else {
-		// reset fail counter if certs were loaded successfully
-		p.certLoadFailCounter = 0
+	// skip matching the certificates, if the list did not change since it was processed
+	if p.certListUnchanged(trustList.SignedList) {
+		log.Debugf("public key certificate list from %s is unchanged", p.CertificateListSource())
+		return nil
 	}
 
+	generation := p.certMatchGeneration()
+	tempSkidStore := p.updateSKIDs(trustList.Certificates)
+	p.setCertListProcessed(trustList.SignedList, generation)
+
+	skids, _ := json.Marshal(tempSkidStore)
+	log.Infof("loaded %d matching certificates from %s: %s", len(tempSkidStore), p.CertificateListSource(), skids)
+	return nil
+}
+
+// updateSKIDs replaces the SKID store with the SKIDs of the valid certificates which
+// match the public keys of known identities and returns the new SKID store
+func (p *Protocol) updateSKIDs(certs []Certificate) map[uuid.UUID][]byte {
 	tempSkidStore := map[uuid.UUID][]byte{}
+	tempPrevSkidStore := map[uuid.UUID][]byte{}
+	certExpiry := map[uuid.UUID]time.Time{}
 
-	// go through certificate list and match known public keys
-	for _, cert := range certs {
+	// the SKIDs need to be updated again, as soon as the validity of a certificate or a replaced key changes
+	now := time.Now()
+	validUntil := time.Time{}
+
+	// go through the certificates which match known public keys
+	for _, cert := range p.matchCertificates(certs) {
 		kid := base64.StdEncoding.EncodeToString(cert.Kid)
+		uid := cert.uid
+		pubKeyPEM := cert.pubKeyPEM
 
-		// get public key from certificate
-		certificate, err := x509.ParseCertificate(cert.RawData)
-		if err != nil {
-			log.Errorf("%s: %v", kid, err)
+		if len(cert.Kid) != SkidLen {
+			log.Errorf("invalid KID length: expected %d, got %d", SkidLen, len(kid))
 			continue
 		}
 
-		pubKeyPEM, err := p.Crypto.EncodePublicKey(certificate.PublicKey)
+		validUntil = earliestFuture(now, validUntil, cert.notBefore, cert.notAfter, cert.notAfter.Add(-p.certFilter.ExpiryWarning))
+
+		err := checkValidity(cert.notBefore, cert.notAfter, now)
 		if err != nil {
-			//log.Debugf("%s: unable to encode public key: %v", kid, err)
+			log.Warnf("%s: skipping public key certificate with SKID %s: %v", uid, kid, err)
 			continue
 		}
 
-		// look up matching UUID for public key
-		uid, err := p.GetUuidForPublicKey(pubKeyPEM)
+		identity, err := p.GetIdentity(uid)
 		if err != nil {
-			if err != ErrNotExist {
-				log.Errorf("%s: %v", kid, err)
-			}
+			log.Errorf("%s: %v", uid, err)
 			continue
 		}
-		//log.Debugf("%s: public key certificate match", kid)
 
-		if len(cert.Kid) != SkidLen {
-			log.Errorf("invalid KID length: expected %d, got %d", SkidLen, len(kid))
-			continue
+		if len(identity.PrevPublicKey) != 0 {
+			validUntil = earliestFuture(now, validUntil, identity.PrevKeyExpiry)
 		}
 
-		tempSkidStore[uid] = cert.Kid
+		switch {
+		case samePublicKey(pubKeyPEM, identity.NextPublicKey):
+			// the certificate for the new key of a pending key rotation is available
+			err = p.activateNextKey(uid, pubKeyPEM, cert.Kid)
+			if err != nil {
+				log.Errorf("%s: activating new key failed: %v", uid, err)
+				continue
+			}
+			log.Infof("%s: key rotation completed, new key is active (SKID %s)", uid, kid)
+
+			if prevSkid, found := tempSkidStore[uid]; found {
+				tempPrevSkidStore[uid] = prevSkid
+			}
+			tempSkidStore[uid] = cert.Kid
+			certExpiry[uid] = cert.notAfter
+		case samePublicKey(pubKeyPEM, identity.PublicKey):
+			tempSkidStore[uid] = cert.Kid
+			certExpiry[uid] = cert.notAfter
+		case samePublicKey(pubKeyPEM, identity.PrevPublicKey) && now.Before(identity.PrevKeyExpiry):
+			tempPrevSkidStore[uid] = cert.Kid
+		}
 	}
 
-	p.setSkidStore(tempSkidStore)
+	p.setSkidStore(tempSkidStore, tempPrevSkidStore)
+	p.setCertMatchesValidUntil(validUntil)
+	p.checkCertExpiry(certExpiry)
 
-	skids, _ := json.Marshal(tempSkidStore)
-	log.Infof("loaded %d matching certificates from server: %s", len(tempSkidStore), skids)
+	return tempSkidStore
+}
+
+// checkCertExpiry exposes the expiry of the certificates in use and
+// warns about certificates, which expire within the configured period
+func (p *Protocol) checkCertExpiry(certExpiry map[uuid.UUID]time.Time) {
+	CertificateExpiry.Reset()
+
+	for uid, notAfter := range certExpiry {
+		CertificateExpiry.WithLabelValues(uid.String()).Set(float64(notAfter.Unix()))
+
+		if time.Until(notAfter) < p.certFilter.ExpiryWarning {
+			log.Warnf("%s: public key certificate expires at %s", uid, notAfter.Format(time.RFC3339))
+		}
+	}
 }
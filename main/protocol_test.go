@@ -3,12 +3,28 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/ubirch/ubirch-client-go/main/adapters/encrypters"
 	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestProtocol(t *testing.T) {
@@ -24,11 +40,12 @@ func TestProtocol(t *testing.T) {
 
 	p := &Protocol{
 		Crypto:       crypto,
-		ctxManager:   &mockCtxMngr{},
+		ctxManager:   NewMemoryContextManager(),
 		keyEncrypter: enc,
 
 		identityCache: &sync.Map{},
 		uidCache:      &sync.Map{},
+		authCache:     &sync.Map{},
 	}
 
 	privKeyPEM, err := p.GenerateKey()
@@ -62,10 +79,10 @@ func TestProtocol(t *testing.T) {
 		t.Error("Exists returned TRUE")
 	}
 
-	err = p.StoreNewIdentity(nil, testIdentity)
-	if err != nil {
-		t.Fatal(err)
-	}
+	// the auth token of a new identity is hashed by the caller
+	storedTestIdentity := testIdentity
+	storedTestIdentity.AuthToken = hashTestAuthToken(t, testIdentity.AuthToken)
+	storeAndCommit(t, p, &storedTestIdentity)
 
 	// check exists
 	exists, err = p.Exists(testIdentity.Uid)
@@ -87,7 +104,14 @@ func TestProtocol(t *testing.T) {
 	if !bytes.Equal(storedIdentity.PublicKey, testIdentity.PublicKey) {
 		t.Error("GetIdentity returned unexpected PublicKey value")
 	}
-	if storedIdentity.AuthToken != testIdentity.AuthToken {
+	if !isHashedAuthToken(storedIdentity.AuthToken) {
+		t.Error("auth token was not stored as hash")
+	}
+	ok, err := p.checkAuthToken(storedIdentity, testIdentity.AuthToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
 		t.Error("GetIdentity returned unexpected AuthToken value")
 	}
 	if !bytes.Equal(storedIdentity.Uid[:], testIdentity.Uid[:]) {
@@ -96,13 +120,11 @@ func TestProtocol(t *testing.T) {
 }
 
 func TestProtocolLoad(t *testing.T) {
-	wg := &sync.WaitGroup{}
+	runForEachBackend(t, testProtocolLoad)
+}
 
-	dm, err := initDB()
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer cleanUp(t, dm)
+func testProtocolLoad(t *testing.T, dm ContextManager) {
+	wg := &sync.WaitGroup{}
 
 	crypto := &ubirch.ECDSACryptoContext{}
 
@@ -121,6 +143,7 @@ func TestProtocolLoad(t *testing.T) {
 
 		identityCache: &sync.Map{},
 		uidCache:      &sync.Map{},
+		authCache:     &sync.Map{},
 	}
 
 	// generate identities
@@ -145,7 +168,15 @@ func TestProtocolLoad(t *testing.T) {
 	for i, testId := range testIdentities {
 		wg.Add(1)
 		go func(idx int, identity *Identity) {
-			err := storeIdentity(p, identity, wg)
+			// the auth token is hashed before the transaction is started, like for new identities
+			storedIdentity := *identity
+			authTokenHash, err := hashAuthToken(identity.AuthToken)
+			if err != nil {
+				t.Error(err)
+			}
+			storedIdentity.AuthToken = authTokenHash
+
+			err = storeIdentity(p, &storedIdentity, wg)
 			if err != nil {
 				t.Errorf("%s: identity could not be stored: %v", identity.Uid, err)
 			}
@@ -166,40 +197,737 @@ func TestProtocolLoad(t *testing.T) {
 	wg.Wait()
 }
 
-type mockCtxMngr struct {
-	id Identity
+func TestPersistedTrustList(t *testing.T) {
+	idHandler, _ := setupIdentityHandler(t, "")
+	p := idHandler.protocol
+
+	id, err := p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedList, listPubKeyPEM := createTrustList(t, listPrivKeyPEM, createTestCertificate(t, id.PrivateKey, skid))
+
+	trustList := &VerifiedTrustList{
+		SignedList: signedList,
+		VerifiedAt: time.Now().UTC().Add(-time.Hour).Truncate(time.Second),
+	}
+
+	// the persisted list is verified with the configured public key
+	dir := t.TempDir()
+	p.CertificateListFile = filepath.Join(dir, "certificate_list")
+	p.CertificateListKeyFile = filepath.Join(dir, "certificate_list_key.pem")
+	writeTestFile(t, p.CertificateListKeyFile, listPubKeyPEM)
+
+	p.trustListFile = filepath.Join(dir, trustListFileName)
+	err = persistFile(p.trustListFile, trustList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.setSkidStore(map[uuid.UUID][]byte{}, map[uuid.UUID][]byte{})
+	p.loadPersistedSKIDs()
+
+	loadedSkid, err := p.GetSKID(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loadedSkid, skid) {
+		t.Errorf("unexpected SKID from persisted certificate list: %x", loadedSkid)
+	}
+
+	verifiedAt, ok := p.TrustListVerifiedAt()
+	if !ok || !verifiedAt.Equal(trustList.VerifiedAt) {
+		t.Errorf("unexpected verification time of persisted certificate list: %s", verifiedAt)
+	}
+
+	// a persisted certificate list with invalid signature must not be loaded
+	trustList.SignedList = append(trustList.SignedList, ' ')
+	err = persistFile(p.trustListFile, trustList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.setSkidStore(map[uuid.UUID][]byte{}, map[uuid.UUID][]byte{})
+	p.loadPersistedSKIDs()
+
+	_, err = p.GetSKID(uid)
+	if err == nil {
+		t.Error("SKID was loaded from altered certificate list")
+	}
+
+	// a persisted certificate list, which was signed with another key, must not be loaded,
+	// even if the file contains the public key for its verification
+	otherPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherSignedList, otherPubKeyPEM := createTrustList(t, otherPrivKeyPEM, createTestCertificate(t, id.PrivateKey, skid))
+
+	forgedTrustList, err := json.Marshal(map[string]interface{}{
+		"signedList": otherSignedList,
+		"publicKey":  otherPubKeyPEM,
+		"verifiedAt": trustList.VerifiedAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, p.trustListFile, forgedTrustList)
+
+	p.setSkidStore(map[uuid.UUID][]byte{}, map[uuid.UUID][]byte{})
+	p.loadPersistedSKIDs()
+
+	_, err = p.GetSKID(uid)
+	if err == nil {
+		t.Error("SKID was loaded from certificate list with foreign signature")
+	}
+
+	// without the configured public key, the persisted certificate list is dropped
+	trustList.SignedList = signedList
+	err = persistFile(p.trustListFile, trustList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(p.CertificateListKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.setSkidStore(map[uuid.UUID][]byte{}, map[uuid.UUID][]byte{})
+	p.loadPersistedSKIDs()
+
+	_, err = p.GetSKID(uid)
+	if err == nil {
+		t.Error("SKID was loaded from certificate list without configured public key")
+	}
+}
+
+func TestPersistedTrustListServerUnreachable(t *testing.T) {
+	idHandler, _ := setupIdentityHandler(t, "")
+	p := idHandler.protocol
+
+	id, err := p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedList, listPubKeyPEM := createTrustList(t, listPrivKeyPEM, createTestCertificate(t, id.PrivateKey, skid))
+
+	// the certificate list was retrieved from the certificate server and verified before the restart
+	trustList := &VerifiedTrustList{
+		SignedList: signedList,
+		PublicKey:  listPubKeyPEM,
+		VerifiedAt: time.Now().UTC().Add(-time.Hour).Truncate(time.Second),
+	}
+
+	p.CertificateListFile = ""
+	p.trustListFile = filepath.Join(t.TempDir(), trustListFileName)
+
+	err = p.persistTrustList(trustList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate server is unreachable on startup
+	p.CertificateServerURL = "https://127.0.0.1:1/v1/trustList"
+	p.CertificateServerPubKeyURL = "https://127.0.0.1:1/v1/pubkey"
+	p.ServerTLSCertFingerprints = map[string][32]byte{"127.0.0.1:1": {}}
+
+	err = p.loadSKIDs()
+	if err == nil {
+		t.Fatal("certificate list was loaded from unreachable certificate server")
+	}
+
+	p.setSkidStore(map[uuid.UUID][]byte{}, map[uuid.UUID][]byte{})
+	p.loadPersistedSKIDs()
+
+	loadedSkid, err := p.GetSKID(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loadedSkid, skid) {
+		t.Errorf("unexpected SKID from persisted certificate list: %x", loadedSkid)
+	}
+
+	// a persisted certificate list, which does not match the persisted public key, must not be loaded
+	otherPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherPubKeyPEM := createTrustList(t, otherPrivKeyPEM)
+	writeTestFile(t, p.trustListKeyFile(), otherPubKeyPEM)
+
+	p.setSkidStore(map[uuid.UUID][]byte{}, map[uuid.UUID][]byte{})
+	p.loadPersistedSKIDs()
+
+	_, err = p.GetSKID(uid)
+	if err == nil {
+		t.Error("SKID was loaded from certificate list with foreign signature")
+	}
+}
+
+func TestCertificateListFile(t *testing.T) {
+	idHandler, _ := setupIdentityHandler(t, "")
+	p := idHandler.protocol
+
+	id, err := p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedList, listPubKeyPEM := createTrustList(t, listPrivKeyPEM, createTestCertificate(t, id.PrivateKey, skid))
+
+	dir := t.TempDir()
+	p.CertificateListFile = filepath.Join(dir, "certificate_list")
+	p.CertificateListKeyFile = filepath.Join(dir, "certificate_list_key.pem")
+	p.trustListFile = filepath.Join(dir, trustListFileName)
+
+	writeTestFile(t, p.CertificateListFile, signedList)
+	writeTestFile(t, p.CertificateListKeyFile, listPubKeyPEM)
+
+	p.setSkidStore(map[uuid.UUID][]byte{}, map[uuid.UUID][]byte{})
+
+	err = p.loadSKIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedSkid, err := p.GetSKID(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loadedSkid, skid) {
+		t.Errorf("unexpected SKID from certificate list file: %x", loadedSkid)
+	}
+
+	if _, ok := p.TrustListVerifiedAt(); !ok {
+		t.Error("verification time of certificate list file was not set")
+	}
+
+	// the certificate list from the file is persisted like a list from the server
+	trustList := &VerifiedTrustList{}
+	err = loadFile(p.trustListFile, trustList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(trustList.SignedList, signedList) {
+		t.Error("certificate list file was not persisted")
+	}
+	if len(trustList.PublicKey) != 0 {
+		t.Error("public key for the certificate list verification was persisted")
+	}
+
+	// a certificate list file with invalid signature must not be loaded
+	writeTestFile(t, p.CertificateListFile, append(signedList, ' '))
+
+	_, err = p.RequestCertificateList(p.Verify)
+	if err == nil {
+		t.Error("certificate list file with invalid signature was accepted")
+	}
+
+	// a certificate list file, which was signed with another key, must not be loaded
+	otherPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSignedList, _ := createTrustList(t, otherPrivKeyPEM, createTestCertificate(t, id.PrivateKey, skid))
+	writeTestFile(t, p.CertificateListFile, otherSignedList)
+
+	_, err = p.RequestCertificateList(p.Verify)
+	if err == nil {
+		t.Error("certificate list file with signature of unknown key was accepted")
+	}
+
+	// the public key for the verification is mandatory
+	writeTestFile(t, p.CertificateListFile, signedList)
+	p.CertificateListKeyFile = filepath.Join(dir, "missing.pem")
+
+	_, err = p.RequestCertificateList(p.Verify)
+	if err == nil {
+		t.Error("certificate list file was accepted without public key file")
+	}
+}
+
+func TestUpdateSKIDs_CertificateValidation(t *testing.T) {
+	idHandler, _ := setupIdentityHandler(t, "")
+	p := idHandler.protocol
+
+	id, err := p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	validCert := createTestCertificate(t, id.PrivateKey, skid)
+
+	expiredCert := createTestCertificateWithValidity(t, id.PrivateKey, []byte("expired!"), now.Add(-2*time.Hour), now.Add(-time.Hour))
+	notYetValidCert := createTestCertificateWithValidity(t, id.PrivateKey, []byte("upcoming"), now.Add(time.Hour), now.Add(2*time.Hour))
+
+	otherTypeCert := createTestCertificate(t, id.PrivateKey, []byte("othertyp"))
+	otherTypeCert.CertificateType = "CSCA"
+
+	otherCountryCert := createTestCertificate(t, id.PrivateKey, []byte("othercty"))
+	otherCountryCert.Country = "FR"
+
+	p.certFilter = CertificateFilter{
+		Types:     []string{"DSC"},
+		Countries: []string{"de"},
+	}
+
+	testCases := []struct {
+		name         string
+		cert         Certificate
+		expectedSkid []byte
+	}{
+		{name: "valid", cert: validCert, expectedSkid: skid},
+		{name: "expired", cert: expiredCert},
+		{name: "not yet valid", cert: notYetValidCert},
+		{name: "other type", cert: otherTypeCert},
+		{name: "other country", cert: otherCountryCert},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			skidStore := p.updateSKIDs([]Certificate{validCert, c.cert})
+
+			if !bytes.Equal(skidStore[uid], skid) {
+				t.Errorf("unexpected SKID: %x", skidStore[uid])
+			}
+		})
+	}
+
+	// the last matching certificate is used, if it is valid
+	newSkid := []byte("newskid!")
+	newCert := createTestCertificateWithValidity(t, id.PrivateKey, newSkid, now.Add(-time.Hour), now.Add(24*time.Hour))
+
+	skidStore := p.updateSKIDs([]Certificate{validCert, newCert})
+	if !bytes.Equal(skidStore[uid], newSkid) {
+		t.Errorf("unexpected SKID: %x", skidStore[uid])
+	}
+
+	expiry := testutil.ToFloat64(CertificateExpiry.WithLabelValues(uid.String()))
+	if int64(expiry) != now.Add(24*time.Hour).Unix() {
+		t.Errorf("unexpected certificate expiry metric: %f", expiry)
+	}
+
+	// without any valid certificate, the identity has no SKID and no certificate expiry
+	skidStore = p.updateSKIDs([]Certificate{expiredCert})
+	if _, found := skidStore[uid]; found {
+		t.Error("SKID of expired certificate was loaded")
+	}
+
+	if testutil.CollectAndCount(CertificateExpiry) != 0 {
+		t.Error("certificate expiry metric was not removed")
+	}
+}
+
+// lookupCountingContextManager counts the public key lookups of the wrapped context manager
+type lookupCountingContextManager struct {
+	ContextManager
+	lookups    int
+	lookupKeys int
 }
 
-var _ ContextManager = (*mockCtxMngr)(nil)
+func (c *lookupCountingContextManager) GetUuidForPublicKey(pubKey []byte) (uuid.UUID, error) {
+	c.lookups++
+	c.lookupKeys++
+	return c.ContextManager.GetUuidForPublicKey(pubKey)
+}
 
-func (m *mockCtxMngr) StoreNewIdentity(tx interface{}, id Identity) error {
-	m.id = id
-	return nil
+func (c *lookupCountingContextManager) GetUuidsForPublicKeys(pubKeys [][]byte) (map[string]uuid.UUID, error) {
+	c.lookups++
+	c.lookupKeys += len(pubKeys)
+	return c.ContextManager.GetUuidsForPublicKeys(pubKeys)
 }
 
-func (m *mockCtxMngr) GetIdentity(uid uuid.UUID) (*Identity, error) {
-	if m.id.Uid == uuid.Nil {
-		return nil, ErrNotExist
+func TestIncrementalSKIDMatching(t *testing.T) {
+	idHandler, _ := setupIdentityHandler(t, "")
+	p := idHandler.protocol
+
+	counter := &lookupCountingContextManager{ContextManager: p.ctxManager}
+	p.ctxManager = counter
+
+	id, err := p.GetIdentity(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// certificates of other public keys
+	var certs []Certificate
+	for i := 0; i < 10; i++ {
+		otherPrivKeyPEM, err := p.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, createTestCertificate(t, otherPrivKeyPEM, []byte(fmt.Sprintf("other%03d", i))))
+	}
+	certs = append(certs, createTestCertificate(t, id.PrivateKey, skid))
+
+	listPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	p.CertificateListFile = filepath.Join(dir, "certificate_list")
+	p.CertificateListKeyFile = filepath.Join(dir, "certificate_list_key.pem")
+
+	writeCertificateList := func(certs ...Certificate) {
+		signedList, listPubKeyPEM := createTrustList(t, listPrivKeyPEM, certs...)
+		writeTestFile(t, p.CertificateListFile, signedList)
+		writeTestFile(t, p.CertificateListKeyFile, listPubKeyPEM)
+	}
+
+	loadAndCheck := func(expectedLookups, expectedLookupKeys int) {
+		t.Helper()
+
+		counter.lookups, counter.lookupKeys = 0, 0
+
+		err := p.loadSKIDs()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if counter.lookups != expectedLookups || counter.lookupKeys != expectedLookupKeys {
+			t.Errorf("unexpected public key lookups: %d queries for %d keys, expected %d queries for %d keys",
+				counter.lookups, counter.lookupKeys, expectedLookups, expectedLookupKeys)
+		}
+
+		loadedSkid, err := p.GetSKID(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(loadedSkid, skid) {
+			t.Errorf("unexpected SKID: %x", loadedSkid)
+		}
 	}
-	return &m.id, nil
+
+	// the public keys of all certificates are looked up with a single query
+	writeCertificateList(certs...)
+	loadAndCheck(1, len(certs))
+
+	// an unchanged list is not processed again
+	loadAndCheck(0, 0)
+
+	// only the public keys of new certificates are looked up
+	newPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCertificateList(append(certs, createTestCertificate(t, newPrivKeyPEM, []byte("newcert!")))...)
+	loadAndCheck(1, 1)
+
+	// removing certificates does not require any lookups
+	writeCertificateList(certs[5:]...)
+	loadAndCheck(0, 0)
+
+	// all public keys are looked up again after the identities changed,
+	// except for the public key of the identity, which is cached
+	p.invalidateCertMatches()
+	loadAndCheck(1, len(certs[5:])-1)
 }
 
-func (m *mockCtxMngr) StartTransaction(ctx context.Context) (transactionCtx interface{}, err error) {
-	panic("implement me")
+func TestCertMatchInvalidationAfterCommit(t *testing.T) {
+	idHandler, _ := setupIdentityHandler(t, "")
+	p := idHandler.protocol
+
+	newPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPubKeyPEM, err := p.GetPublicKeyFromPrivateKey(newPrivKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate for the public key of the new identity is already in the list
+	newSkid := []byte("newcert!")
+	signedList, listPubKeyPEM := createTrustList(t, listPrivKeyPEM, createTestCertificate(t, newPrivKeyPEM, newSkid))
+
+	dir := t.TempDir()
+	p.CertificateListFile = filepath.Join(dir, "certificate_list")
+	p.CertificateListKeyFile = filepath.Join(dir, "certificate_list_key.pem")
+	writeTestFile(t, p.CertificateListFile, signedList)
+	writeTestFile(t, p.CertificateListKeyFile, listPubKeyPEM)
+
+	err = p.loadSKIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tx, err := p.StartTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newUid := uuid.New()
+	err = p.StoreNewIdentity(tx, Identity{
+		Uid:        newUid,
+		PrivateKey: newPrivKeyPEM,
+		PublicKey:  newPubKeyPEM,
+		AuthToken:  hashTestAuthToken(t, "password1234"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a reload before the commit does not see the new identity and must not
+	// prevent that the certificate is matched after the commit
+	err = p.loadSKIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.CloseTransaction(tx, Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.loadSKIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadedSkid, err := p.GetSKID(newUid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loadedSkid, newSkid) {
+		t.Errorf("unexpected SKID: %x", loadedSkid)
+	}
 }
 
-func (m *mockCtxMngr) CloseTransaction(transactionCtx interface{}, commit bool) error {
-	panic("implement me")
+func TestCertMatchInvalidationOnPublicKeyChange(t *testing.T) {
+	idHandler, _ := setupIdentityHandler(t, "")
+	p := idHandler.protocol
+
+	privKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listPrivKeyPEM, err := p.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedList, listPubKeyPEM := createTrustList(t, listPrivKeyPEM, createTestCertificate(t, privKeyPEM, []byte("certskid")))
+
+	dir := t.TempDir()
+	p.CertificateListFile = filepath.Join(dir, "certificate_list")
+	p.CertificateListKeyFile = filepath.Join(dir, "certificate_list_key.pem")
+	writeTestFile(t, p.CertificateListFile, signedList)
+	writeTestFile(t, p.CertificateListKeyFile, listPubKeyPEM)
+
+	err = p.loadSKIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generation := p.certMatchGeneration()
+
+	// changes of the auth token do not affect the certificate matches
+	err = p.updateAuthToken(uid, "new-password1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.certMatchGeneration() != generation {
+		t.Error("certificate matches were invalidated by an auth token update")
+	}
+	if !p.certListUnchanged(signedList) {
+		t.Error("certificate list is processed again after an auth token update")
+	}
+
+	// a pending key might match a certificate
+	nextPubKeyPEM, err := p.GetPublicKeyFromPrivateKey(privKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.updateKeys(uid, func(id *Identity) error {
+		id.NextPrivateKey, id.NextPublicKey = privKeyPEM, nextPubKeyPEM
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.certMatchGeneration() == generation {
+		t.Error("certificate matches were not invalidated by a change of the public keys")
+	}
+	if p.certListUnchanged(signedList) {
+		t.Error("certificate list is not processed again after a change of the public keys")
+	}
 }
 
-func (m *mockCtxMngr) ExistsPrivateKey(uid uuid.UUID) (bool, error) {
-	panic("implement me")
+func TestCertificateFilter(t *testing.T) {
+	cert := Certificate{CertificateType: "DSC", Country: "DE"}
+
+	testCases := []struct {
+		name     string
+		filter   CertificateFilter
+		accepted bool
+	}{
+		{name: "no filter", filter: CertificateFilter{}, accepted: true},
+		{name: "accepted type", filter: CertificateFilter{Types: []string{"CSCA", "DSC"}}, accepted: true},
+		{name: "other type", filter: CertificateFilter{Types: []string{"CSCA"}}, accepted: false},
+		{name: "accepted country", filter: CertificateFilter{Countries: []string{"de"}}, accepted: true},
+		{name: "other country", filter: CertificateFilter{Countries: []string{"AT", "FR"}}, accepted: false},
+		{name: "accepted type and other country", filter: CertificateFilter{Types: []string{"DSC"}, Countries: []string{"FR"}}, accepted: false},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.filter.acceptsEntry(cert) != c.accepted {
+				t.Errorf("unexpected result for filter %+v", c.filter)
+			}
+		})
+	}
 }
 
-func (m *mockCtxMngr) GetUuidForPublicKey(pubKey []byte) (uuid.UUID, error) {
-	panic("implement me")
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "certificate_list")
+	keyFile := filepath.Join(dir, "certificate_list_key.pem")
+
+	writeTestFile(t, file, []byte("list"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := watchFiles(ctx, 10*time.Millisecond, file, keyFile)
+
+	select {
+	case <-changed:
+		t.Fatal("unchanged files were reported as changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	writeTestFile(t, file, []byte("new list"))
+	checkFilesChanged(t, changed)
+
+	writeTestFile(t, keyFile, []byte("key"))
+	checkFilesChanged(t, changed)
 }
 
-func (m *mockCtxMngr) Close() {
-	panic("implement me")
+func checkFilesChanged(t *testing.T, changed <-chan struct{}) {
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Error("changed file was not reported")
+	}
+}
+
+func writeTestFile(t *testing.T, file string, data []byte) {
+	err := ioutil.WriteFile(file, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestCertificate returns a self-signed X.509 certificate for the public key of the given private key
+func createTestCertificate(t *testing.T, privKeyPEM []byte, kid []byte) Certificate {
+	return createTestCertificateWithValidity(t, privKeyPEM, kid, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// createTestCertificateWithValidity returns a self-signed X.509 certificate for the public key of the given
+// private key, which is valid within the given period
+func createTestCertificateWithValidity(t *testing.T, privKeyPEM []byte, kid []byte, notBefore, notAfter time.Time) Certificate {
+	priv, err := decodePKCS8OrECPrivateKey(privKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: uid.String()},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+
+	certDER, err := x509.CreateCertificate(cryptorand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thumbprint := sha256.Sum256(certDER)
+
+	return Certificate{
+		CertificateType: "DSC",
+		Country:         "DE",
+		Kid:             kid,
+		RawData:         certDER,
+		ThumbprintHEX:   hex.EncodeToString(thumbprint[:]),
+		Timestamp:       time.Now().UTC(),
+	}
+}
+
+// createTrustList returns a public key certificate list with the given certificates in the format of the
+// certificate server, signed with the given private key, and the public key for its verification
+func createTrustList(t *testing.T, privKeyPEM []byte, certs ...Certificate) (signedList, pubKeyPEM []byte) {
+	c := &ubirch.ECDSACryptoContext{}
+
+	certList, err := json.Marshal(trustList{Certificates: certs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := c.Sign(privKeyPEM, certList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKeyPEM, err = c.GetPublicKeyFromPrivateKey(privKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedList = append([]byte(base64.StdEncoding.EncodeToString(signature)+"\n"), certList...)
+	return signedList, pubKeyPEM
+}
+
+// decodePKCS8OrECPrivateKey decodes a PEM encoded private key in PKCS #8 or SEC 1 format
+func decodePKCS8OrECPrivateKey(privKeyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(privKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("unable to parse PEM block")
+	}
+
+	if priv, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return priv, nil
+	}
+
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return priv.(crypto.Signer), nil
 }
@@ -0,0 +1,139 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StatusOK     = "OK"
+	StatusFailed = "FAILED"
+
+	dbReadinessTimeout = 5 * time.Second
+)
+
+type ReadinessResponse struct {
+	Status    string          `json:"status"`
+	Database  DatabaseStatus  `json:"database"`
+	TrustList TrustListStatus `json:"trustList"`
+}
+
+type DatabaseStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type TrustListStatus struct {
+	Status        string     `json:"status"`
+	Error         string     `json:"error,omitempty"`
+	VerifiedAt    *time.Time `json:"verifiedAt,omitempty"` // time of the verification of the public key certificate list in use
+	AgeSeconds    int64      `json:"ageSeconds"`           // seconds since the verification of the public key certificate list in use
+	MaxAgeSeconds int64      `json:"maxAgeSeconds"`
+	SKIDs         int        `json:"skids"` // number of identities with known SKID
+	MinSKIDs      int        `json:"minSKIDs"`
+}
+
+type ReadinessChecker struct {
+	*Protocol
+	serverID        string
+	maxTrustListAge time.Duration
+	minSKIDs        int
+}
+
+// readiness returns a handler for readiness checks, which reports the status of the database connection
+// and of the public key certificate list. Responds with status code 503, if any of the checks fails.
+func (c *ReadinessChecker) readiness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := ReadinessResponse{
+			Status:    StatusOK,
+			Database:  c.checkDatabase(r.Context()),
+			TrustList: c.checkTrustList(),
+		}
+
+		respCode := http.StatusOK
+
+		if resp.Database.Status != StatusOK || resp.TrustList.Status != StatusOK {
+			resp.Status = StatusFailed
+			respCode = http.StatusServiceUnavailable
+		}
+
+		respBody, err := json.Marshal(resp)
+		if err != nil {
+			log.Errorf("unable to encode readiness response: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if respCode != http.StatusOK {
+			log.Warnf("readiness check failed: %s", respBody)
+		}
+
+		w.Header().Set("Server", c.serverID)
+		w.Header().Set("Content-Type", JSONType)
+		w.WriteHeader(respCode)
+		_, err = w.Write(respBody)
+		if err != nil {
+			log.Errorf("unable to write response: %s", err)
+		}
+	}
+}
+
+func (c *ReadinessChecker) checkDatabase(ctx context.Context) DatabaseStatus {
+	ctx, cancel := context.WithTimeout(ctx, dbReadinessTimeout)
+	defer cancel()
+
+	err := c.IsReady(ctx)
+	if err != nil {
+		return DatabaseStatus{Status: StatusFailed, Error: err.Error()}
+	}
+
+	return DatabaseStatus{Status: StatusOK}
+}
+
+func (c *ReadinessChecker) checkTrustList() TrustListStatus {
+	status := TrustListStatus{
+		Status:        StatusOK,
+		MaxAgeSeconds: int64(c.maxTrustListAge.Seconds()),
+		SKIDs:         c.SKIDCount(),
+		MinSKIDs:      c.minSKIDs,
+	}
+
+	verifiedAt, loaded := c.TrustListVerifiedAt()
+	if loaded {
+		status.VerifiedAt = &verifiedAt
+		status.AgeSeconds = int64(time.Since(verifiedAt).Seconds())
+	}
+
+	switch {
+	case !loaded:
+		status.Status = StatusFailed
+		status.Error = "public key certificate list was not loaded yet"
+	case time.Since(verifiedAt) > c.maxTrustListAge:
+		status.Status = StatusFailed
+		status.Error = fmt.Sprintf("public key certificate list is older than %s", c.maxTrustListAge)
+	case status.SKIDs < c.minSKIDs:
+		status.Status = StatusFailed
+		status.Error = fmt.Sprintf("less than %d identities with known SKID", c.minSKIDs)
+	}
+
+	return status
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	idHandler, _ := setupIdentityHandler(t, "")
+
+	checker := &ReadinessChecker{
+		Protocol:        idHandler.protocol,
+		serverID:        "test",
+		maxTrustListAge: time.Hour,
+	}
+
+	// certificate list was not loaded yet
+	resp := sendReadinessRequest(t, checker, http.StatusServiceUnavailable)
+	if resp.TrustList.Status != StatusFailed || resp.TrustList.VerifiedAt != nil {
+		t.Errorf("unexpected certificate list status before certificate list was loaded: %+v", resp.TrustList)
+	}
+	if resp.Database.Status != StatusOK {
+		t.Errorf("unexpected database status: %+v", resp.Database)
+	}
+
+	checker.setTrustListVerifiedAt(time.Now().Add(-time.Minute))
+
+	resp = sendReadinessRequest(t, checker, http.StatusOK)
+	if resp.Status != StatusOK || resp.TrustList.Status != StatusOK {
+		t.Errorf("unexpected readiness status: %+v", resp)
+	}
+	if resp.TrustList.AgeSeconds < 60 || resp.TrustList.AgeSeconds > 120 {
+		t.Errorf("unexpected certificate list age: %d", resp.TrustList.AgeSeconds)
+	}
+	if resp.TrustList.SKIDs != 1 {
+		t.Errorf("unexpected number of known SKIDs: %d", resp.TrustList.SKIDs)
+	}
+
+	// not enough identities with known SKID
+	checker.minSKIDs = 2
+	resp = sendReadinessRequest(t, checker, http.StatusServiceUnavailable)
+	if resp.TrustList.Status != StatusFailed {
+		t.Errorf("unexpected certificate list status with too few known SKIDs: %+v", resp.TrustList)
+	}
+	checker.minSKIDs = 0
+
+	// outdated certificate list
+	checker.setTrustListVerifiedAt(time.Now().Add(-2 * time.Hour))
+	resp = sendReadinessRequest(t, checker, http.StatusServiceUnavailable)
+	if resp.TrustList.Status != StatusFailed {
+		t.Errorf("unexpected status of outdated certificate list: %+v", resp.TrustList)
+	}
+	checker.setTrustListVerifiedAt(time.Now())
+
+	// database not reachable
+	checker.ctxManager = &unreachableCtxMngr{NewMemoryContextManager()}
+	resp = sendReadinessRequest(t, checker, http.StatusServiceUnavailable)
+	if resp.Database.Status != StatusFailed || resp.Database.Error == "" {
+		t.Errorf("unexpected status of unreachable database: %+v", resp.Database)
+	}
+}
+
+type unreachableCtxMngr struct {
+	*MemoryContextManager
+}
+
+func (m *unreachableCtxMngr) IsReady(ctx context.Context) error {
+	return fmt.Errorf("connection refused")
+}
+
+func sendReadinessRequest(t *testing.T, checker *ReadinessChecker, expectedCode int) ReadinessResponse {
+	w := httptest.NewRecorder()
+	checker.readiness()(w, httptest.NewRequest(http.MethodGet, "/readiness", nil))
+
+	if w.Code != expectedCode {
+		t.Errorf("unexpected response status code: expected %d, got %d (%s)", expectedCode, w.Code, w.Body.String())
+	}
+
+	resp := ReadinessResponse{}
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
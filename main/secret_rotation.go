@@ -0,0 +1,200 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ubirch/ubirch-client-go/main/adapters/encrypters"
+	"github.com/ubirch/ubirch-client-go/main/auditlogger"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const secretRotationBatchSize = 100
+
+// RotateSecret re-encrypts the private keys of all identities, which were encrypted with the
+// previous secret ('previousSecret32'), with the current secret ('secret32')
+func RotateSecret(c *Config) error {
+	if len(c.prevSecretBytes) == 0 {
+		return fmt.Errorf("missing previous secret ('previousSecret32')")
+	}
+
+	ctxManager, err := GetCtxManager(c)
+	if err != nil {
+		return err
+	}
+	defer ctxManager.Close()
+
+	count, err := rotateSecret(ctxManager, c.prevSecretBytes, c.secretBytes, secretRotationBatchSize)
+	if err != nil {
+		return fmt.Errorf("aborted after re-encrypting the keys of %d identities: %v", count, err)
+	}
+
+	log.Infof("secret rotation successful: re-encrypted the keys of %d identities", count)
+
+	infos := fmt.Sprintf("\"keyVersion\":\"%s\", \"identities\":%d", secretKeyVersion(c.secretBytes), count)
+	auditlogger.AuditLog("rotate", "secret", infos)
+
+	return nil
+}
+
+// rotateSecret re-encrypts the private keys of all identities, which were not encrypted with the new secret yet.
+// Identities are processed in batches, each batch within a transaction. Since the key version of each identity
+// is updated together with its keys, an interrupted rotation can be resumed. Returns the number of identities,
+// the keys of which were re-encrypted.
+func rotateSecret(ctxManager ContextManager, oldSecret, newSecret []byte, batchSize int) (count int, err error) {
+	for {
+		n, err := rotateSecretBatch(ctxManager, oldSecret, newSecret, batchSize)
+		if err != nil {
+			return count, err
+		}
+		if n == 0 {
+			return count, nil
+		}
+
+		count += n
+		log.Infof("re-encrypted the keys of %d identities", count)
+	}
+}
+
+func rotateSecretBatch(ctxManager ContextManager, oldSecret, newSecret []byte, batchSize int) (int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tx, err := ctxManager.StartTransaction(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	identities, err := ctxManager.GetIdentitiesWithOtherKeyVersion(tx, secretKeyVersion(newSecret), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range identities {
+		err = reencryptKeys(&id, oldSecret, newSecret)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", id.Uid, err)
+		}
+
+		err = ctxManager.UpdateIdentity(tx, id)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", id.Uid, err)
+		}
+	}
+
+	err = ctxManager.CloseTransaction(tx, Commit)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(identities), nil
+}
+
+// reencryptKeys decrypts the private keys of the identity with the old secret and encrypts them with the new secret.
+// Each re-encrypted key is verified by decrypting it and comparing its public key with the stored public key.
+func reencryptKeys(id *Identity, oldSecret, newSecret []byte) error {
+	alg, err := lookupAlgorithm(id.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	var secrets [][]byte
+	switch id.KeyVersion {
+	case secretKeyVersion(oldSecret):
+		secrets = [][]byte{oldSecret}
+	case "": // keys were stored before key versions were recorded
+		secrets = [][]byte{oldSecret, newSecret}
+	default:
+		return fmt.Errorf("keys were encrypted with a secret of unknown key version %s", id.KeyVersion)
+	}
+
+	enc := &encrypters.KeyEncrypter{Secret: newSecret, Crypto: alg.crypto}
+
+	for _, keyPair := range []struct {
+		privKey *[]byte
+		pubKey  []byte
+	}{
+		{&id.PrivateKey, id.PublicKey},
+		{&id.NextPrivateKey, id.NextPublicKey},
+		{&id.PrevPrivateKey, id.PrevPublicKey},
+	} {
+		if len(*keyPair.privKey) == 0 || isKeyHandle(*keyPair.privKey) { // keys held by a key token are not encrypted
+			continue
+		}
+
+		privKeyPEM, err := decryptPrivateKey(alg, secrets, *keyPair.privKey)
+		if err != nil {
+			return err
+		}
+
+		reencrypted, err := enc.Encrypt(privKeyPEM)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt private key: %v", err)
+		}
+
+		// verify re-encrypted key
+		decrypted, err := enc.Decrypt(reencrypted)
+		if err != nil {
+			return fmt.Errorf("unable to decrypt re-encrypted private key: %v", err)
+		}
+
+		pubKeyPEM, err := alg.crypto.GetPublicKeyFromPrivateKey(decrypted)
+		if err != nil {
+			return fmt.Errorf("unable to get public key from re-encrypted private key: %v", err)
+		}
+
+		pubKey, err := alg.crypto.PublicKeyPEMToBytes(pubKeyPEM)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(pubKey, keyPair.pubKey) {
+			return fmt.Errorf("public key of re-encrypted private key does not match stored public key")
+		}
+
+		*keyPair.privKey = reencrypted
+	}
+
+	id.KeyVersion = secretKeyVersion(newSecret)
+
+	return nil
+}
+
+// decryptPrivateKey decrypts an encrypted private key with the first of the given secrets, which succeeds
+func decryptPrivateKey(alg *signingAlgorithm, secrets [][]byte, encryptedPrivKey []byte) (privKeyPEM []byte, err error) {
+	for _, secret := range secrets {
+		enc := &encrypters.KeyEncrypter{Secret: secret, Crypto: alg.crypto}
+
+		privKeyPEM, err = enc.Decrypt(encryptedPrivKey)
+		if err == nil {
+			return privKeyPEM, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unable to decrypt private key: %v", err)
+}
+
+// secretKeyVersion derives the key version, which identifies the secret used for the encryption of private keys,
+// from the secret
+func secretKeyVersion(secret []byte) string {
+	hash := sha256.Sum256(append([]byte("key version:"), secret...))
+	return hex.EncodeToString(hash[:8])
+}
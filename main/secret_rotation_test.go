@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ubirch/ubirch-client-go/main/adapters/encrypters"
+	"github.com/ubirch/ubirch-protocol-go/ubirch/v2"
+)
+
+func TestRotateSecret(t *testing.T) {
+	runForEachBackend(t, testRotateSecret)
+}
+
+func testRotateSecret(t *testing.T, dm ContextManager) {
+	oldSecret, newSecret := newTestSecret(), newTestSecret()
+
+	p := newSecretTestProtocol(t, dm, oldSecret, nil)
+	identities := storeSecretTestIdentities(t, p, 7)
+
+	// identities can not be decrypted with the new secret before the rotation
+	_, err := newSecretTestProtocol(t, dm, newSecret, nil).GetIdentity(identities[0].Uid)
+	if err == nil {
+		t.Fatal("decrypted private key of identity with wrong secret")
+	}
+
+	count, err := rotateSecret(dm, oldSecret, newSecret, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(identities) {
+		t.Errorf("unexpected number of re-encrypted identities: %d, expected: %d", count, len(identities))
+	}
+
+	checkSecretTestIdentities(t, newSecretTestProtocol(t, dm, newSecret, nil), identities, secretKeyVersion(newSecret))
+
+	// a second rotation has nothing left to do
+	count, err = rotateSecret(dm, oldSecret, newSecret, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("repeated rotation re-encrypted %d identities", count)
+	}
+}
+
+func TestRotateSecret_Resume(t *testing.T) {
+	dm := NewMemoryContextManager()
+	oldSecret, newSecret := newTestSecret(), newTestSecret()
+
+	p := newSecretTestProtocol(t, dm, oldSecret, nil)
+	identities := storeSecretTestIdentities(t, p, 5)
+
+	// rotate the first batch only to simulate an interrupted rotation
+	count, err := rotateSecretBatch(dm, oldSecret, newSecret, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("unexpected number of re-encrypted identities: %d", count)
+	}
+
+	// during the rollout, identities encrypted with either secret can be decrypted, if both secrets are configured
+	checkSecretTestIdentities(t, newSecretTestProtocol(t, dm, newSecret, oldSecret), identities, "")
+
+	count, err = rotateSecret(dm, oldSecret, newSecret, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("unexpected number of re-encrypted identities after resuming: %d", count)
+	}
+
+	checkSecretTestIdentities(t, newSecretTestProtocol(t, dm, newSecret, nil), identities, secretKeyVersion(newSecret))
+}
+
+func TestRotateSecret_LegacyIdentity(t *testing.T) {
+	dm := NewMemoryContextManager()
+	oldSecret, newSecret := newTestSecret(), newTestSecret()
+
+	p := newSecretTestProtocol(t, dm, oldSecret, nil)
+	identities := storeSecretTestIdentities(t, p, 1)
+
+	// identities, which were stored before key versions were recorded, have no key version
+	id, err := dm.GetIdentity(identities[0].Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id.KeyVersion = ""
+	updateAndCommit(t, dm, id)
+
+	checkSecretTestIdentities(t, newSecretTestProtocol(t, dm, oldSecret, nil), identities, "")
+
+	_, err = rotateSecret(dm, oldSecret, newSecret, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSecretTestIdentities(t, newSecretTestProtocol(t, dm, newSecret, nil), identities, secretKeyVersion(newSecret))
+}
+
+func TestRotateSecret_WrongSecret(t *testing.T) {
+	dm := NewMemoryContextManager()
+	oldSecret, newSecret := newTestSecret(), newTestSecret()
+
+	p := newSecretTestProtocol(t, dm, oldSecret, nil)
+	identities := storeSecretTestIdentities(t, p, 3)
+
+	_, err := rotateSecret(dm, newTestSecret(), newSecret, 10)
+	if err == nil {
+		t.Fatal("rotation with wrong old secret did not fail")
+	}
+
+	// nothing was changed
+	checkSecretTestIdentities(t, newSecretTestProtocol(t, dm, oldSecret, nil), identities, secretKeyVersion(oldSecret))
+}
+
+func TestRotateSecret_VerificationFailure(t *testing.T) {
+	dm := NewMemoryContextManager()
+	oldSecret, newSecret := newTestSecret(), newTestSecret()
+
+	p := newSecretTestProtocol(t, dm, oldSecret, nil)
+	identities := storeSecretTestIdentities(t, p, 3)
+
+	// replace the stored public key of one identity, so that it does not match its private key
+	id, err := dm.GetIdentity(identities[1].Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id.PublicKey = identities[0].PublicKey
+	id.PublicKey, err = p.PublicKeyPEMToBytes(id.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateAndCommit(t, dm, id)
+
+	_, err = rotateSecret(dm, oldSecret, newSecret, 10)
+	if err == nil {
+		t.Fatal("rotation of identity with mismatching public key did not fail")
+	}
+
+	// the batch was rolled back
+	for _, id := range identities {
+		storedId, err := dm.GetIdentity(id.Uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if storedId.KeyVersion != secretKeyVersion(oldSecret) {
+			t.Errorf("%s: key version was changed by failed rotation", id.Uid)
+		}
+	}
+}
+
+func newTestSecret() []byte {
+	secret := make([]byte, secretLength)
+	rand.Read(secret)
+	return secret
+}
+
+func newSecretTestProtocol(t *testing.T, dm ContextManager, secret, prevSecret []byte) *Protocol {
+	crypto := &ubirch.ECDSACryptoContext{}
+
+	enc, err := encrypters.NewKeyEncrypter(secret, crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Protocol{
+		Crypto:       crypto,
+		ctxManager:   dm,
+		keyEncrypter: enc,
+		prevSecret:   prevSecret,
+
+		identityCache: &sync.Map{},
+		uidCache:      &sync.Map{},
+		authCache:     &sync.Map{},
+	}
+}
+
+// storeSecretTestIdentities stores identities with a current and a next key pair and returns them with decrypted keys
+func storeSecretTestIdentities(t *testing.T, p *Protocol, n int) []Identity {
+	var identities []Identity
+
+	for i := 0; i < n; i++ {
+		id := Identity{
+			Uid:       uuid.New(),
+			AuthToken: "password1234",
+		}
+
+		for _, keyPair := range []struct{ privKey, pubKey *[]byte }{
+			{&id.PrivateKey, &id.PublicKey},
+			{&id.NextPrivateKey, &id.NextPublicKey},
+		} {
+			privKeyPEM, err := p.GenerateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pubKeyPEM, err := p.GetPublicKeyFromPrivateKey(privKeyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			*keyPair.privKey, *keyPair.pubKey = privKeyPEM, pubKeyPEM
+		}
+
+		// the next key pair is not part of a new identity, it is stored with an update
+		storedId := id
+		storedId.AuthToken = hashTestAuthToken(t, id.AuthToken)
+		storeAndCommit(t, p, &storedId)
+		updateAndCommit(t, p, &storedId)
+
+		identities = append(identities, id)
+	}
+
+	return identities
+}
+
+// checkSecretTestIdentities checks that the stored identities can be decrypted and have the expected key version,
+// an empty expected key version is not checked
+func checkSecretTestIdentities(t *testing.T, p *Protocol, identities []Identity, expectedKeyVersion string) {
+	for _, id := range identities {
+		storedId, err := p.GetIdentity(id.Uid)
+		if err != nil {
+			t.Fatalf("%s: %v", id.Uid, err)
+		}
+
+		if !bytes.Equal(storedId.PrivateKey, id.PrivateKey) {
+			t.Errorf("%s: unexpected private key", id.Uid)
+		}
+		if !bytes.Equal(storedId.NextPrivateKey, id.NextPrivateKey) {
+			t.Errorf("%s: unexpected next private key", id.Uid)
+		}
+		if expectedKeyVersion != "" && storedId.KeyVersion != expectedKeyVersion {
+			t.Errorf("%s: unexpected key version: %s, expected: %s", id.Uid, storedId.KeyVersion, expectedKeyVersion)
+		}
+	}
+}
+
+func updateAndCommit(t *testing.T, ctxMngr ContextManager, id *Identity) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tx, err := ctxMngr.StartTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctxMngr.UpdateIdentity(tx, *id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctxMngr.CloseTransaction(tx, Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultVaultSecretKey     = "secret32"
+	defaultVaultPrevSecretKey = "previousSecret32"
+
+	secretCommandTimeout = 30 * time.Second
+	vaultRequestTimeout  = 10 * time.Second
+)
+
+// secretSource describes the configured sources of a secret, at most one of them may be set
+type secretSource struct {
+	name       string // name of the secret in the configuration, e.g. 'secret32'
+	value      string // the base64 encoded secret from the configuration itself
+	file       string
+	command    string
+	vaultURL   string
+	vaultKey   string
+	defaultKey string // key of the secret in the KV endpoint data, if vaultKey is not set
+}
+
+func (c *Config) secretSource() *secretSource {
+	return &secretSource{
+		name:       "secret32",
+		value:      c.SecretBase64,
+		file:       c.SecretFile,
+		command:    c.SecretCommand,
+		vaultURL:   c.SecretVaultURL,
+		vaultKey:   c.SecretVaultKey,
+		defaultKey: defaultVaultSecretKey,
+	}
+}
+
+func (c *Config) previousSecretSource() *secretSource {
+	return &secretSource{
+		name:       "previousSecret32",
+		value:      c.PreviousSecretBase64,
+		file:       c.PreviousSecretFile,
+		command:    c.PreviousSecretCommand,
+		vaultURL:   c.PreviousSecretVaultURL,
+		vaultKey:   c.PreviousSecretVaultKey,
+		defaultKey: defaultVaultPrevSecretKey,
+	}
+}
+
+// loadSecret loads the base64 encoded key store secret from the configured source, which is either the
+// configuration itself ('secret32'), a file, the output of a command or a Vault-compatible KV endpoint.
+// The previous secret ('previousSecret32') is loaded the same way, if any source is configured for it.
+// Errors never contain the secret itself.
+func (c *Config) loadSecret() (err error) {
+	c.secretBytes, err = c.secretSource().load(c.configDir, c.VaultToken)
+	if err != nil {
+		return err
+	}
+
+	if prev := c.previousSecretSource(); prev.isSet() {
+		c.prevSecretBytes, err = prev.load(c.configDir, c.VaultToken)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSecretSource makes sure that not more than one source is configured for the secret and the previous secret
+func (c *Config) checkSecretSource() error {
+	err := c.secretSource().check()
+	if err != nil {
+		return err
+	}
+
+	return c.previousSecretSource().check()
+}
+
+// load loads the base64 encoded secret from the configured source and decodes it
+func (s *secretSource) load(configDir, vaultToken string) (secret []byte, err error) {
+	var source, secretBase64 string
+
+	switch {
+	case s.file != "":
+		source = "file"
+		secretBase64, err = readSecretFile(s.filePath(configDir))
+	case s.command != "":
+		source = "command"
+		secretBase64, err = execSecretCommand(s.command)
+	case s.vaultURL != "":
+		source = "vault"
+		key := s.vaultKey
+		if key == "" {
+			key = s.defaultKey
+		}
+		secretBase64, err = fetchVaultSecret(s.vaultURL, vaultToken, key)
+	default:
+		source = "config"
+		secretBase64 = s.value
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load %s from %s: %v", s.name, source, err)
+	}
+
+	secret, err = base64.StdEncoding.DecodeString(secretBase64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode base64 encoded %s from %s: %v", s.name, source, err)
+	}
+
+	log.Debugf("loaded %s from %s", s.name, source)
+	return secret, nil
+}
+
+// isSet returns true, if any source is configured for the secret
+func (s *secretSource) isSet() bool {
+	return len(s.configured()) != 0
+}
+
+// check makes sure that not more than one source is configured for the secret
+func (s *secretSource) check() error {
+	sources := s.configured()
+
+	if len(sources) > 1 {
+		return fmt.Errorf("only one source may be configured for '%s', got: %s", s.name, strings.Join(sources, ", "))
+	}
+
+	return nil
+}
+
+// configured returns the configuration names of all sources, which are set for the secret
+func (s *secretSource) configured() (sources []string) {
+	for _, source := range []struct{ suffix, value string }{
+		{"", s.value},
+		{"File", s.file},
+		{"Command", s.command},
+		{"VaultURL", s.vaultURL},
+	} {
+		if source.value != "" {
+			sources = append(sources, s.name+source.suffix)
+		}
+	}
+
+	return sources
+}
+
+// filePath returns the path to the secret file, relative paths are relative to the config directory
+func (s *secretSource) filePath(configDir string) string {
+	if filepath.IsAbs(s.file) {
+		return s.file
+	}
+	return filepath.Join(configDir, s.file)
+}
+
+// readSecretFile reads the secret from a file, e.g. a mounted kubernetes secret
+func readSecretFile(path string) (string, error) {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// execSecretCommand executes the command and returns its output as secret. The command is split at
+// white spaces and executed directly, i.e. not by a shell.
+func execSecretCommand(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+
+	// the output of the command is not part of the error, since it may contain the secret
+	secret, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// fetchVaultSecret reads the secret with the given key from a Vault-compatible KV endpoint. Both, the KV
+// version 1 (secret data in "data") and version 2 (secret data in "data.data") response formats are supported.
+func fetchVaultSecret(url, token, key string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	client := &http.Client{Timeout: vaultRequestTimeout}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request to %s failed: (%d) %s", url, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	var kv struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&kv)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode response from %s: %v", url, err)
+	}
+
+	data := kv.Data
+	if nested, ok := kv.Data["data"]; ok {
+		data = nil
+		err = json.Unmarshal(nested, &data)
+		if err != nil {
+			return "", fmt.Errorf("unexpected secret data format in response from %s", url)
+		}
+	}
+
+	value, found := data[key]
+	if !found {
+		return "", fmt.Errorf("key %q not found in response from %s", key, url)
+	}
+
+	var secret string
+	err = json.Unmarshal(value, &secret)
+	if err != nil {
+		return "", fmt.Errorf("value of key %q in response from %s is not a string", key, url)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testVaultToken = "vault-token-1234"
+
+func TestLoadSecret_Config(t *testing.T) {
+	secret := newTestSecret()
+
+	c := &Config{SecretBase64: base64.StdEncoding.EncodeToString(secret)}
+
+	checkLoadedSecret(t, c, secret)
+}
+
+func TestLoadSecret_File(t *testing.T) {
+	secret := newTestSecret()
+
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "secret32"), []byte(base64.StdEncoding.EncodeToString(secret)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// relative to the config directory
+	c := &Config{SecretFile: "secret32", configDir: dir}
+	checkLoadedSecret(t, c, secret)
+
+	// absolute
+	c = &Config{SecretFile: filepath.Join(dir, "secret32")}
+	checkLoadedSecret(t, c, secret)
+}
+
+func TestLoadSecret_Command(t *testing.T) {
+	secret := newTestSecret()
+
+	c := &Config{SecretCommand: "echo " + base64.StdEncoding.EncodeToString(secret)}
+
+	checkLoadedSecret(t, c, secret)
+}
+
+func TestLoadSecret_CommandFails(t *testing.T) {
+	c := &Config{SecretCommand: "false"}
+
+	err := c.loadSecret()
+	if err == nil {
+		t.Fatal("loading secret from failing command did not fail")
+	}
+}
+
+func TestLoadSecret_Vault(t *testing.T) {
+	secret := newTestSecret()
+	secretBase64 := base64.StdEncoding.EncodeToString(secret)
+
+	testCases := []struct {
+		name     string
+		key      string
+		response map[string]interface{}
+	}{
+		{
+			name: "kv v1",
+			response: map[string]interface{}{
+				"data": map[string]interface{}{"secret32": secretBase64},
+			},
+		},
+		{
+			name: "kv v2",
+			response: map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"secret32": secretBase64},
+					"metadata": map[string]interface{}{"version": 1},
+				},
+			},
+		},
+		{
+			name: "custom key",
+			key:  "encryption-secret",
+			response: map[string]interface{}{
+				"data": map[string]interface{}{
+					"data": map[string]interface{}{"encryption-secret": secretBase64},
+				},
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			vault := newVaultStandIn(t, c.response)
+			defer vault.Close()
+
+			conf := &Config{
+				SecretVaultURL: vault.URL + "/v1/secret/data/cose-client",
+				SecretVaultKey: c.key,
+				VaultToken:     testVaultToken,
+			}
+
+			checkLoadedSecret(t, conf, secret)
+		})
+	}
+}
+
+func TestLoadSecret_VaultErrors(t *testing.T) {
+	secretBase64 := base64.StdEncoding.EncodeToString(newTestSecret())
+
+	vault := newVaultStandIn(t, map[string]interface{}{
+		"data": map[string]interface{}{"secret32": secretBase64},
+	})
+	defer vault.Close()
+
+	testCases := []struct {
+		name  string
+		token string
+		key   string
+	}{
+		{
+			name:  "wrong token",
+			token: "wrong-token",
+		},
+		{
+			name:  "missing key",
+			token: testVaultToken,
+			key:   "unknown",
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := &Config{
+				SecretVaultURL: vault.URL,
+				SecretVaultKey: c.key,
+				VaultToken:     c.token,
+			}
+
+			err := conf.loadSecret()
+			if err == nil {
+				t.Fatal("loading secret did not fail")
+			}
+			if strings.Contains(err.Error(), secretBase64) {
+				t.Errorf("error contains secret: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadSecret_InvalidSecretNotInError(t *testing.T) {
+	invalidSecret := "not base64 encoded secret!"
+
+	c := &Config{SecretBase64: invalidSecret}
+
+	err := c.loadSecret()
+	if err == nil {
+		t.Fatal("loading invalid secret did not fail")
+	}
+	if strings.Contains(err.Error(), invalidSecret) {
+		t.Errorf("error contains secret: %v", err)
+	}
+}
+
+func TestCheckSecretSource(t *testing.T) {
+	c := &Config{SecretBase64: "secret", SecretFile: "secret32"}
+
+	err := c.checkSecretSource()
+	if err == nil {
+		t.Error("multiple secret sources were accepted")
+	}
+
+	c = &Config{PreviousSecretBase64: "secret", PreviousSecretVaultURL: "http://localhost:8200"}
+
+	err = c.checkSecretSource()
+	if err == nil {
+		t.Error("multiple previous secret sources were accepted")
+	}
+
+	c = &Config{SecretFile: "secret32", PreviousSecretFile: "previousSecret32"}
+
+	err = c.checkSecretSource()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadSecret_PreviousSecret(t *testing.T) {
+	secret := newTestSecret()
+	prevSecret := newTestSecret()
+	prevSecretBase64 := base64.StdEncoding.EncodeToString(prevSecret)
+
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "previousSecret32"), []byte(prevSecretBase64+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault := newVaultStandIn(t, map[string]interface{}{
+		"data": map[string]interface{}{
+			"data": map[string]interface{}{"previousSecret32": prevSecretBase64},
+		},
+	})
+	defer vault.Close()
+
+	testCases := []struct {
+		name string
+		conf Config
+	}{
+		{
+			name: "config",
+			conf: Config{PreviousSecretBase64: prevSecretBase64},
+		},
+		{
+			name: "file",
+			conf: Config{PreviousSecretFile: "previousSecret32"},
+		},
+		{
+			name: "command",
+			conf: Config{PreviousSecretCommand: "echo " + prevSecretBase64},
+		},
+		{
+			name: "vault",
+			conf: Config{PreviousSecretVaultURL: vault.URL, VaultToken: testVaultToken},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := c.conf
+			conf.SecretBase64 = base64.StdEncoding.EncodeToString(secret)
+			conf.configDir = dir
+
+			checkLoadedSecret(t, &conf, secret)
+
+			if !bytes.Equal(conf.prevSecretBytes, prevSecret) {
+				t.Errorf("unexpected previous secret loaded")
+			}
+		})
+	}
+}
+
+func TestLoadSecret_NoPreviousSecret(t *testing.T) {
+	secret := newTestSecret()
+
+	c := &Config{SecretBase64: base64.StdEncoding.EncodeToString(secret)}
+
+	checkLoadedSecret(t, c, secret)
+
+	if c.prevSecretBytes != nil {
+		t.Errorf("previous secret loaded without configured source")
+	}
+}
+
+func TestLoadSecret_PreviousSecretCommandFails(t *testing.T) {
+	c := &Config{
+		SecretBase64:          base64.StdEncoding.EncodeToString(newTestSecret()),
+		PreviousSecretCommand: "false",
+	}
+
+	err := c.loadSecret()
+	if err == nil {
+		t.Fatal("loading previous secret from failing command did not fail")
+	}
+}
+
+func checkLoadedSecret(t *testing.T, c *Config, expected []byte) {
+	err := c.loadSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(c.secretBytes, expected) {
+		t.Errorf("unexpected secret loaded")
+	}
+}
+
+// newVaultStandIn returns a server, which responds like a Vault KV endpoint with the given response
+func newVaultStandIn(t *testing.T, response map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(response)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+}
@@ -15,14 +15,17 @@
 package main
 
 import (
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/go-chi/chi"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
@@ -36,9 +39,20 @@ import (
 const (
 	AuthHeader = "X-Auth-Token"
 
-	UUIDKey      = "uuid"
-	CBORPath     = "/cbor"
-	HashEndpoint = "/hash"
+	UUIDKey          = "uuid"
+	RegisterEndpoint = "/register"
+	CBORPath         = "/cbor"
+	HashEndpoint     = "/hash"
+	VerifyEndpoint   = "/verify"
+	AttachEndpoint   = "/attach"
+	BatchEndpoint    = "/batch"
+	RotateEndpoint   = "/rotate"
+	TokenEndpoint    = "/token"
+
+	DetachedPayloadHeader = "X-Detached-Payload"
+	ExternalAADHeader     = "X-External-AAD"
+	DetachedPayloadParam  = "detached"
+	AlgorithmParam        = "algorithm"
 
 	BinType  = "application/octet-stream"
 	TextType = "text/plain"
@@ -47,17 +61,37 @@ const (
 
 	HexEncoding = "hex"
 
-	HashLen = 32
+	// maxBatchItemSize is the maximum average size in bytes of an encoded item in a batch request,
+	// the body of a batch request is limited to maxBatchSize * maxBatchItemSize bytes
+	maxBatchItemSize = 64 * 1024
 )
 
-var UUIDPath = fmt.Sprintf("/{%s}", UUIDKey)
+var (
+	UUIDPath = fmt.Sprintf("/{%s}", UUIDKey)
 
-type Sha256Sum [HashLen]byte
+	errBatchBodyTooLarge = errors.New("batch request body too large")
+)
 
 type HTTPRequest struct {
-	ID      uuid.UUID
-	Hash    Sha256Sum
-	Payload []byte
+	ID         uuid.UUID
+	Algorithm  string
+	Hash       []byte
+	ToBeSigned []byte // only set for requests with original data
+	Payload    []byte
+}
+
+type AttachRequest struct {
+	COSE        []byte `json:"cose"`
+	Payload     []byte `json:"payload"`
+	ExternalAAD []byte `json:"externalAAD,omitempty"`
+}
+
+// BatchResponseItem is the result for a single item of a batch request, which
+// contains either the COSE_Sign1 object or an error message
+type BatchResponseItem struct {
+	Status int    `json:"status" cbor:"status"`
+	COSE   []byte `json:"cose,omitempty" cbor:"cose,omitempty"`
+	Error  string `json:"error,omitempty" cbor:"error,omitempty"`
 }
 
 type HTTPResponse struct {
@@ -68,6 +102,9 @@ type HTTPResponse struct {
 
 type COSEService struct {
 	*CoseSigner
+	maxBatchSize   int
+	jwtVerifier    *JWTVerifier // verifier for JWT bearer tokens, nil if JWT authentication is not enabled
+	clientCertAuth string       // how client certificates authorize signing requests, empty if mutual TLS is not enabled
 }
 
 func (s *COSEService) directUUID() http.HandlerFunc {
@@ -83,30 +120,57 @@ func (s *COSEService) directUUID() http.HandlerFunc {
 	}
 }
 
-func (s *COSEService) handleRequest(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+// getAuthorizedIdentity returns the identity with the given UUID and its signing algorithm,
+// if the request is authorized to use it. Otherwise, an error is sent to the client and ok is false.
+func (s *COSEService) getAuthorizedIdentity(w http.ResponseWriter, r *http.Request, uid uuid.UUID) (identity *Identity, alg *signingAlgorithm, ok bool) {
 	identity, err := s.GetIdentity(uid)
 	if err == ErrNotExist {
 		h.Error(uid, w, fmt.Errorf("unknown UUID"), http.StatusNotFound)
-		return
+		return nil, nil, false
 	}
 	if err != nil {
 		log.Errorf("%s: %v", uid, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		return nil, nil, false
 	}
-	err = checkAuth(r, identity.AuthToken)
+	err = s.checkAuth(r, identity)
 	if err != nil {
 		Error(uid, w, err, http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	alg, err = lookupAlgorithm(identity.Algorithm)
+	if err != nil {
+		log.Errorf("%s: %v", uid, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	return identity, alg, true
+}
+
+func (s *COSEService) handleRequest(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	identity, alg, ok := s.getAuthorizedIdentity(w, r, uid)
+	if !ok {
 		return
 	}
 
-	msg := HTTPRequest{ID: uid}
+	msg := HTTPRequest{ID: uid, Algorithm: alg.name}
+
+	err := s.getPayloadAndHash(r, alg, &msg)
+	if err != nil {
+		Error(msg.ID, w, err, http.StatusBadRequest)
+		return
+	}
 
-	msg.Payload, msg.Hash, err = s.getPayloadAndHash(r)
+	detached, err := isDetachedPayloadRequest(r)
 	if err != nil {
 		Error(msg.ID, w, err, http.StatusBadRequest)
 		return
 	}
+	if detached {
+		msg.Payload = nil
+	}
 
 	timer := prometheus.NewTimer(p.SignatureCreationDuration)
 	resp := s.Sign(msg, identity.PrivateKey)
@@ -115,52 +179,351 @@ func (s *COSEService) handleRequest(w http.ResponseWriter, r *http.Request, uid
 	sendResponse(w, resp)
 
 	if h.HttpSuccess(resp.StatusCode) {
-		infos := fmt.Sprintf("\"hwDeviceId\":\"%s\", \"hash\":\"%s\"", msg.ID, base64.StdEncoding.EncodeToString(msg.Hash[:]))
-		auditlogger.AuditLog("create", "COSE", infos)
+		logSignatureCreation(msg)
+	}
+}
+
+// logSignatureCreation writes the audit log entry and increments the Prometheus counter for a created signature
+func logSignatureCreation(msg HTTPRequest) {
+	infos := fmt.Sprintf("\"hwDeviceId\":\"%s\", \"hash\":\"%s\"", msg.ID, base64.StdEncoding.EncodeToString(msg.Hash))
+	auditlogger.AuditLog("create", "COSE", infos)
+
+	p.SignatureCreationCounter.Inc()
+}
+
+// batchUUID handles batch requests with an array of hashes or original data
+// for the identity with the UUID from the request URL
+func (s *COSEService) batchUUID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := getUUID(r)
+		if err != nil {
+			log.Warn(err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		s.handleBatchRequest(w, r, uid)
+	}
+}
+
+func (s *COSEService) handleBatchRequest(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	identity, alg, ok := s.getAuthorizedIdentity(w, r, uid)
+	if !ok {
+		return
+	}
+
+	isHashBatch := isHashBatchRequest(r)
+	if isHashBatch && alg.pure {
+		Error(uid, w, fmt.Errorf("hash requests are not supported for identities with signing algorithm %s: "+
+			"signature is calculated over the original data", alg.name), http.StatusBadRequest)
+		return
+	}
+	if isHashBatch && r.Header.Get(ExternalAADHeader) != "" {
+		Error(uid, w, fmt.Errorf("external additional authenticated data can not be applied to hash requests: "+
+			"must be included in the signature structure before hashing"), http.StatusBadRequest)
+		return
+	}
+
+	detached, err := isDetachedPayloadRequest(r)
+	if err != nil {
+		Error(uid, w, err, http.StatusBadRequest)
+		return
+	}
+
+	// the body is limited before it is decoded, since the batch size can only be checked after decoding
+	maxBodySize := int64(s.maxBatchSize) * maxBatchItemSize
+
+	rBody, err := readBatchBody(w, r, maxBodySize)
+	if err == errBatchBodyTooLarge {
+		Error(uid, w, fmt.Errorf("batch request body exceeds maximum size of %d bytes", maxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		Error(uid, w, err, http.StatusBadRequest)
+		return
+	}
+
+	items, err := s.getBatchItems(r.Header, rBody, isHashBatch)
+	if err != nil {
+		Error(uid, w, err, http.StatusBadRequest)
+		return
+	}
+
+	if len(items) > s.maxBatchSize {
+		Error(uid, w, fmt.Errorf("batch size exceeds maximum: %d > %d", len(items), s.maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]BatchResponseItem, len(items))
+
+	for i, item := range items {
+		msg := HTTPRequest{ID: uid, Algorithm: alg.name}
+
+		if isHashBatch {
+			msg.Payload = item
+			msg.Hash, err = checkHashSize(item, alg)
+		} else {
+			err = s.getPayloadAndHashFromDataRequest(r.Header, item, alg, &msg)
+		}
+		if err != nil {
+			log.Warnf("%s: batch item %d: %v", uid, i, err)
+			results[i] = BatchResponseItem{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+
+		if detached {
+			msg.Payload = nil
+		}
+
+		timer := prometheus.NewTimer(p.SignatureCreationDuration)
+		resp := s.Sign(msg, identity.PrivateKey)
+		timer.ObserveDuration()
+
+		results[i].Status = resp.StatusCode
+
+		if !h.HttpSuccess(resp.StatusCode) {
+			results[i].Error = string(resp.Content)
+			continue
+		}
+
+		results[i].COSE = resp.Content
+		logSignatureCreation(msg)
+	}
+
+	resp, err := s.getBatchResponse(r.Header, results)
+	if err != nil {
+		log.Errorf("%s: unable to encode batch response: %v", uid, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, resp)
+}
+
+// getBatchItems decodes the array of hashes or original data items from the request body.
+//
+//	application/json: array of base64 encoded hashes, or array of JSON data packages
+//	application/cbor: array of hashes as byte strings, or array of CBOR encoded data items
+func (s *COSEService) getBatchItems(header http.Header, rBody []byte, isHashBatch bool) (items [][]byte, err error) {
+	switch ContentType(header) {
+	case JSONType:
+		if isHashBatch {
+			err = json.Unmarshal(rBody, &items)
+		} else {
+			var jsonItems []json.RawMessage
+			err = json.Unmarshal(rBody, &jsonItems)
+			for _, jsonItem := range jsonItems {
+				items = append(items, jsonItem)
+			}
+		}
+	case CBORType:
+		if isHashBatch {
+			err = cbor.Unmarshal(rBody, &items)
+		} else {
+			var cborItems []cbor.RawMessage
+			err = cbor.Unmarshal(rBody, &cborItems)
+			for _, cborItem := range cborItems {
+				items = append(items, cborItem)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid content-type for batch request: "+
+			"expected (\"%s\" | \"%s\")", CBORType, JSONType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode batch request: %v", err)
+	}
 
-		p.SignatureCreationCounter.Inc()
+	if len(items) == 0 {
+		return nil, fmt.Errorf("empty batch request")
 	}
+
+	return items, nil
 }
 
-func (s *COSEService) getPayloadAndHash(r *http.Request) (payload []byte, hash Sha256Sum, err error) {
+// getBatchResponse encodes the batch results in the content type of the request (JSON or CBOR)
+func (s *COSEService) getBatchResponse(header http.Header, results []BatchResponseItem) (HTTPResponse, error) {
+	var (
+		content     []byte
+		contentType string
+		err         error
+	)
+
+	if ContentType(header) == CBORType {
+		content, err = s.encMode.Marshal(results)
+		contentType = CBORType
+	} else {
+		content, err = json.Marshal(results)
+		contentType = JSONType
+	}
+	if err != nil {
+		return HTTPResponse{}, err
+	}
+
+	return HTTPResponse{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Content:    content,
+	}, nil
+}
+
+// getPayloadAndHash sets the payload, the hash and, for requests with original data,
+// the ToBeSigned value of the message according to the signing algorithm of the identity
+func (s *COSEService) getPayloadAndHash(r *http.Request, alg *signingAlgorithm, msg *HTTPRequest) error {
 	rBody, err := readBody(r)
 	if err != nil {
-		return nil, Sha256Sum{}, err
+		return err
 	}
 
 	if isHashRequest(r) { // request contains hash
-		hash, err = getHashFromHashRequest(r.Header, rBody)
-		return rBody, hash, err
+		if alg.pure {
+			return fmt.Errorf("hash requests are not supported for identities with signing algorithm %s: "+
+				"signature is calculated over the original data", alg.name)
+		}
+		if r.Header.Get(ExternalAADHeader) != "" {
+			return fmt.Errorf("external additional authenticated data can not be applied to hash requests: " +
+				"must be included in the signature structure before hashing")
+		}
+		msg.Payload = rBody
+		msg.Hash, err = getHashFromHashRequest(r.Header, rBody, alg)
+		return err
 	} else { // request contains original data
-		return s.getPayloadAndHashFromDataRequest(r.Header, rBody)
+		return s.getPayloadAndHashFromDataRequest(r.Header, rBody, alg, msg)
 	}
 }
 
-func (s *COSEService) getPayloadAndHashFromDataRequest(header http.Header, data []byte) (payload []byte, hash Sha256Sum, err error) {
+func (s *COSEService) getPayloadAndHashFromDataRequest(header http.Header, data []byte, alg *signingAlgorithm, msg *HTTPRequest) (err error) {
 	switch ContentType(header) {
 	case JSONType:
 		data, err = s.GetCBORFromJSON(data)
 		if err != nil {
-			return nil, Sha256Sum{}, fmt.Errorf("unable to CBOR encode JSON object: %v", err)
+			return fmt.Errorf("unable to CBOR encode JSON object: %v", err)
 		}
 		log.Debugf("CBOR encoded JSON: %x", data)
 
 		fallthrough
 	case CBORType:
-		toBeSigned, err := s.GetSigStructBytes(data)
+		externalAAD, err := getExternalAAD(header)
 		if err != nil {
-			return nil, Sha256Sum{}, err
+			return err
+		}
+
+		toBeSigned, err := s.GetSigStructBytes(alg.name, data, externalAAD)
+		if err != nil {
+			return err
 		}
 		log.Debugf("toBeSigned: %x", toBeSigned)
 
-		hash = sha256.Sum256(toBeSigned)
-		return data, hash, err
+		msg.Payload = data
+		msg.ToBeSigned = toBeSigned
+		msg.Hash = alg.digest(toBeSigned)
+		return nil
 	default:
-		return nil, Sha256Sum{}, fmt.Errorf("invalid content-type for original data: "+
+		return fmt.Errorf("invalid content-type for original data: "+
 			"expected (\"%s\" | \"%s\")", CBORType, JSONType)
 	}
 }
 
+type VerificationService struct {
+	*CoseVerifier
+}
+
+// verify handles verification requests for COSE objects of any known identity
+func (s *VerificationService) verify() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.handleRequest(w, r, uuid.Nil)
+	}
+}
+
+// verifyUUID handles verification requests for COSE objects of the identity
+// with the UUID from the request URL
+func (s *VerificationService) verifyUUID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := getUUID(r)
+		if err != nil {
+			log.Warn(err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		s.handleRequest(w, r, uid)
+	}
+}
+
+func (s *VerificationService) handleRequest(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	rBody, err := readBody(r)
+	if err != nil {
+		Error(uid, w, err, http.StatusBadRequest)
+		return
+	}
+
+	coseBytes, err := getCOSEFromVerificationRequest(r.Header, rBody)
+	if err != nil {
+		Error(uid, w, err, http.StatusBadRequest)
+		return
+	}
+
+	externalAAD, err := getExternalAAD(r.Header)
+	if err != nil {
+		Error(uid, w, err, http.StatusBadRequest)
+		return
+	}
+
+	resp := s.VerifyCOSE(uid, coseBytes, externalAAD)
+	sendResponse(w, resp)
+}
+
+// attachUUID handles requests to insert original data into COSE objects with detached payload
+// of the identity with the UUID from the request URL
+func (s *VerificationService) attachUUID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, err := getUUID(r)
+		if err != nil {
+			log.Warn(err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if ContentType(r.Header) != JSONType {
+			Error(uid, w, fmt.Errorf("invalid content-type: expected \"%s\"", JSONType), http.StatusBadRequest)
+			return
+		}
+
+		attachReq := AttachRequest{}
+		err = json.NewDecoder(r.Body).Decode(&attachReq)
+		if err != nil {
+			Error(uid, w, fmt.Errorf("unable to decode request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		resp := s.AttachPayload(uid, attachReq.COSE, attachReq.Payload, attachReq.ExternalAAD)
+		sendResponse(w, resp)
+	}
+}
+
+func getCOSEFromVerificationRequest(header http.Header, data []byte) (coseBytes []byte, err error) {
+	switch ContentType(header) {
+	case TextType:
+		if ContentEncoding(header) == HexEncoding {
+			coseBytes, err = hex.DecodeString(string(data))
+			if err != nil {
+				return nil, fmt.Errorf("decoding hex encoded COSE object failed: %v", err)
+			}
+		} else {
+			coseBytes, err = base64.StdEncoding.DecodeString(string(data))
+			if err != nil {
+				return nil, fmt.Errorf("decoding base64 encoded COSE object failed: %v", err)
+			}
+		}
+		return coseBytes, nil
+	case CBORType, BinType:
+		return data, nil
+	default:
+		return nil, fmt.Errorf("invalid content-type for COSE object: "+
+			"expected (\"%s\" | \"%s\" | \"%s\")", CBORType, BinType, TextType)
+	}
+}
+
 // wrapper for http.Error that additionally logs the error message to std.Output
 func Error(uid uuid.UUID, w http.ResponseWriter, err error, code int) {
 	log.Warnf("%s: %v", uid, err)
@@ -187,10 +550,33 @@ func getUUID(r *http.Request) (uuid.UUID, error) {
 	return uid, nil
 }
 
-// checkAuth checks the auth token from the request header
-// Returns error if auth token is not correct
-func checkAuth(r *http.Request, correctAuthToken string) error {
-	if r.Header.Get(AuthHeader) != correctAuthToken {
+// checkAuth checks the client certificate, if mutual TLS is enabled, and the JWT bearer token,
+// if JWT authentication is enabled and the request has one, or the auth token from the request header
+// Returns error if the client certificate or the token is not correct
+func (s *COSEService) checkAuth(r *http.Request, identity *Identity) error {
+	authorized, err := checkClientCert(r, s.clientCertAuth, identity.Uid)
+	if err != nil {
+		log.Warnf("%s: %v", identity.Uid, err)
+		return fmt.Errorf("invalid client certificate")
+	}
+	if authorized {
+		return nil
+	}
+
+	if token, found := bearerToken(r); found && s.jwtVerifier != nil {
+		err := s.jwtVerifier.Verify(token, identity.Uid)
+		if err != nil {
+			log.Warnf("%s: invalid bearer token: %v", identity.Uid, err)
+			return fmt.Errorf("invalid bearer token")
+		}
+		return nil
+	}
+
+	ok, err := s.checkAuthToken(identity, r.Header.Get(AuthHeader))
+	if err != nil {
+		log.Errorf("%s: unable to check auth token: %v", identity.Uid, err)
+	}
+	if !ok {
 		return fmt.Errorf("invalid auth token")
 	}
 	return nil
@@ -204,39 +590,100 @@ func readBody(r *http.Request) ([]byte, error) {
 	return rBody, nil
 }
 
+// readBatchBody reads the body of a batch request, which must not exceed maxBodySize bytes.
+// If it does, errBatchBodyTooLarge is returned.
+func readBatchBody(w http.ResponseWriter, r *http.Request, maxBodySize int64) ([]byte, error) {
+	if r.ContentLength > maxBodySize {
+		return nil, errBatchBodyTooLarge
+	}
+
+	rBody, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		// the body reader returns exactly maxBodySize bytes before it fails, if the body is too large
+		if int64(len(rBody)) == maxBodySize {
+			return nil, errBatchBodyTooLarge
+		}
+		return nil, fmt.Errorf("unable to read request body: %v", err)
+	}
+
+	return rBody, nil
+}
+
 func isHashRequest(r *http.Request) bool {
 	return strings.HasSuffix(r.URL.Path, HashEndpoint)
 }
 
-func getHashFromHashRequest(header http.Header, data []byte) (hash Sha256Sum, err error) {
+func isHashBatchRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, HashEndpoint+BatchEndpoint)
+}
+
+// getExternalAAD returns the base64 decoded external additional authenticated data
+// from the "X-External-AAD" header, or nil if the header is not set
+func getExternalAAD(header http.Header) ([]byte, error) {
+	externalAADBase64 := header.Get(ExternalAADHeader)
+	if externalAADBase64 == "" {
+		return nil, nil
+	}
+
+	externalAAD, err := base64.StdEncoding.DecodeString(externalAADBase64)
+	if err != nil {
+		return nil, fmt.Errorf("decoding base64 encoded external additional authenticated data failed: %v", err)
+	}
+	return externalAAD, nil
+}
+
+// isDetachedPayloadRequest checks if the request asks for a COSE object with detached (nil) payload,
+// which is requested by either the query parameter "detached" or the header "X-Detached-Payload"
+func isDetachedPayloadRequest(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get(DetachedPayloadParam)
+	if value == "" {
+		value = r.Header.Get(DetachedPayloadHeader)
+	}
+	if value == "" {
+		return false, nil
+	}
+
+	detached, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for detached payload option: %s", value)
+	}
+	return detached, nil
+}
+
+// getHashFromHashRequest returns the hash from a hash request, which must be
+// the hash of the ToBeSigned value calculated with the hash function of the signing algorithm
+func getHashFromHashRequest(header http.Header, data []byte, alg *signingAlgorithm) (hash []byte, err error) {
 	switch ContentType(header) {
 	case TextType:
 		if ContentEncoding(header) == HexEncoding {
 			data, err = hex.DecodeString(string(data))
 			if err != nil {
-				return Sha256Sum{}, fmt.Errorf("decoding hex encoded hash failed: %v (%s)", err, string(data))
+				return nil, fmt.Errorf("decoding hex encoded hash failed: %v (%s)", err, string(data))
 			}
 		} else {
 			data, err = base64.StdEncoding.DecodeString(string(data))
 			if err != nil {
-				return Sha256Sum{}, fmt.Errorf("decoding base64 encoded hash failed: %v (%s)", err, string(data))
+				return nil, fmt.Errorf("decoding base64 encoded hash failed: %v (%s)", err, string(data))
 			}
 		}
 		fallthrough
 	case BinType:
-		if len(data) != HashLen {
-			return Sha256Sum{}, fmt.Errorf("invalid SHA256 hash size: "+
-				"expected %d bytes, got %d bytes", HashLen, len(data))
-		}
-
-		copy(hash[:], data)
-		return hash, nil
+		return checkHashSize(data, alg)
 	default:
-		return Sha256Sum{}, fmt.Errorf("invalid content-type for hash: "+
+		return nil, fmt.Errorf("invalid content-type for hash: "+
 			"expected (\"%s\" | \"%s\")", BinType, TextType)
 	}
 }
 
+// checkHashSize checks if the size of the hash matches the hash function of the signing algorithm
+func checkHashSize(hash []byte, alg *signingAlgorithm) ([]byte, error) {
+	if len(hash) != alg.hash.Size() {
+		return nil, fmt.Errorf("invalid %s hash size for signing algorithm %s: "+
+			"expected %d bytes, got %d bytes", alg.hash, alg.name, alg.hash.Size(), len(hash))
+	}
+	return hash, nil
+}
+
 // forwards response to sender
 func sendResponse(w http.ResponseWriter, resp HTTPResponse) {
 	for k, v := range resp.Header {
@@ -0,0 +1,404 @@
+// Copyright (c) 2021 ubirch GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-chi/chi"
+)
+
+func TestBatchData(t *testing.T) {
+	router, coseVerifier := setupBatchRouter(t)
+
+	resp := sendBatchRequest(t, router, path.Join("/", uid.String(), CBORPath, BatchEndpoint), JSONType,
+		[]byte(`[{"a": 1}, {"b": [true, null]}, {"c": 1, "c": 2}]`))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected response status code: %d, %s", resp.Code, resp.Body.String())
+	}
+
+	var results []BatchResponseItem
+	err := json.Unmarshal(resp.Body.Bytes(), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("unexpected number of batch results: %d", len(results))
+	}
+
+	for i, result := range results[:2] {
+		if result.Status != http.StatusOK {
+			t.Errorf("batch item %d: unexpected status: %d, %s", i, result.Status, result.Error)
+		}
+		checkVerification(t, coseVerifier, uid, result.COSE, http.StatusOK)
+	}
+
+	if results[2].Status != http.StatusBadRequest || results[2].Error == "" || results[2].COSE != nil {
+		t.Errorf("invalid batch item was not reported: %+v", results[2])
+	}
+}
+
+func TestBatchHashCBOR(t *testing.T) {
+	router, _ := setupBatchRouter(t)
+
+	hash := sha256.Sum256([]byte("test"))
+	reqBody, err := cbor.Marshal([][]byte{hash[:], hash[:16]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := sendBatchRequest(t, router, path.Join("/", uid.String(), CBORPath, HashEndpoint, BatchEndpoint), CBORType, reqBody)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected response status code: %d, %s", resp.Code, resp.Body.String())
+	}
+	if resp.Header().Get("Content-Type") != CBORType {
+		t.Errorf("unexpected response content type: %s", resp.Header().Get("Content-Type"))
+	}
+
+	var results []BatchResponseItem
+	err = cbor.Unmarshal(resp.Body.Bytes(), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("unexpected number of batch results: %d", len(results))
+	}
+
+	if results[0].Status != http.StatusOK || len(results[0].COSE) == 0 {
+		t.Errorf("batch item 0: unexpected result: %+v", results[0])
+	}
+
+	if results[1].Status != http.StatusBadRequest || results[1].Error == "" {
+		t.Errorf("batch item 1: hash with invalid size was not reported: %+v", results[1])
+	}
+}
+
+func TestBatchInvalid(t *testing.T) {
+	router, _ := setupBatchRouter(t)
+
+	batchEndpoint := path.Join("/", uid.String(), CBORPath, BatchEndpoint)
+
+	resp := sendBatchRequest(t, router, batchEndpoint, JSONType, []byte(`[{"a": 1}, {"a": 2}, {"a": 3}, {"a": 4}]`))
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch exceeding maximum size was not rejected: %d", resp.Code)
+	}
+
+	resp = sendBatchRequest(t, router, batchEndpoint, JSONType, []byte(`[]`))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("empty batch was not rejected: %d", resp.Code)
+	}
+
+	resp = sendBatchRequest(t, router, batchEndpoint, TextType, []byte(`[{"a": 1}]`))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("batch with invalid content type was not rejected: %d", resp.Code)
+	}
+}
+
+func TestBatchBodyTooLarge(t *testing.T) {
+	router, _ := setupBatchRouter(t)
+
+	batchEndpoint := path.Join("/", uid.String(), CBORPath, BatchEndpoint)
+
+	// the router allows batches of 3 items
+	body := []byte(`[{"a": "` + strings.Repeat("a", 3*maxBatchItemSize) + `"}]`)
+
+	resp := sendBatchRequest(t, router, batchEndpoint, JSONType, body)
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch body exceeding maximum size was not rejected: %d", resp.Code)
+	}
+
+	// request body with unknown length
+	req := httptest.NewRequest(http.MethodPost, batchEndpoint, bytes.NewReader(body))
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", JSONType)
+	req.Header.Set(AuthHeader, "password1234")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch body with unknown length exceeding maximum size was not rejected: %d", w.Code)
+	}
+
+	// a large item is accepted, as long as the body does not exceed the limit
+	body = []byte(`[{"a": "` + strings.Repeat("a", 2*maxBatchItemSize) + `"}]`)
+
+	resp = sendBatchRequest(t, router, batchEndpoint, JSONType, body)
+	if resp.Code != http.StatusOK {
+		t.Errorf("batch body within maximum size was rejected: %d, %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestSignDetachedPayload(t *testing.T) {
+	router, coseSigner, coseVerifier := setupServiceRouter(t)
+
+	payloadCBOR, err := coseSigner.GetCBORFromJSON([]byte(payloadJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		query    string
+		header   string
+		detached bool
+	}{
+		{
+			name: "no option",
+		},
+		{
+			name:     "query parameter",
+			query:    "?" + DetachedPayloadParam + "=true",
+			detached: true,
+		},
+		{
+			name:     "header",
+			header:   "true",
+			detached: true,
+		},
+		{
+			name:     "query parameter precedes header",
+			query:    "?" + DetachedPayloadParam + "=false",
+			header:   "true",
+			detached: false,
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			header := map[string]string{"Content-Type": JSONType}
+			if c.header != "" {
+				header[DetachedPayloadHeader] = c.header
+			}
+
+			resp := sendRequest(t, router, path.Join("/", uid.String(), CBORPath)+c.query, header, []byte(payloadJSON))
+			if resp.Code != http.StatusOK {
+				t.Fatalf("unexpected response status code: %d, %s", resp.Code, resp.Body.String())
+			}
+			coseBytes := resp.Body.Bytes()
+
+			coseSign1, err := coseVerifier.decodeCOSE(coseBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !c.detached {
+				if !bytes.Equal(coseSign1.Payload, payloadCBOR) {
+					t.Errorf("unexpected payload: %x", coseSign1.Payload)
+				}
+				checkRouterVerification(t, router, coseBytes, "", http.StatusOK)
+				return
+			}
+
+			if coseSign1.Payload != nil {
+				t.Errorf("payload was not detached: %x", coseSign1.Payload)
+			}
+			checkRouterVerification(t, router, coseBytes, "", http.StatusUnprocessableEntity)
+
+			attachedCOSE := sendAttachRequest(t, router, AttachRequest{COSE: coseBytes, Payload: payloadCBOR}, http.StatusOK)
+			checkRouterVerification(t, router, attachedCOSE, "", http.StatusOK)
+		})
+	}
+
+	resp := sendRequest(t, router, path.Join("/", uid.String(), CBORPath)+"?"+DetachedPayloadParam+"=maybe",
+		map[string]string{"Content-Type": JSONType}, []byte(payloadJSON))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("invalid detached payload option was not rejected: %d", resp.Code)
+	}
+}
+
+func TestSignExternalAAD(t *testing.T) {
+	router, _, _ := setupServiceRouter(t)
+
+	externalAAD := base64.StdEncoding.EncodeToString([]byte("session-1234"))
+
+	resp := sendRequest(t, router, path.Join("/", uid.String(), CBORPath),
+		map[string]string{"Content-Type": JSONType, ExternalAADHeader: externalAAD}, []byte(payloadJSON))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected response status code: %d, %s", resp.Code, resp.Body.String())
+	}
+	coseBytes := resp.Body.Bytes()
+
+	checkRouterVerification(t, router, coseBytes, externalAAD, http.StatusOK)
+	checkRouterVerification(t, router, coseBytes, base64.StdEncoding.EncodeToString([]byte("session-5678")), http.StatusUnprocessableEntity)
+	checkRouterVerification(t, router, coseBytes, "", http.StatusUnprocessableEntity)
+
+	resp = sendRequest(t, router, path.Join("/", uid.String(), CBORPath),
+		map[string]string{"Content-Type": JSONType, ExternalAADHeader: "not base64!"}, []byte(payloadJSON))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("invalid external AAD was not rejected: %d", resp.Code)
+	}
+
+	hash := sha256.Sum256([]byte("test"))
+	resp = sendRequest(t, router, path.Join("/", uid.String(), CBORPath, HashEndpoint),
+		map[string]string{"Content-Type": BinType, ExternalAADHeader: externalAAD}, hash[:])
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("hash request with external AAD was not rejected: %d", resp.Code)
+	}
+}
+
+func TestBatchDetachedPayloadExternalAAD(t *testing.T) {
+	router, coseSigner, coseVerifier := setupServiceRouter(t)
+
+	externalAAD := []byte("session-1234")
+
+	resp := sendRequest(t, router, path.Join("/", uid.String(), CBORPath, BatchEndpoint),
+		map[string]string{
+			"Content-Type":        JSONType,
+			DetachedPayloadHeader: "true",
+			ExternalAADHeader:     base64.StdEncoding.EncodeToString(externalAAD),
+		},
+		[]byte(`[{"a": 1}, {"b": 2}]`))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("unexpected response status code: %d, %s", resp.Code, resp.Body.String())
+	}
+
+	var results []BatchResponseItem
+	err := json.Unmarshal(resp.Body.Bytes(), &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("unexpected number of batch results: %d", len(results))
+	}
+
+	for i, data := range []string{`{"a": 1}`, `{"b": 2}`} {
+		if results[i].Status != http.StatusOK {
+			t.Fatalf("batch item %d: unexpected status: %d, %s", i, results[i].Status, results[i].Error)
+		}
+
+		coseSign1, err := coseVerifier.decodeCOSE(results[i].COSE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if coseSign1.Payload != nil {
+			t.Errorf("batch item %d: payload was not detached: %x", i, coseSign1.Payload)
+		}
+
+		payloadCBOR, err := coseSigner.GetCBORFromJSON([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sendAttachRequest(t, router, AttachRequest{COSE: results[i].COSE, Payload: payloadCBOR}, http.StatusUnprocessableEntity)
+
+		attachedCOSE := sendAttachRequest(t, router, AttachRequest{COSE: results[i].COSE, Payload: payloadCBOR, ExternalAAD: externalAAD}, http.StatusOK)
+		checkRouterVerification(t, router, attachedCOSE, base64.StdEncoding.EncodeToString(externalAAD), http.StatusOK)
+	}
+}
+
+func setupBatchRouter(t *testing.T) (*chi.Mux, *CoseVerifier) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	service := &COSEService{
+		CoseSigner:   coseSigner,
+		maxBatchSize: 3,
+	}
+
+	router := chi.NewMux()
+	router.Post(path.Join(UUIDPath, CBORPath, BatchEndpoint), service.batchUUID())
+	router.Post(path.Join(UUIDPath, CBORPath, HashEndpoint, BatchEndpoint), service.batchUUID())
+
+	return router, coseVerifier
+}
+
+// setupServiceRouter returns a router with the signing, batch signing, verification and attach endpoints
+func setupServiceRouter(t *testing.T) (*chi.Mux, *CoseSigner, *CoseVerifier) {
+	coseSigner, coseVerifier := setupCoseVerifier(t)
+
+	service := &COSEService{
+		CoseSigner:   coseSigner,
+		maxBatchSize: 3,
+	}
+	verificationService := &VerificationService{
+		CoseVerifier: coseVerifier,
+	}
+
+	directUuidEndpoint := path.Join(UUIDPath, CBORPath)
+
+	router := chi.NewMux()
+	router.Post(directUuidEndpoint, service.directUUID())
+	router.Post(path.Join(directUuidEndpoint, HashEndpoint), service.directUUID())
+	router.Post(path.Join(directUuidEndpoint, BatchEndpoint), service.batchUUID())
+	router.Post(path.Join(directUuidEndpoint, VerifyEndpoint), verificationService.verifyUUID())
+	router.Post(path.Join(directUuidEndpoint, AttachEndpoint), verificationService.attachUUID())
+
+	return router, coseSigner, coseVerifier
+}
+
+func sendRequest(t *testing.T, router http.Handler, endpoint string, header map[string]string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set(AuthHeader, "password1234")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+// sendAttachRequest sends the attach request to the router and returns the completed COSE object
+func sendAttachRequest(t *testing.T, router http.Handler, attachReq AttachRequest, expectedCode int) []byte {
+	reqBody, err := json.Marshal(attachReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := sendRequest(t, router, path.Join("/", uid.String(), CBORPath, AttachEndpoint),
+		map[string]string{"Content-Type": JSONType}, reqBody)
+	if resp.Code != expectedCode {
+		t.Errorf("unexpected attach response status code: expected %d, got %d (%s)", expectedCode, resp.Code, resp.Body.String())
+	}
+
+	return resp.Body.Bytes()
+}
+
+// checkRouterVerification verifies the COSE object with the external AAD (base64 encoded, optional) at the verification endpoint
+func checkRouterVerification(t *testing.T, router http.Handler, coseBytes []byte, externalAAD string, expectedCode int) {
+	header := map[string]string{"Content-Type": CBORType}
+	if externalAAD != "" {
+		header[ExternalAADHeader] = externalAAD
+	}
+
+	resp := sendRequest(t, router, path.Join("/", uid.String(), CBORPath, VerifyEndpoint), header, coseBytes)
+	if resp.Code != expectedCode {
+		t.Errorf("unexpected verification response status code: expected %d, got %d (%s)", expectedCode, resp.Code, resp.Body.String())
+	}
+}
+
+func sendBatchRequest(t *testing.T, router http.Handler, endpoint, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(AuthHeader, "password1234")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}